@@ -3,9 +3,12 @@ package main
 /*
 	Adjust
 	- Adjust dBFS to dBSPL
-	- Add fixed offset from options
+	- Add fixed offset from options, or the per-channel offset from a
+	  calibration profile (levels calibrate)
 	- Add sensitivity from calibration files
-	- Add interpolated SPL from calibration files
+	- Add interpolated SPL from calibration files, unless the direct samples
+	  already went through the calibration filter (-calfilter)
+	- Adjust at a given frequency for spectra (per bin or band)
 */
 
 func (s *Server) adjust(channel int, dBFS float64) float64 {
@@ -13,7 +16,7 @@ func (s *Server) adjust(channel int, dBFS float64) float64 {
 
 	// Add fixed offset from options, default is 94.0
 	// FIXME: Don't know REW's default
-	dBSPL += float64(s.sploffset)
+	dBSPL += s.offset(channel)
 
 	// Add sensitivity from calibration files
 	// FIXME: I'm not sure what to do with sensitivity
@@ -21,7 +24,34 @@ func (s *Server) adjust(channel int, dBFS float64) float64 {
 
 	// Add interpolated SPL from calibration files
 	// FIXME: I'm not sure if this is correct
-	dBSPL += s.calfiles.interpolatedSPL(channel)
+	if !s.calibrationFiltered() {
+		dBSPL += s.calfiles.interpolatedSPL(channel)
+	}
 
 	return dBSPL
 }
+
+// adjustAt adjusts a level measured at a known frequency (e.g. a spectrum
+// bin) using the calibration curve at that frequency instead of -frequency
+func (s *Server) adjustAt(channel int, frequency float64, dBFS float64) float64 {
+	dBSPL := dBFS
+	dBSPL += s.offset(channel)
+	dBSPL += s.calfiles.sensitivity(channel)
+	dBSPL += s.calfiles.splAt(channel, frequency)
+	return dBSPL
+}
+
+// offset returns the SPL offset of a channel, measured by levels calibrate
+// when a profile is used, -sploffset otherwise
+func (s *Server) offset(channel int) float64 {
+	if s.offsets != nil {
+		return s.offsets[channel]
+	}
+	return float64(s.sploffset)
+}
+
+// calibrationFiltered reports whether the calibration curve is applied by the
+// correction filter on the direct path
+func (s *Server) calibrationFiltered() bool {
+	return s.direct.CalFilter != "" && s.direct.CalFilter != "off"
+}
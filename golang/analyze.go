@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+)
+
+/*
+	Offline analysis
+	- levels analyze [options] <file>
+	- Stream a WAV or FLAC recording through Server.readAudio in 2048-frame blocks
+	- Collect dBFS and dBSPL per block and per channel
+	- Summarize min, max and energy-averaged levels per channel
+	- Print as text or export as CSV or JSON
+*/
+
+// Levels below this floor (e.g. digital silence) are reported as the floor
+const levelFloor = -200.0
+
+type BlockLevels struct {
+	Block int       `json:"block"`
+	Time  float64   `json:"time"`
+	DBFS  []float64 `json:"dBFS"`
+	DBSPL []float64 `json:"dBSPL"`
+}
+
+type ChannelSummary struct {
+	Channel   string  `json:"channel"`
+	Blocks    int     `json:"blocks"`
+	MinDBFS   float64 `json:"minDBFS"`
+	MaxDBFS   float64 `json:"maxDBFS"`
+	MeanDBFS  float64 `json:"meanDBFS"`
+	MinDBSPL  float64 `json:"minDBSPL"`
+	MaxDBSPL  float64 `json:"maxDBSPL"`
+	MeanDBSPL float64 `json:"meanDBSPL"`
+}
+
+type Analysis struct {
+	File            string           `json:"file"`
+	SampleRate      float64          `json:"sampleRate"`
+	Channels        int              `json:"channels"`
+	FramesPerBuffer int              `json:"framesPerBuffer"`
+	DBFSConvention  string           `json:"dBFSConvention"`
+	Duration        float64          `json:"duration"`
+	Blocks          []BlockLevels    `json:"blocks,omitempty"`
+	Summary         []ChannelSummary `json:"summary"`
+}
+
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	frequency := fs.Int("frequency", 1000, "Frequency for calibration")
+	sploffset := fs.Int("sploffset", 94, "Fixed SPL offset")
+	profileName := fs.String("profile", "", "Rig profile name or file, sets the options not given and replaces -sploffset with its offsets")
+	calibration := registerCalibrationFlags(fs)
+	direct := registerDirectFlags(fs)
+	format := fs.String("format", "text", "Output format: text, csv or json")
+	output := fs.String("o", "", "Output file (default stdout)")
+	blocks := fs.Bool("blocks", true, "Include per-block levels")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: levels analyze [options] <file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var profile *Profile
+	if *profileName != "" {
+		var err error
+		profile, err = loadProfile(*profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyProfile(fs, profile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	directOptions, err := direct.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	directOptions.CalFilter, err = calibration.filterMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	calFiles, err := calibration.load(*frequency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := NewServer("", calFiles, *sploffset, directOptions)
+
+	if profile != nil && len(profile.Offsets) == 2 {
+		server.offsets = profile.Offsets
+	}
+
+	analysis, err := server.analyze(fs.Arg(0), 2048, *blocks)
+	if err != nil {
+		log.Fatalf("Failed to analyze %s: %v", fs.Arg(0), err)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		defer out.Close()
+	}
+
+	switch *format {
+	case "text":
+		err = analysis.writeText(out)
+	case "csv":
+		err = analysis.writeCSV(out)
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(analysis)
+	default:
+		log.Fatalf("Unknown output format '%s'", *format)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write analysis: %v", err)
+	}
+}
+
+// analyze runs a recorded file through the same chain as the live direct path
+func (s *Server) analyze(path string, framesPerBuffer int, keepBlocks bool) (*Analysis, error) {
+	file, err := openAudioFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := s.setupDirect(file.SampleRate()); err != nil {
+		return nil, err
+	}
+
+	analysis := &Analysis{
+		File:            path,
+		SampleRate:      file.SampleRate(),
+		Channels:        file.Channels(),
+		FramesPerBuffer: framesPerBuffer,
+		DBFSConvention:  s.direct.DBFS,
+	}
+
+	in := make([]float32, framesPerBuffer*file.Channels())
+	stereo := make([]float32, framesPerBuffer*2)
+
+	summaries := []*levelSummary{newLevelSummary("Left"), newLevelSummary("Right")}
+	total := 0
+
+	for block := 0; ; block++ {
+		frames, err := file.Read(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		toStereo(stereo, in, file.Channels(), frames)
+		skipped := s.calFilterSkip
+		s.readAudio(stereo[:frames*2])
+
+		// Blocks within the calibration filter delay did not reach the meters
+		measured := frames
+		if skipped > 0 {
+			measured -= skipped - s.calFilterSkip
+		}
+		if measured == 0 {
+			total += frames
+			continue
+		}
+
+		levels := BlockLevels{
+			Block: block,
+			Time:  float64(total) / file.SampleRate(),
+			DBFS:  []float64{floorLevel(s.directLeftdBFS), floorLevel(s.directRightdBFS)},
+			DBSPL: []float64{floorLevel(s.directLeftdBSPL), floorLevel(s.directRightdBSPL)},
+		}
+		for ch, summary := range summaries {
+			summary.add(levels.DBFS[ch], levels.DBSPL[ch], measured)
+		}
+		if keepBlocks {
+			analysis.Blocks = append(analysis.Blocks, levels)
+		}
+
+		total += frames
+	}
+
+	analysis.Duration = float64(total) / file.SampleRate()
+	for _, summary := range summaries {
+		analysis.Summary = append(analysis.Summary, summary.result())
+	}
+
+	return analysis, nil
+}
+
+func floorLevel(level float64) float64 {
+	if math.IsNaN(level) || level < levelFloor {
+		return levelFloor
+	}
+	return level
+}
+
+/*
+	Per channel summary
+	- Mean levels are energy averages weighted by the frames in each block
+*/
+
+type levelSummary struct {
+	ChannelSummary
+	energyFS  float64
+	energySPL float64
+	frames    int
+}
+
+func newLevelSummary(channel string) *levelSummary {
+	return &levelSummary{
+		ChannelSummary: ChannelSummary{
+			Channel:  channel,
+			MinDBFS:  math.Inf(1),
+			MaxDBFS:  math.Inf(-1),
+			MinDBSPL: math.Inf(1),
+			MaxDBSPL: math.Inf(-1),
+		},
+	}
+}
+
+func (l *levelSummary) add(dBFS, dBSPL float64, frames int) {
+	l.Blocks++
+	l.MinDBFS = math.Min(l.MinDBFS, dBFS)
+	l.MaxDBFS = math.Max(l.MaxDBFS, dBFS)
+	l.MinDBSPL = math.Min(l.MinDBSPL, dBSPL)
+	l.MaxDBSPL = math.Max(l.MaxDBSPL, dBSPL)
+	l.energyFS += math.Pow(10, dBFS/10) * float64(frames)
+	l.energySPL += math.Pow(10, dBSPL/10) * float64(frames)
+	l.frames += frames
+}
+
+func (l *levelSummary) result() ChannelSummary {
+	summary := l.ChannelSummary
+	if l.frames == 0 {
+		return ChannelSummary{Channel: l.Channel}
+	}
+	summary.MeanDBFS = floorLevel(10 * math.Log10(l.energyFS/float64(l.frames)))
+	summary.MeanDBSPL = floorLevel(10 * math.Log10(l.energySPL/float64(l.frames)))
+	return summary
+}
+
+/*
+	Output formats
+*/
+
+func (a *Analysis) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "File: %s (%.0f Hz, %d channels, %.2f s, dBFS %s)\n", a.File, a.SampleRate, a.Channels, a.Duration, a.DBFSConvention)
+
+	if len(a.Blocks) > 0 {
+		fmt.Fprintf(w, "%6s %9s %12s %12s %12s %12s\n", "Block", "Time", "Left dBFS", "Left dBSPL", "Right dBFS", "Right dBSPL")
+		for _, b := range a.Blocks {
+			fmt.Fprintf(w, "%6d %9.3f %12.2f %12.2f %12.2f %12.2f\n",
+				b.Block, b.Time, b.DBFS[0], b.DBSPL[0], b.DBFS[1], b.DBSPL[1])
+		}
+	}
+
+	for _, s := range a.Summary {
+		fmt.Fprintf(w, "%-5s %d blocks: dBFS min %7.2f max %7.2f mean %7.2f - dBSPL min %7.2f max %7.2f mean %7.2f\n",
+			s.Channel, s.Blocks, s.MinDBFS, s.MaxDBFS, s.MeanDBFS, s.MinDBSPL, s.MaxDBSPL, s.MeanDBSPL)
+	}
+
+	return nil
+}
+
+// writeCSV writes the per-block table, or the per-channel summary when the
+// blocks were not kept.
+func (a *Analysis) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+
+	if len(a.Blocks) > 0 {
+		cw.Write([]string{"block", "time", "left_dBFS", "left_dBSPL", "right_dBFS", "right_dBSPL"})
+		for _, b := range a.Blocks {
+			cw.Write([]string{strconv.Itoa(b.Block), f(b.Time), f(b.DBFS[0]), f(b.DBSPL[0]), f(b.DBFS[1]), f(b.DBSPL[1])})
+		}
+	} else {
+		cw.Write([]string{"channel", "blocks", "min_dBFS", "max_dBFS", "mean_dBFS", "min_dBSPL", "max_dBSPL", "mean_dBSPL"})
+		for _, s := range a.Summary {
+			cw.Write([]string{s.Channel, strconv.Itoa(s.Blocks), f(s.MinDBFS), f(s.MaxDBFS), f(s.MeanDBFS), f(s.MinDBSPL), f(s.MaxDBSPL), f(s.MeanDBSPL)})
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Audio files
+	- Common reader interface for recorded audio files
+	- Pick a decoder from the file extension
+*/
+
+type audioFile interface {
+	SampleRate() float64
+	Channels() int
+	// Read fills buf with interleaved frames and returns the number of frames
+	// read, or io.EOF when the file is exhausted.
+	Read(buf []float32) (int, error)
+	Close() error
+}
+
+func openAudioFile(path string) (audioFile, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".wav", ".wave":
+		return openWav(path)
+	case ".flac":
+		return openFlac(path)
+	default:
+		return nil, fmt.Errorf("unsupported audio file type: %s", path)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+	Audio sources
+	- AudioSource interface for the direct path
+	- PortAudio, audio file (WAV/FLAC) and synthetic-signal implementations
+	- Deliver interleaved float32 buffers to a handler (Server.readAudio)
+	- Pace file and synthetic sources in real time or run them as fast as possible
+	- Optional channel map picks the input channel for left and right,
+	  e.g. [1, 0] swaps them for a rig wired the other way round
+*/
+
+// defaultDevice is the PortAudio input of the E.A.R.S at its default gain
+const defaultDevice = "E.A.R.S Gain: 18dB"
+
+// AudioHandler receives one buffer of interleaved samples
+// (i.e., [left, right, left, right, ...]).
+type AudioHandler func(in []float32)
+
+// AudioSource delivers interleaved float32 frames to its handler between
+// Start and Stop.
+type AudioSource interface {
+	Start() error
+	Stop() error
+	Close() error
+	SampleRate() float64
+	Channels() int
+	FramesPerBuffer() int
+}
+
+type AudioSourceOptions struct {
+	Kind            string // "portaudio", "file" or "synth"
+	Device          string // PortAudio input device name
+	File            string // WAV or FLAC file for the "file" source
+	SampleRate      float64
+	FramesPerBuffer int
+	Frequency       float64 // Sine frequency for the "synth" source
+	Gain            float64 // Sine amplitude for the "synth" source, 1.0 is full scale
+	Realtime        bool    // Pace file and synth sources at the sample rate
+	Loop            bool    // Restart file sources at the end of the file
+	ChannelMap      []int   // Input channel for left and right, nil keeps them
+}
+
+func NewAudioSource(opts AudioSourceOptions, handler AudioHandler) (AudioSource, error) {
+	if opts.FramesPerBuffer <= 0 {
+		opts.FramesPerBuffer = 2048
+	}
+	if opts.SampleRate <= 0 {
+		opts.SampleRate = 48000
+	}
+	if opts.ChannelMap != nil {
+		if err := validateChannelMap(opts.ChannelMap); err != nil {
+			return nil, err
+		}
+		if opts.ChannelMap[0] != 0 || opts.ChannelMap[1] != 1 {
+			handler = remapChannels(opts.ChannelMap, handler)
+		}
+	}
+
+	switch opts.Kind {
+	case "", "portaudio":
+		return newPortAudioSource(opts, handler)
+	case "file", "wav":
+		return newFileSource(opts, handler)
+	case "synth":
+		return newSynthSource(opts, handler), nil
+	default:
+		return nil, fmt.Errorf("unknown audio source '%s'", opts.Kind)
+	}
+}
+
+// remapChannels wraps a handler so it receives the mapped input channels
+func remapChannels(channelMap []int, handler AudioHandler) AudioHandler {
+	var buf []float32
+	return func(in []float32) {
+		if cap(buf) < len(in) {
+			buf = make([]float32, len(in))
+		}
+		buf = buf[:len(in)]
+		for i := 0; i+1 < len(in); i += 2 {
+			buf[i] = in[i+channelMap[0]]
+			buf[i+1] = in[i+channelMap[1]]
+		}
+		handler(buf)
+	}
+}
+
+/*
+	Block pump
+	- Shared by the file and synth sources
+	- Fills a buffer via next() and hands it to the handler
+	- Sleeps between buffers when running in real time
+*/
+
+type blockPump struct {
+	sampleRate      float64
+	channels        int
+	framesPerBuffer int
+	realtime        bool
+	handler         AudioHandler
+
+	// next fills buf with interleaved frames and returns the number of
+	// frames written; 0 ends the stream.
+	next func(buf []float32) (int, error)
+
+	mu      sync.Mutex
+	running bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (p *blockPump) SampleRate() float64  { return p.sampleRate }
+func (p *blockPump) Channels() int        { return p.channels }
+func (p *blockPump) FramesPerBuffer() int { return p.framesPerBuffer }
+
+func (p *blockPump) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.running {
+		return nil
+	}
+	p.running = true
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go p.run(p.stop, p.done)
+	return nil
+}
+
+func (p *blockPump) Stop() error {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return nil
+	}
+	p.running = false
+	close(p.stop)
+	done := p.done
+	p.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+func (p *blockPump) Close() error {
+	return p.Stop()
+}
+
+// Done is closed when the stream ends, either by Stop or at the end of the data.
+func (p *blockPump) Done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+func (p *blockPump) run(stop, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]float32, p.framesPerBuffer*p.channels)
+	period := time.Duration(float64(p.framesPerBuffer) / p.sampleRate * float64(time.Second))
+	deadline := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		frames, err := p.next(buf)
+		if err != nil {
+			fmt.Printf("Audio source stopped: %v\n", err)
+			return
+		}
+		if frames == 0 {
+			return
+		}
+		// The final buffer of a file may be short
+		p.handler(buf[:frames*p.channels])
+
+		if p.realtime {
+			deadline = deadline.Add(period)
+			if wait := time.Until(deadline); wait > 0 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(wait):
+				}
+			} else {
+				deadline = time.Now()
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+	Audio source tests
+	- The synth and file sources run through setupAudio and readAudio without
+	  REW or an audio device, as fast as possible
+	- 750 Hz fits 2048-frame blocks at 48 kHz exactly, so every block reads the
+	  RMS of the sine
+	- The WAV files are written byte by byte, independent of wav_writer.go
+*/
+
+const testToneFrequency = 750
+
+func newTestServer(t *testing.T, direct DirectOptions) *Server {
+	t.Helper()
+	calFiles := NewCalfiles("ears", 1000)
+	if err := calFiles.load(); err != nil {
+		t.Fatalf("loading the calibration files: %v", err)
+	}
+	if direct.Weighting == "" {
+		direct.Weighting = "Z"
+	}
+	if direct.TimeWeighting == "" {
+		direct.TimeWeighting = "Fast"
+	}
+	if direct.DBFS == "" {
+		direct.DBFS = "rms"
+	}
+	return NewServer("", calFiles, 100, direct)
+}
+
+// writeTestWav writes a WAV file with the sample of each frame and channel,
+// format 1 is PCM with 16 or 24 bits, format 3 is 32-bit float
+func writeTestWav(t *testing.T, path string, format uint16, bits, channels, frames int, sample func(frame, channel int) float64) {
+	t.Helper()
+	bytesPerSample := bits / 8
+	data := make([]byte, 0, frames*channels*bytesPerSample)
+	for i := 0; i < frames; i++ {
+		for ch := 0; ch < channels; ch++ {
+			v := sample(i, ch)
+			switch {
+			case format == 3:
+				data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(v)))
+			case bits == 16:
+				data = binary.LittleEndian.AppendUint16(data, uint16(int16(math.Round(v*32767))))
+			case bits == 24:
+				s := int32(math.Round(v * 8388607))
+				data = append(data, byte(s), byte(s>>8), byte(s>>16))
+			}
+		}
+	}
+
+	var b []byte
+	b = append(b, "RIFF"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(36+len(data)))
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, format)
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, 48000)
+	b = binary.LittleEndian.AppendUint32(b, uint32(48000*channels*bytesPerSample))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels*bytesPerSample))
+	b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTone(gain float64) func(frame, channel int) float64 {
+	return func(frame, channel int) float64 {
+		return gain * math.Sin(2*math.Pi*testToneFrequency*float64(frame)/48000)
+	}
+}
+
+func TestSynthSource(t *testing.T) {
+	s := newTestServer(t, DirectOptions{})
+	source, err := s.setupAudio(AudioSourceOptions{
+		Kind:            "synth",
+		SampleRate:      48000,
+		FramesPerBuffer: 2048,
+		Frequency:       testToneFrequency,
+		Gain:            0.5,
+	})
+	if err != nil {
+		t.Fatalf("setupAudio: %v", err)
+	}
+	if err := source.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	source.Close()
+
+	for channel := 0; channel < 2; channel++ {
+		block, ok := s.directBlock(channel)
+		if !ok {
+			t.Fatalf("no direct levels for channel %d", channel)
+		}
+		if !near(block.DBFS, -9.03, 0.01) || !near(block.DBFSSine, -6.02, 0.01) {
+			t.Fatalf("channel %d: %.3f dBFS rms %.3f dBFS sine, want -9.03 and -6.02", channel, block.DBFS, block.DBFSSine)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   uint16
+		bits     int
+		channels int
+		want     [2]float64 // dBFS rms
+	}{
+		{"pcm16 stereo", 1, 16, 2, [2]float64{-9.03, -15.05}},
+		{"pcm24 mono", 1, 24, 1, [2]float64{-9.03, -9.03}},
+		{"float32 stereo", 3, 32, 2, [2]float64{-9.03, -15.05}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tone.wav")
+			writeTestWav(t, path, test.format, test.bits, test.channels, 10*2048, func(frame, channel int) float64 {
+				return testTone(0.5/float64(channel+1))(frame, channel)
+			})
+
+			s := newTestServer(t, DirectOptions{})
+			source, err := s.setupAudio(AudioSourceOptions{Kind: "file", File: path, FramesPerBuffer: 2048})
+			if err != nil {
+				t.Fatalf("setupAudio: %v", err)
+			}
+			defer source.Close()
+			if source.SampleRate() != 48000 {
+				t.Fatalf("sample rate %v, want 48000", source.SampleRate())
+			}
+			if err := source.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			select {
+			case <-source.(*fileSource).Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("the file source did not end")
+			}
+
+			for channel := 0; channel < 2; channel++ {
+				block, _ := s.directBlock(channel)
+				if !near(block.DBFS, test.want[channel], 0.01) {
+					t.Fatalf("channel %d: %.3f dBFS, want %.2f", channel, block.DBFS, test.want[channel])
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type DataPoint struct {
@@ -17,187 +18,384 @@ type DataPoint struct {
 
 type CalFiles struct {
 	frequency        float64
+	toneMu           sync.Mutex
+	toneFrequencies  [2]float64 // detected test tone per channel, 0 uses frequency
+	splFailing       [2]bool    // interpolatedSPL logged an error, guarded by toneMu
 	folder           string
+	format           string                     // "auto", "ears", "umik", "rew", "frd" or "csv"
+	interpolation    string                     // "linear", "cubic" or "akima"
+	extrapolation    string                     // "zero", "hold" or "error"
+	angle            int                        // 0 or 90, picks the UMIK file when a folder has both
+	sets             map[string]*calibrationSet // by compensation
+	compensations    []string                   // sorted keys of sets
+	setMu            sync.RWMutex               // guards the active set below
+	compensation     string
 	leftDataPoints   []DataPoint
+	leftCurve        *CalibrationCurve
 	leftSensitivity  float64
+	leftInfo         CalibrationInfo
 	rightDataPoints  []DataPoint
+	rightCurve       *CalibrationCurve
 	rightSensitivity float64
+	rightInfo        CalibrationInfo
 }
 
 func NewCalfiles(folder string, frequency int) *CalFiles {
 	return &CalFiles{
-		frequency: float64(frequency),
-		folder:    folder,
+		frequency:     float64(frequency),
+		folder:        folder,
+		format:        "auto",
+		interpolation: "linear",
+		extrapolation: "zero",
 	}
 }
 
-func (c *CalFiles) load() error {
-	// Load calibration files for left and right channels
+// setFormat selects the calibration file format, call it before load
+func (c *CalFiles) setFormat(format string) error {
+	format, err := calibrationFormat(format)
+	if err != nil {
+		return err
+	}
+	c.format = format
+	return nil
+}
+
+// setAngle selects the 0° or 90° file of a microphone calibrated for both,
+// call it before load
+func (c *CalFiles) setAngle(angle int) error {
+	if angle != 0 && angle != 90 {
+		return fmt.Errorf("unknown calibration angle %d, use 0 or 90", angle)
+	}
+	c.angle = angle
+	return nil
+}
 
-	// Open the directory
-	dir, err := os.Open(c.folder)
+// setCurveOptions selects the interpolation method and out of range policy of
+// the calibration curves, call it before load
+func (c *CalFiles) setCurveOptions(interpolation string, extrapolation string) error {
+	interpolation, err := curveInterpolation(interpolation)
 	if err != nil {
-		return fmt.Errorf("error opening folder: %w", err)
+		return err
 	}
-	defer dir.Close()
+	extrapolation, err = curveExtrapolation(extrapolation)
+	if err != nil {
+		return err
+	}
+	c.interpolation = interpolation
+	c.extrapolation = extrapolation
+	return nil
+}
 
-	// Read the directory contents
-	files, err := dir.Readdir(-1) // -1 means read all files and folders
+func (c *CalFiles) load() error {
+	// Load calibration files for left and right channels, from a folder or
+	// a single file used for both channels
+
+	info, err := os.Stat(c.folder)
 	if err != nil {
-		return fmt.Errorf("error reading folder contents: %w", err)
+		return fmt.Errorf("error opening folder: %w", err)
 	}
 
-	// Iterate over the files and folders
-	for _, file := range files {
-		if !file.IsDir() {
-			if strings.HasSuffix(file.Name(), ".txt") {
-				if err := c.loadFile(file); err != nil {
-					return fmt.Errorf("error loading calibration file: %v", err)
-				}
+	var paths []string
+	if info.IsDir() {
+		// Open the directory
+		dir, err := os.Open(c.folder)
+		if err != nil {
+			return fmt.Errorf("error opening folder: %w", err)
+		}
+		defer dir.Close()
+
+		// Read the directory contents
+		files, err := dir.Readdir(-1) // -1 means read all files and folders
+		if err != nil {
+			return fmt.Errorf("error reading folder contents: %w", err)
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+		// Iterate over the files and folders
+		for _, file := range files {
+			if !file.IsDir() && isCalibrationExtension(file.Name()) {
+				paths = append(paths, filepath.Join(c.folder, file.Name()))
 			}
 		}
+	} else {
+		paths = append(paths, c.folder)
 	}
 
-	if len(c.leftDataPoints) == 0 {
+	// Group the files by compensation, files without a channel fill the
+	// channels no other file of the same compensation claims. Of several
+	// files without a channel the one for the angle is used
+	sets := make(map[string]*calibrationSet)
+	shared := make(map[string][]*calibrationFile)
+	for _, path := range paths {
+		file, err := c.loadFile(path)
+		if err != nil {
+			return fmt.Errorf("error loading calibration file: %v", err)
+		}
+		key := file.info.Compensation
+		if sets[key] == nil {
+			sets[key] = &calibrationSet{compensation: key}
+		}
+		if file.channel == -1 {
+			shared[key] = append(shared[key], file)
+			continue
+		}
+		sets[key].files[file.channel] = file
+	}
+	if len(sets) == 0 {
 		return fmt.Errorf("no calibration data found for LEFT channel")
 	}
-	if len(c.rightDataPoints) == 0 {
-		return fmt.Errorf("no calibration data found for RIGHT channel")
+
+	var compensations []string
+	for key, set := range sets {
+		for channel := range set.files {
+			if set.files[channel] != nil || len(shared[key]) == 0 {
+				continue
+			}
+			file, err := c.angleFile(shared[key])
+			if err != nil {
+				return err
+			}
+			set.files[channel] = file
+		}
+		if err := set.build(c.interpolation, c.extrapolation); err != nil {
+			return err
+		}
+		compensations = append(compensations, key)
+	}
+	sort.Strings(compensations)
+
+	// All sets must come from the same unit
+	first := sets[compensations[0]].files[0].info
+	for _, key := range compensations[1:] {
+		other := sets[key].files[0].info
+		if first.Serial != "" && other.Serial != "" && first.Serial != other.Serial {
+			return fmt.Errorf("calibration files are from different units: %s has serial %s, %s has serial %s",
+				first.File, first.Serial, other.File, other.Serial)
+		}
 	}
 
-	return nil
+	c.sets = sets
+	c.compensations = compensations
+
+	// Start with HEQ when there is a choice, like the E.A.R.S default
+	active := compensations[0]
+	if _, ok := sets["HEQ"]; ok {
+		active = "HEQ"
+	}
+	return c.useCompensation(active)
 }
 
-func (c *CalFiles) loadFile(fileInfo os.FileInfo) error {
+// angleFile picks the file for the angle from files without a channel, e.g.
+// the 0° and 90° files of a UMIK
+func (c *CalFiles) angleFile(files []*calibrationFile) (*calibrationFile, error) {
+	if len(files) == 1 {
+		return files[0], nil
+	}
+	var names []string
+	var matches []*calibrationFile
+	for _, file := range files {
+		names = append(names, file.name)
+		if calibrationAngle(file.name) == c.angle {
+			matches = append(matches, file)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no %d° calibration file among %s", c.angle, strings.Join(names, ", "))
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("more than one %d° calibration file without a channel: %s and %s", c.angle, matches[0].name, matches[1].name)
+	}
+}
+
+func (c *CalFiles) loadFile(path string) (*calibrationFile, error) {
 	// Open the calibration file
-	file, err := os.Open(c.folder + "/" + fileInfo.Name())
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("error opening calibration file %s: %v", fileInfo.Name(), err)
+		return nil, fmt.Errorf("error opening calibration file %s: %v", filepath.Base(path), err)
 	}
 	defer file.Close()
 
-	sensitiviy := 0.0
-	channel := -1 // 0 for LEFT, 1 for RIGHT, -1 for unknown
-
-	// Read the calibration data line by line
-	var data []DataPoint
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Skip header and metadata lines starting with "*" or other non-data lines
-		if strings.HasPrefix(line, "*") || strings.HasPrefix(line, "\"") || len(strings.TrimSpace(line)) == 0 {
-			if strings.Contains(line, "LEFT") {
-				channel = 0
-			}
-			if strings.Contains(line, "RIGHT") {
-				channel = 1
-			}
-			if strings.Contains(line, "Sens Factor") {
-				parts := strings.Split(line, ",")
-				if len(parts) > 0 {
-					factorField := strings.TrimSpace(parts[0])
-					p := strings.Split(factorField, "=")
-					if len(p) != 2 {
-						return fmt.Errorf("invalid sensitivity data parsing factor field: %s", line)
-					}
-					numberOnly := strings.TrimSuffix(p[1], "dB")
-					sens, err := strconv.ParseFloat(numberOnly, 64)
-					if err != nil {
-						log.Fatalf("invalid sensitivity data parsing float '%s' %v", p[1], err)
-					}
-					sensitiviy = sens
-				} else {
-					return fmt.Errorf("invalid sensitivity data parsing sense factor line %s", line)
-				}
-			}
-			continue
-		}
+	return parseCalibrationFile(path, file, c.format)
+}
 
-		fields := strings.Fields(line)
-		if len(fields) != 3 {
-			return fmt.Errorf("invalid calibration data: %s", line)
-		}
-		frequency, err := strconv.ParseFloat(fields[0], 64)
-		if err != nil {
-			return fmt.Errorf("error parsing frequency: %v", err)
-		}
-		spl, err := strconv.ParseFloat(fields[1], 64)
-		if err != nil {
-			return fmt.Errorf("error parsing SPL: %v", err)
+// calibrationSet is the left and right calibration of one compensation
+type calibrationSet struct {
+	compensation string // "" for files without a compensation in the header or name
+	files        [2]*calibrationFile
+	curves       [2]*CalibrationCurve
+}
+
+// build checks that both channels are present and match, and builds the curves
+func (set *calibrationSet) build(interpolation string, extrapolation string) error {
+	label := ""
+	if set.compensation != "" {
+		label = " (" + set.compensation + ")"
+	}
+	for channel, name := range []string{"LEFT", "RIGHT"} {
+		if set.files[channel] == nil {
+			return fmt.Errorf("no calibration data found for %s channel%s", name, label)
 		}
-		phase, err := strconv.ParseFloat(fields[2], 64)
+	}
+
+	if err := verifyCalibrationInfo(set.files[0].info, set.files[1].info); err != nil {
+		return err
+	}
+
+	for channel, name := range []string{"LEFT", "RIGHT"} {
+		curve, err := NewCalibrationCurve(set.files[channel].data, interpolation, extrapolation)
 		if err != nil {
-			return fmt.Errorf("error parsing phase: %v", err)
+			return fmt.Errorf("invalid calibration data for %s channel%s: %v", name, label, err)
 		}
-		data = append(data, DataPoint{Frequency: frequency, SPL: spl, Phase: phase})
+		set.curves[channel] = curve
 	}
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading calibration file: %v", err)
+// useCompensation makes the calibration set of a compensation (e.g. "HEQ",
+// "IDF" or "RAW") the active one
+func (c *CalFiles) useCompensation(compensation string) error {
+	set, ok := c.sets[strings.ToUpper(compensation)]
+	if !ok {
+		return fmt.Errorf("no calibration files for compensation '%s', available: %s",
+			compensation, strings.Join(c.compensations, ", "))
 	}
 
-	if len(data) == 0 {
-		return fmt.Errorf("no calibration data found in file: %s", fileInfo.Name())
+	// With the error policy, a lookup frequency outside the table would fail
+	// on every audio block
+	if c.extrapolation == "error" {
+		for channel, name := range []string{"LEFT", "RIGHT"} {
+			frequency := c.toneFrequency(channel)
+			if !set.curves[channel].InRange(frequency) {
+				return fmt.Errorf("frequency %.2f Hz is outside the %s calibration table of %s with -calextrapolation error",
+					frequency, name, set.files[channel].info.File)
+			}
+		}
 	}
 
-	if channel == -1 {
-		return fmt.Errorf("no channel found in calibration file: %s", fileInfo.Name())
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+
+	c.compensation = set.compensation
+	c.leftSensitivity = set.files[0].sensitivity
+	c.leftDataPoints = set.files[0].data
+	c.leftInfo = set.files[0].info
+	c.leftCurve = set.curves[0]
+	c.rightSensitivity = set.files[1].sensitivity
+	c.rightDataPoints = set.files[1].data
+	c.rightInfo = set.files[1].info
+	c.rightCurve = set.curves[1]
+	return nil
+}
+
+// activeCompensation returns the compensation of the active calibration set
+func (c *CalFiles) activeCompensation() string {
+	c.setMu.RLock()
+	defer c.setMu.RUnlock()
+	return c.compensation
+}
+
+// availableCompensations returns the compensations found in the calibration folder
+func (c *CalFiles) availableCompensations() []string {
+	return c.compensations
+}
+
+// isCalibrationExtension reports whether a file in the calibration folder is loaded
+func isCalibrationExtension(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range calibrationExtensions {
+		if ext == e {
+			return true
+		}
 	}
+	return false
+}
 
-	if channel == 0 {
-		c.leftSensitivity = sensitiviy
-		c.leftDataPoints = data
-	} else if channel == 1 {
-		c.rightSensitivity = sensitiviy
-		c.rightDataPoints = data
-	} else {
-		return fmt.Errorf("unknown channel in calibration file: %s", fileInfo.Name())
+// setToneFrequency makes the calibration lookup follow a detected test tone,
+// frequencies outside the calibration table are rejected
+func (c *CalFiles) setToneFrequency(channel int, frequency float64) error {
+	curve := c.curve(channel)
+	if curve == nil || !curve.InRange(frequency) {
+		return fmt.Errorf("frequency %.2f is out of range", frequency)
 	}
+
+	c.toneMu.Lock()
+	c.toneFrequencies[channel] = frequency
+	c.toneMu.Unlock()
 	return nil
 }
 
-// InterpolateSPL takes a frequency and returns the interpolated SPL value.
-func interpolateSPL(frequency float64, data []DataPoint) (float64, error) {
-	if frequency < data[0].Frequency || frequency > data[len(data)-1].Frequency {
-		return 0, fmt.Errorf("frequency %.2f is out of range", frequency)
+// toneFrequency returns the frequency used for the calibration lookup
+func (c *CalFiles) toneFrequency(channel int) float64 {
+	c.toneMu.Lock()
+	defer c.toneMu.Unlock()
+
+	if c.toneFrequencies[channel] > 0 {
+		return c.toneFrequencies[channel]
 	}
+	return c.frequency
+}
 
-	// Search for the two data points surrounding the frequency
-	for i := 0; i < len(data)-1; i++ {
-		if frequency >= data[i].Frequency && frequency <= data[i+1].Frequency {
-			// Linear interpolation formula
-			x0 := data[i].Frequency
-			x1 := data[i+1].Frequency
-			y0 := data[i].SPL
-			y1 := data[i+1].SPL
+// interpolatedSPL returns the calibration at the lookup frequency, 0 when the
+// out of range policy gives an error. It runs for every audio block, so errors
+// are only logged when they start and stop
+func (c *CalFiles) interpolatedSPL(channel int) float64 {
+	spl, err := c.curve(channel).SPL(c.toneFrequency(channel))
+
+	c.toneMu.Lock()
+	changed := c.splFailing[channel] != (err != nil)
+	c.splFailing[channel] = err != nil
+	c.toneMu.Unlock()
 
-			// Interpolated SPL value
-			spl := y0 + (y1-y0)*(frequency-x0)/(x1-x0)
-			return spl, nil
+	if err != nil {
+		if changed {
+			log.Printf("Error interpolating SPL: %v", err)
 		}
+		return 0.0
+	}
+	if changed {
+		log.Printf("Interpolating SPL at %.2f Hz again", c.toneFrequency(channel))
 	}
+	return spl
+}
 
-	return 0, fmt.Errorf("frequency %.2f not found", frequency)
+// splAt returns the interpolated SPL at a frequency, 0 when the out of range
+// policy gives an error
+func (c *CalFiles) splAt(channel int, frequency float64) float64 {
+	spl, err := c.curve(channel).SPL(frequency)
+	if err != nil {
+		return 0.0
+	}
+	return spl
 }
 
-func (c *CalFiles) interpolatedSPL(channel int) float64 {
+// curve returns the calibration curve of a channel
+func (c *CalFiles) curve(channel int) *CalibrationCurve {
+	c.setMu.RLock()
+	defer c.setMu.RUnlock()
+
 	if channel == 0 {
-		spl, err := interpolateSPL(c.frequency, c.leftDataPoints)
-		if err != nil {
-			log.Printf("Error interpolating SPL: %v", err)
-			return 0.0
-		}
-		return spl
-	} else {
-		spl, err := interpolateSPL(c.frequency, c.rightDataPoints)
-		if err != nil {
-			log.Printf("Error interpolating SPL: %v", err)
-		}
-		return spl
+		return c.leftCurve
 	}
+	return c.rightCurve
+}
+
+// info returns the metadata of the calibration file of a channel
+func (c *CalFiles) info(channel int) CalibrationInfo {
+	c.setMu.RLock()
+	defer c.setMu.RUnlock()
+
+	if channel == 0 {
+		return c.leftInfo
+	}
+	return c.rightInfo
 }
 
 func (c *CalFiles) sensitivity(channel int) float64 {
+	c.setMu.RLock()
+	defer c.setMu.RUnlock()
+
 	if channel == 0 {
 		return c.leftSensitivity
 	} else {
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	Acoustic calibration
+	- levels calibrate [options]
+	- Play a known reference into the E.A.R.S, e.g. a 94 dB / 1 kHz calibrator
+	- Skip the settle time, then average the direct Leq for the duration per channel
+	- The tone frequency is detected, so the calibration curve is read at the
+	  frequency actually played
+	- Offset per channel = reference - (Leq + sensitivity + calibration curve),
+	  the value that replaces -sploffset
+	- Save the offsets to the rig profile given with -profile, or to the -o file
+	  with the options used, channels that were not calibrated keep their offset
+*/
+
+type calibrationMeasurement struct {
+	Leq            []float64 // dBFS per channel
+	Adjusted       []float64 // dBSPL per channel without offset
+	ToneFrequency  []float64
+	ToneConfidence []float64
+	Duration       float64 // seconds averaged
+}
+
+func runCalibrate(args []string) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	reference := fs.Float64("level", 94, "SPL of the reference in dB (e.g. 94 or 114 for a calibrator)")
+	frequency := fs.Int("frequency", 1000, "Frequency of the reference in Hz")
+	duration := fs.Duration("duration", 10*time.Second, "Averaging time per channel")
+	settle := fs.Duration("settle", 2*time.Second, "Time to skip before averaging")
+	channels := fs.String("channels", "both", "Channels to calibrate: both, left or right")
+	profileName := fs.String("profile", "", "Rig profile name or file, sets the options not given and receives the offsets")
+	calibration := registerCalibrationFlags(fs)
+	audioSource := registerSourceFlags(fs)
+	output := fs.String("o", "calibration.json", "Profile to write without -profile")
+	weighting := fs.String("weighting", "Z", "Frequency weighting of the calibration measurement: A, C or Z")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: levels calibrate [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// Update the rig profile, or a profile file with these options
+	path := *output
+	profile, all := &Profile{Name: strings.TrimSuffix(filepath.Base(*output), ".json")}, true
+	if *profileName != "" {
+		var err error
+		if path, err = profilePath(*profileName); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		if profile, err = loadProfile(path); err != nil {
+			log.Fatal(err)
+		}
+		all = false
+	} else if *profileName != "" {
+		log.Fatal(err)
+	}
+	if *profileName != "" {
+		if err := applyProfile(fs, profile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := profile.setFlags(fs, all); err != nil {
+		log.Fatal(err)
+	}
+	if len(profile.Offsets) != 2 {
+		profile.Offsets = []float64{94, 94}
+	}
+
+	sourceOptions, err := audioSource.options(*frequency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sourceOptions.Realtime = sourceOptions.Kind == "portaudio"
+
+	selected := []bool{true, true}
+	switch strings.ToLower(*channels) {
+	case "both":
+	case "left":
+		selected[1] = false
+	case "right":
+		selected[0] = false
+	default:
+		log.Fatalf("Unknown channels '%s'", *channels)
+	}
+
+	calFilterMode, err := calibration.filterMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	calFiles, err := calibration.load(*frequency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// No offset, so the adjusted levels show what the offset has to add
+	server := NewServer("", calFiles, 0, DirectOptions{
+		Weighting:     strings.ToUpper(*weighting),
+		TimeWeighting: "Slow",
+		AutoTone:      true,
+		CalFilter:     calFilterMode,
+	})
+
+	fmt.Printf("Play the %.1f dB / %d Hz reference, measuring for %s after %s\n", *reference, *frequency, *duration, *settle)
+	measurement, err := server.calibrate(sourceOptions, *settle, *duration)
+	if err != nil {
+		log.Fatalf("Calibration failed: %v", err)
+	}
+
+	fmt.Printf("Calibration at %.1f dBSPL, %.1f s:\n", *reference, measurement.Duration)
+	for channel, side := range []string{"Left ", "Right"} {
+		if !selected[channel] {
+			continue
+		}
+		offset := *reference - measurement.Adjusted[channel]
+		fmt.Printf("%s: Leq %7.2f dBFS tone %8.1f Hz (confidence %4.2f) offset %7.2f dB (was %7.2f dB)\n",
+			side, measurement.Leq[channel], measurement.ToneFrequency[channel], measurement.ToneConfidence[channel],
+			offset, profile.Offsets[channel])
+		if measurement.ToneConfidence[channel] < toneMinConfidence {
+			fmt.Printf("%s: warning, the signal is not a steady tone, check the calibrator\n", side)
+		}
+		profile.Offsets[channel] = offset
+	}
+
+	profile.Calibration = &ProfileCalibration{
+		Date:          time.Now(),
+		Reference:     *reference,
+		Frequency:     float64(*frequency),
+		Duration:      measurement.Duration,
+		Measured:      measurement.Leq,
+		ToneFrequency: measurement.ToneFrequency,
+		CalFiles:      *calibration.folder,
+		Compensation:  calFiles.activeCompensation(),
+		Weighting:     strings.ToUpper(*weighting),
+	}
+	if err := profile.save(path); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Saved %s, use it with -profile %s\n", path, path)
+}
+
+// calibrate runs the source through the direct path and averages the Leq of
+// each channel after the settle time
+func (s *Server) calibrate(opts AudioSourceOptions, settle, duration time.Duration) (*calibrationMeasurement, error) {
+	frames := 0
+	settled, finished := false, false
+	done := make(chan struct{})
+
+	source, err := NewAudioSource(opts, func(in []float32) {
+		// Sources keep delivering until they are stopped
+		if finished {
+			return
+		}
+		s.readAudio(in)
+
+		// Count audio time rather than wall time, so files run at any speed
+		frames += len(in) / 2
+		if !settled && float64(frames) >= settle.Seconds()*s.sampleRate {
+			s.resetDirect()
+			settled = true
+		}
+		if settled && float64(frames) >= (settle+duration).Seconds()*s.sampleRate {
+			finished = true
+			close(done)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	if err := s.setupDirect(source.SampleRate()); err != nil {
+		return nil, err
+	}
+	if err := source.Start(); err != nil {
+		return nil, err
+	}
+
+	// File sources end at the end of the data
+	var ended <-chan struct{}
+	if d, ok := source.(interface{ Done() <-chan struct{} }); ok {
+		ended = d.Done()
+	}
+	select {
+	case <-done:
+	case <-ended:
+		select {
+		case <-done:
+		default:
+			return nil, fmt.Errorf("the source ended before %s of audio", settle+duration)
+		}
+	}
+	source.Stop()
+
+	measurement := &calibrationMeasurement{}
+	for channel := 0; channel < 2; channel++ {
+		s.directMu.Lock()
+		levels := s.meters[channel].Levels()
+		s.directMu.Unlock()
+
+		frequency, confidence, _ := s.directTone(channel)
+		measurement.Leq = append(measurement.Leq, levels.Leq)
+		measurement.Adjusted = append(measurement.Adjusted, s.adjust(channel, levels.Leq))
+		measurement.ToneFrequency = append(measurement.ToneFrequency, frequency)
+		measurement.ToneConfidence = append(measurement.ToneConfidence, confidence)
+		measurement.Duration = levels.ElapsedTime
+	}
+	return measurement, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+/*
+	Calibration curve
+	- SPL and phase of a calibration file as a function of frequency
+	- Interpolation on a log frequency axis: linear, monotone cubic (Fritsch-Carlson)
+	  or Akima, located with a binary search
+	- Phase is unwrapped before it is interpolated, so it may exceed ±180°
+	- Out of range policy:
+	  - zero: no correction (0 dB, 0°) outside the table, like the original lookup
+	  - hold: the value at the nearest end of the table, clamp is an alias
+	  - error: return an error
+*/
+
+type CalibrationCurve struct {
+	points        []DataPoint // as loaded, ascending frequency
+	x             []float64   // log frequency
+	spl           []float64
+	phase         []float64 // unwrapped degrees
+	splSlopes     []float64 // tangents per log frequency for the cubic methods
+	phaseSlopes   []float64
+	interpolation string
+	extrapolation string
+}
+
+// curveInterpolation returns the canonical interpolation method name
+func curveInterpolation(method string) (string, error) {
+	switch strings.ToLower(method) {
+	case "", "linear":
+		return "linear", nil
+	case "cubic", "monotone", "pchip":
+		return "cubic", nil
+	case "akima":
+		return "akima", nil
+	default:
+		return "", fmt.Errorf("unknown calibration interpolation '%s'", method)
+	}
+}
+
+// curveExtrapolation returns the canonical out of range policy name
+func curveExtrapolation(policy string) (string, error) {
+	switch strings.ToLower(policy) {
+	case "", "zero", "none":
+		return "zero", nil
+	case "hold", "clamp":
+		return "hold", nil
+	case "error":
+		return "error", nil
+	default:
+		return "", fmt.Errorf("unknown calibration extrapolation '%s'", policy)
+	}
+}
+
+func NewCalibrationCurve(points []DataPoint, interpolation string, extrapolation string) (*CalibrationCurve, error) {
+	interpolation, err := curveInterpolation(interpolation)
+	if err != nil {
+		return nil, err
+	}
+	extrapolation, err = curveExtrapolation(extrapolation)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no calibration data")
+	}
+
+	c := &CalibrationCurve{
+		points:        points,
+		x:             make([]float64, len(points)),
+		spl:           make([]float64, len(points)),
+		phase:         make([]float64, len(points)),
+		interpolation: interpolation,
+		extrapolation: extrapolation,
+	}
+	for i, p := range points {
+		if p.Frequency <= 0 {
+			return nil, fmt.Errorf("invalid calibration frequency %.2f", p.Frequency)
+		}
+		if i > 0 && p.Frequency <= points[i-1].Frequency {
+			return nil, fmt.Errorf("calibration frequencies are not ascending at %.2f", p.Frequency)
+		}
+		c.x[i] = math.Log(p.Frequency)
+		c.spl[i] = p.SPL
+		c.phase[i] = p.Phase
+	}
+	unwrapPhase(c.phase)
+
+	switch interpolation {
+	case "cubic":
+		c.splSlopes = monotoneSlopes(c.x, c.spl)
+		c.phaseSlopes = monotoneSlopes(c.x, c.phase)
+	case "akima":
+		c.splSlopes = akimaSlopes(c.x, c.spl)
+		c.phaseSlopes = akimaSlopes(c.x, c.phase)
+	}
+
+	return c, nil
+}
+
+// WithExtrapolation returns a copy of the curve with another out of range policy
+func (c *CalibrationCurve) WithExtrapolation(policy string) (*CalibrationCurve, error) {
+	policy, err := curveExtrapolation(policy)
+	if err != nil {
+		return nil, err
+	}
+	curve := *c
+	curve.extrapolation = policy
+	return &curve, nil
+}
+
+// SPL returns the interpolated SPL in dB at a frequency
+func (c *CalibrationCurve) SPL(frequency float64) (float64, error) {
+	return c.interpolate(frequency, c.spl, c.splSlopes)
+}
+
+// Phase returns the interpolated, unwrapped phase in degrees at a frequency
+func (c *CalibrationCurve) Phase(frequency float64) (float64, error) {
+	return c.interpolate(frequency, c.phase, c.phaseSlopes)
+}
+
+// InRange reports whether a frequency is covered by the table
+func (c *CalibrationCurve) InRange(frequency float64) bool {
+	return frequency >= c.points[0].Frequency && frequency <= c.points[len(c.points)-1].Frequency
+}
+
+// Points returns the calibration data as loaded
+func (c *CalibrationCurve) Points() []DataPoint {
+	return c.points
+}
+
+func (c *CalibrationCurve) Interpolation() string {
+	return c.interpolation
+}
+
+func (c *CalibrationCurve) Extrapolation() string {
+	return c.extrapolation
+}
+
+func (c *CalibrationCurve) interpolate(frequency float64, y []float64, slopes []float64) (float64, error) {
+	n := len(c.x)
+	if !c.InRange(frequency) {
+		switch c.extrapolation {
+		case "hold":
+			if frequency < c.points[0].Frequency {
+				return y[0], nil
+			}
+			return y[n-1], nil
+		case "error":
+			return 0, fmt.Errorf("frequency %.2f is out of range", frequency)
+		default:
+			return 0, nil
+		}
+	}
+	if n == 1 {
+		return y[0], nil
+	}
+
+	// Segment i such that x[i] <= x < x[i+1]
+	x := math.Log(frequency)
+	i := sort.SearchFloat64s(c.x, x)
+	if i >= n || c.x[i] > x {
+		i--
+	}
+	if i >= n-1 {
+		return y[n-1], nil
+	}
+
+	h := c.x[i+1] - c.x[i]
+	t := (x - c.x[i]) / h
+	if slopes == nil {
+		return y[i] + t*(y[i+1]-y[i]), nil
+	}
+
+	// Cubic Hermite with the precomputed tangents
+	t2, t3 := t*t, t*t*t
+	h00 := 2*t3 - 3*t2 + 1
+	h10 := t3 - 2*t2 + t
+	h01 := -2*t3 + 3*t2
+	h11 := t3 - t2
+	return h00*y[i] + h10*h*slopes[i] + h01*y[i+1] + h11*h*slopes[i+1], nil
+}
+
+// unwrapPhase removes the 360° jumps between consecutive phases in place
+func unwrapPhase(phase []float64) {
+	offset := 0.0
+	for i := 1; i < len(phase); i++ {
+		previous := phase[i-1]
+		current := phase[i] + offset
+		for current-previous > 180 {
+			current -= 360
+			offset -= 360
+		}
+		for current-previous < -180 {
+			current += 360
+			offset += 360
+		}
+		phase[i] = current
+	}
+}
+
+// secants returns the slopes of the segments between the points
+func secants(x, y []float64) []float64 {
+	d := make([]float64, len(x)-1)
+	for i := range d {
+		d[i] = (y[i+1] - y[i]) / (x[i+1] - x[i])
+	}
+	return d
+}
+
+// monotoneSlopes returns the Fritsch-Carlson tangents, which keep the curve
+// monotone between the points (no overshoot)
+func monotoneSlopes(x, y []float64) []float64 {
+	n := len(x)
+	m := make([]float64, n)
+	if n < 2 {
+		return m
+	}
+	d := secants(x, y)
+
+	m[0] = d[0]
+	m[n-1] = d[n-2]
+	for i := 1; i < n-1; i++ {
+		if d[i-1]*d[i] <= 0 {
+			m[i] = 0
+			continue
+		}
+		// Weighted harmonic mean of the neighbouring secants
+		h0, h1 := x[i]-x[i-1], x[i+1]-x[i]
+		w0, w1 := 2*h1+h0, h1+2*h0
+		m[i] = (w0 + w1) / (w0/d[i-1] + w1/d[i])
+	}
+	return m
+}
+
+// akimaSlopes returns the Akima tangents, which follow the local trend and
+// are insensitive to outliers further away
+func akimaSlopes(x, y []float64) []float64 {
+	n := len(x)
+	m := make([]float64, n)
+	if n < 2 {
+		return m
+	}
+	if n == 2 {
+		d := (y[1] - y[0]) / (x[1] - x[0])
+		m[0], m[1] = d, d
+		return m
+	}
+
+	// Secants extended by two on each side
+	d := secants(x, y)
+	e := make([]float64, n+3)
+	copy(e[2:], d)
+	e[1] = 2*e[2] - e[3]
+	e[0] = 2*e[1] - e[2]
+	e[n+1] = 2*e[n] - e[n-1]
+	e[n+2] = 2*e[n+1] - e[n]
+
+	for i := 0; i < n; i++ {
+		w1 := math.Abs(e[i+3] - e[i+2])
+		w2 := math.Abs(e[i+1] - e[i])
+		if w1+w2 == 0 {
+			m[i] = (e[i+1] + e[i+2]) / 2
+		} else {
+			m[i] = (w1*e[i+1] + w2*e[i+2]) / (w1 + w2)
+		}
+	}
+	return m
+}
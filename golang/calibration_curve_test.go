@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// A step from 0 to 10 dB between 40 and 80 Hz with flat sides, a plain cubic
+// spline overshoots on both sides of it
+var stepCurve = []DataPoint{{10, 0, 0}, {20, 0, 0}, {40, 0, 0}, {80, 10, 0}, {160, 10, 0}, {320, 10, 0}}
+
+func TestCalibrationCurvePoints(t *testing.T) {
+	points := []DataPoint{{20, -1.5, 10}, {50, 0.3, 4}, {200, -0.2, 0}, {1000, 0, 0}, {10000, 1.7, -20}, {20000, -3, -45}}
+	for _, method := range []string{"linear", "cubic", "akima"} {
+		curve, err := NewCalibrationCurve(points, method, "error")
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		for _, p := range points {
+			spl, err := curve.SPL(p.Frequency)
+			if err != nil || math.Abs(spl-p.SPL) > 1e-9 {
+				t.Errorf("%s: SPL(%.0f) = %v, %v, want %v", method, p.Frequency, spl, err, p.SPL)
+			}
+			phase, err := curve.Phase(p.Frequency)
+			if err != nil || math.Abs(phase-p.Phase) > 1e-9 {
+				t.Errorf("%s: Phase(%.0f) = %v, %v, want %v", method, p.Frequency, phase, err, p.Phase)
+			}
+		}
+	}
+}
+
+func TestCalibrationCurveOvershoot(t *testing.T) {
+	for _, method := range []string{"cubic", "akima"} {
+		curve, err := NewCalibrationCurve(stepCurve, method, "zero")
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		previous := 0.0
+		for f := 10.0; f <= 320; f *= 1.01 {
+			spl, _ := curve.SPL(f)
+			if spl < -1e-9 || spl > 10+1e-9 {
+				t.Fatalf("%s: SPL(%.1f) = %.4f overshoots the table", method, f, spl)
+			}
+			if spl < previous-1e-9 {
+				t.Fatalf("%s: SPL(%.1f) = %.4f falls below %.4f", method, f, spl, previous)
+			}
+			if (f < 40 || f > 80) && math.Abs(spl) > 1e-9 && math.Abs(spl-10) > 1e-9 {
+				t.Fatalf("%s: SPL(%.1f) = %.4f, want the flat side", method, f, spl)
+			}
+			previous = spl
+		}
+	}
+
+	// Linear is halfway at the geometric mean of the step
+	curve, _ := NewCalibrationCurve(stepCurve, "linear", "zero")
+	if spl, _ := curve.SPL(40 * math.Sqrt2); math.Abs(spl-5) > 1e-9 {
+		t.Fatalf("linear: SPL at the geometric mean %.4f, want 5", spl)
+	}
+}
+
+func TestCalibrationCurvePhaseUnwrap(t *testing.T) {
+	// The phase wraps from +170° to -170° (190°), turns back below 180° and
+	// wraps again
+	points := []DataPoint{{100, 0, 170}, {200, 0, -170}, {400, 0, -150}, {800, 0, 170}, {1600, 0, -170}}
+	curve, err := NewCalibrationCurve(points, "linear", "zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ frequency, phase float64 }{
+		{100, 170},
+		{100 * math.Sqrt2, 180},
+		{200, 190},
+		{400, 210},
+		{800, 170},
+		{1600, 190},
+	} {
+		if phase, _ := curve.Phase(test.frequency); math.Abs(phase-test.phase) > 1e-9 {
+			t.Errorf("Phase(%.1f) = %.2f, want %.2f", test.frequency, phase, test.phase)
+		}
+	}
+
+	rising := []float64{0, 120, 240, 0, 120, 240}
+	unwrapPhase(rising)
+	for i, want := range []float64{0, 120, 240, 360, 480, 600} {
+		if rising[i] != want {
+			t.Fatalf("unwrapPhase: %v", rising)
+		}
+	}
+}
+
+func TestCalibrationCurveExtrapolation(t *testing.T) {
+	points := []DataPoint{{20, -1.5, 10}, {1000, 0, 0}, {20000, 2, -30}}
+	tests := []struct {
+		policy    string
+		low, high DataPoint // SPL and phase at 10 Hz and 40 kHz
+		fails     bool
+	}{
+		{"zero", DataPoint{10, 0, 0}, DataPoint{40000, 0, 0}, false},
+		{"none", DataPoint{10, 0, 0}, DataPoint{40000, 0, 0}, false},
+		{"hold", DataPoint{10, -1.5, 10}, DataPoint{40000, 2, -30}, false},
+		{"clamp", DataPoint{10, -1.5, 10}, DataPoint{40000, 2, -30}, false},
+		{"error", DataPoint{Frequency: 10}, DataPoint{Frequency: 40000}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			curve, err := NewCalibrationCurve(points, "akima", test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []DataPoint{test.low, test.high} {
+				if curve.InRange(want.Frequency) {
+					t.Fatalf("%.0f Hz is in range", want.Frequency)
+				}
+				spl, splErr := curve.SPL(want.Frequency)
+				phase, phaseErr := curve.Phase(want.Frequency)
+				if test.fails {
+					if splErr == nil || phaseErr == nil {
+						t.Fatalf("no error at %.0f Hz", want.Frequency)
+					}
+					continue
+				}
+				if splErr != nil || phaseErr != nil || spl != want.SPL || phase != want.Phase {
+					t.Fatalf("%.0f Hz: %v dB %v°, want %v dB %v°", want.Frequency, spl, phase, want.SPL, want.Phase)
+				}
+			}
+		})
+	}
+
+	// WithExtrapolation leaves the original curve alone
+	curve, _ := NewCalibrationCurve(points, "linear", "zero")
+	held, err := curve.WithExtrapolation("hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spl, _ := held.SPL(10); spl != -1.5 {
+		t.Fatalf("hold: SPL(10) = %v", spl)
+	}
+	if spl, _ := curve.SPL(10); spl != 0 || curve.Extrapolation() != "zero" {
+		t.Fatalf("WithExtrapolation changed the original curve")
+	}
+}
+
+func TestCalibrationCurveErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		points        []DataPoint
+		interpolation string
+		extrapolation string
+	}{
+		{"no data", nil, "linear", "zero"},
+		{"not ascending", []DataPoint{{100, 0, 0}, {50, 0, 0}}, "linear", "zero"},
+		{"zero frequency", []DataPoint{{0, 0, 0}, {50, 0, 0}}, "linear", "zero"},
+		{"unknown interpolation", stepCurve, "spline", "zero"},
+		{"unknown extrapolation", stepCurve, "linear", "mirror"},
+	}
+	for _, test := range tests {
+		if _, err := NewCalibrationCurve(test.points, test.interpolation, test.extrapolation); err == nil {
+			t.Errorf("%s: NewCalibrationCurve succeeded", test.name)
+		}
+	}
+}
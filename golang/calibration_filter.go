@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"strings"
+)
+
+/*
+	Calibration correction filter
+	- FIR filter with the calibration curve as frequency response, applied to the
+	  direct samples before the frequency weighting and level detection
+	- Same sign as the single-frequency correction in adjust: a pure tone at
+	  -frequency reads the same, broadband signals get the correction per frequency
+	- Minimum phase from the magnitude (real cepstrum), or the measured phase
+	  with a delay of half the filter length
+	- Calibration curve held at its ends beyond the table
+	- Overlap-save FFT convolution, which delays the output by one block
+	- readAudio drops the first Latency() samples, so the leading zeros never
+	  reach the meters and statistics
+*/
+
+const (
+	calFilterTaps       = 4096
+	calFilterDesignSize = 4 * calFilterTaps // FFT size for the cepstrum, limits aliasing
+)
+
+// calibrationFilterMode returns the canonical mode name
+func calibrationFilterMode(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", "off", "none":
+		return "off", nil
+	case "minphase", "minimum", "minimum-phase":
+		return "minphase", nil
+	case "measured", "phase":
+		return "measured", nil
+	default:
+		return "", fmt.Errorf("unknown calibration filter '%s'", mode)
+	}
+}
+
+type CalibrationFilter struct {
+	mode   string
+	fft    *fft
+	kernel []complex128 // FFT of the zero padded taps
+	block  int          // samples per block (the number of taps)
+
+	input  []float64    // last 2 blocks of input
+	output []float64    // filtered samples of the last block
+	pos    int          // position in the current block
+	frame  []complex128 // work buffer
+}
+
+func NewCalibrationFilter(mode string, curve *CalibrationCurve, sampleRate float64) (*CalibrationFilter, error) {
+	mode, err := calibrationFilterMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "off" {
+		return nil, fmt.Errorf("calibration filter is off")
+	}
+	if curve == nil {
+		return nil, fmt.Errorf("no calibration data for the calibration filter")
+	}
+	curve, err = curve.WithExtrapolation("hold")
+	if err != nil {
+		return nil, err
+	}
+
+	var taps []float64
+	if mode == "minphase" {
+		taps, err = minimumPhaseTaps(curve, sampleRate)
+	} else {
+		taps, err = measuredPhaseTaps(curve, sampleRate)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size := 2 * calFilterTaps
+	f, err := newFFT(size)
+	if err != nil {
+		return nil, err
+	}
+	kernel := make([]complex128, size)
+	for n, h := range taps {
+		kernel[n] = complex(h, 0)
+	}
+	f.transform(kernel)
+
+	return &CalibrationFilter{
+		mode:   mode,
+		fft:    f,
+		kernel: kernel,
+		block:  calFilterTaps,
+		input:  make([]float64, size),
+		output: make([]float64, calFilterTaps),
+		frame:  make([]complex128, size),
+	}, nil
+}
+
+// Process feeds one sample and returns the filtered sample of one block earlier
+func (c *CalibrationFilter) Process(x float64) float64 {
+	c.input[c.block+c.pos] = x
+	y := c.output[c.pos]
+	c.pos++
+	if c.pos == c.block {
+		c.convolve()
+		c.pos = 0
+	}
+	return y
+}
+
+// convolve filters the completed block, the first half of the circular
+// convolution is aliased and discarded (overlap-save)
+func (c *CalibrationFilter) convolve() {
+	for n, x := range c.input {
+		c.frame[n] = complex(x, 0)
+	}
+	c.fft.transform(c.frame)
+	for k := range c.frame {
+		c.frame[k] *= c.kernel[k]
+	}
+	c.fft.inverse(c.frame)
+	for n := range c.output {
+		c.output[n] = real(c.frame[c.block+n])
+	}
+	copy(c.input, c.input[c.block:])
+}
+
+// Latency returns the delay of the filtered signal in samples
+func (c *CalibrationFilter) Latency() int {
+	if c.mode == "measured" {
+		return c.block + c.block/2
+	}
+	return c.block
+}
+
+func (c *CalibrationFilter) Mode() string {
+	return c.mode
+}
+
+func (c *CalibrationFilter) Reset() {
+	for n := range c.input {
+		c.input[n] = 0
+	}
+	for n := range c.output {
+		c.output[n] = 0
+	}
+	c.pos = 0
+}
+
+// minimumPhaseTaps designs the minimum phase FIR with the calibration magnitude
+// by folding the real cepstrum of the log magnitude
+func minimumPhaseTaps(curve *CalibrationCurve, sampleRate float64) ([]float64, error) {
+	size := calFilterDesignSize
+	f, err := newFFT(size)
+	if err != nil {
+		return nil, err
+	}
+
+	x := make([]complex128, size)
+	for k := 0; k <= size/2; k++ {
+		spl, err := curve.SPL(float64(k) * sampleRate / float64(size))
+		if err != nil {
+			return nil, err
+		}
+		// Natural log of the magnitude
+		x[k] = complex(spl*math.Ln10/20, 0)
+		if k > 0 && k < size/2 {
+			x[size-k] = x[k]
+		}
+	}
+
+	// Real cepstrum, folded onto the positive quefrencies
+	f.inverse(x)
+	for n := 1; n < size/2; n++ {
+		x[n] *= 2
+		x[size-n] = 0
+	}
+
+	f.transform(x)
+	for k := range x {
+		x[k] = cmplx.Exp(x[k])
+	}
+	f.inverse(x)
+
+	taps := make([]float64, calFilterTaps)
+	for n := range taps {
+		taps[n] = real(x[n])
+	}
+	fadeOut(taps, calFilterTaps/8)
+	return taps, nil
+}
+
+// measuredPhaseTaps designs the FIR from the calibration magnitude and phase,
+// delayed by half the filter length to make it causal
+func measuredPhaseTaps(curve *CalibrationCurve, sampleRate float64) ([]float64, error) {
+	size := calFilterTaps
+	f, err := newFFT(size)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := float64(size / 2)
+	x := make([]complex128, size)
+	for k := 0; k <= size/2; k++ {
+		frequency := float64(k) * sampleRate / float64(size)
+		spl, err := curve.SPL(frequency)
+		if err != nil {
+			return nil, err
+		}
+		phase, err := curve.Phase(frequency)
+		if err != nil {
+			return nil, err
+		}
+		if k == 0 || k == size/2 {
+			// DC and Nyquist must be real
+			phase = 0
+		}
+		radians := phase*math.Pi/180 - 2*math.Pi*float64(k)*delay/float64(size)
+		x[k] = cmplx.Rect(math.Pow(10, spl/20), radians)
+		if k > 0 && k < size/2 {
+			x[size-k] = cmplx.Conj(x[k])
+		}
+	}
+	f.inverse(x)
+
+	taps := make([]float64, size)
+	for n := range taps {
+		// Hann window around the delayed peak
+		taps[n] = real(x[n]) * 0.5 * (1 - math.Cos(2*math.Pi*float64(n)/float64(size)))
+	}
+	return taps, nil
+}
+
+// fadeOut applies a half Hann fade to the last samples of taps
+func fadeOut(taps []float64, length int) {
+	start := len(taps) - length
+	for n := start; n < len(taps); n++ {
+		taps[n] *= 0.5 * (1 + math.Cos(math.Pi*float64(n-start)/float64(length)))
+	}
+}
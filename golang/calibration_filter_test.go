@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// 750 and 3000 Hz are on the FFT bins of both filter designs at 48 kHz, the
+// EARS curve is +0.3 and +4.7 dB there. The windowed measured phase design
+// flattens the 16.5 dB peak at 4500 Hz by about 0.01 dB
+var calFilterFrequencies = []float64{750, 3000}
+
+func TestCalibrationFilterLatency(t *testing.T) {
+	s := newTestServer(t, DirectOptions{})
+	for mode, latency := range map[string]int{"minphase": calFilterTaps, "measured": calFilterTaps + calFilterTaps/2} {
+		filter, err := NewCalibrationFilter(mode, s.calfiles.curve(0), 48000)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if filter.Latency() != latency {
+			t.Fatalf("%s: latency %d, want %d", mode, filter.Latency(), latency)
+		}
+
+		// Nothing comes out for one block, the impulse response peaks at the
+		// latency
+		peak, peakAt := 0.0, 0
+		for n := 0; n < 3*calFilterTaps; n++ {
+			x := 0.0
+			if n == 0 {
+				x = 1
+			}
+			y := filter.Process(x)
+			if n < calFilterTaps && y != 0 {
+				t.Fatalf("%s: output %v at %d, before the first block", mode, y, n)
+			}
+			if math.Abs(y) > peak {
+				peak, peakAt = math.Abs(y), n
+			}
+		}
+		if peakAt < latency || peakAt > latency+16 {
+			t.Fatalf("%s: impulse response peaks at %d, want %d", mode, peakAt, latency)
+		}
+	}
+}
+
+// runCalFilterServer feeds a 0.1 sine of the frequency through the direct
+// path and returns the integrated Leq of both channels in dBSPL, after the
+// filter transient
+func runCalFilterServer(t *testing.T, mode string, frequency float64) [2]float64 {
+	t.Helper()
+	s := newTestServer(t, DirectOptions{CalFilter: mode})
+	for channel := 0; channel < 2; channel++ {
+		if err := s.calfiles.setToneFrequency(channel, frequency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.setupDirect(48000); err != nil {
+		t.Fatalf("setupDirect: %v", err)
+	}
+	if mode != "off" && s.calFilterSkip != s.calFilters[0].Latency() {
+		t.Fatalf("%s: skipping %d samples, want %d", mode, s.calFilterSkip, s.calFilters[0].Latency())
+	}
+
+	i := 0
+	feed := func(blocks int) {
+		in := make([]float32, 2*2048)
+		for ; blocks > 0; blocks-- {
+			for n := 0; n < len(in); n += 2 {
+				x := float32(0.1 * math.Sin(2*math.Pi*frequency*float64(i)/48000))
+				in[n], in[n+1] = x, x
+				i++
+			}
+			s.readAudio(in)
+		}
+	}
+	feed(10)
+	s.resetDirect()
+	feed(24)
+	return [2]float64{s.directLevels(0).Leq, s.directLevels(1).Leq}
+}
+
+func TestCalibrationFilterLevels(t *testing.T) {
+	for _, frequency := range calFilterFrequencies {
+		adjusted := runCalFilterServer(t, "off", frequency)
+		for _, mode := range []string{"minphase", "measured"} {
+			filtered := runCalFilterServer(t, mode, frequency)
+			for channel := 0; channel < 2; channel++ {
+				if !near(filtered[channel], adjusted[channel], 0.01) {
+					t.Errorf("%s at %.0f Hz channel %d: %.3f dBSPL filtered, %.3f dBSPL adjusted",
+						mode, frequency, channel, filtered[channel], adjusted[channel])
+				}
+			}
+		}
+	}
+}
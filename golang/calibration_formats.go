@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Calibration file formats
+	- ears: miniDSP E.A.R.S, quoted "Sens Factor" and LEFT/RIGHT headers, 3 columns
+	- umik: miniDSP UMIK-1/UMIK-2, quoted "Sens Factor =...dB, SERNO: ..." header
+	- rew: generic REW .cal/.txt, 2 or 3 whitespace separated columns
+	- frd: frequency, magnitude and phase, '*' or '#' comments
+	- csv: comma, semicolon or tab separated, optional header row. Fields may
+	  be quoted, a comma within a field is a decimal comma ("1000","0,5" or
+	  1000;0,5)
+	- auto: detect from the extension and the content
+	- Files without a channel in the header or the name (L_/R_, left/right)
+	  apply to both channels
+*/
+
+// calibrationFile is the content of one calibration file
+type calibrationFile struct {
+	name        string
+	format      string
+	channel     int     // 0 for LEFT, 1 for RIGHT, -1 for both
+	sensitivity float64 // dB
+	header      []string
+	data        []DataPoint
+	info        CalibrationInfo
+}
+
+// calibrationExtensions are the file extensions loaded from a folder
+var calibrationExtensions = []string{".txt", ".cal", ".frd", ".csv"}
+
+// calibrationFormat returns the canonical format name
+func calibrationFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", "auto":
+		return "auto", nil
+	case "ears":
+		return "ears", nil
+	case "umik", "umik-1", "umik-2", "umik1", "umik2":
+		return "umik", nil
+	case "rew", "cal", "txt":
+		return "rew", nil
+	case "frd":
+		return "frd", nil
+	case "csv":
+		return "csv", nil
+	default:
+		return "", fmt.Errorf("unknown calibration format '%s'", format)
+	}
+}
+
+func parseCalibrationFile(name string, r io.Reader, format string) (*calibrationFile, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading calibration file: %v", err)
+	}
+	if len(lines) > 0 {
+		lines[0] = strings.TrimPrefix(lines[0], "\ufeff")
+	}
+
+	if format == "auto" {
+		format = detectCalibrationFormat(name, lines)
+	}
+
+	file := &calibrationFile{
+		name:    filepath.Base(name),
+		format:  format,
+		channel: channelFromName(name),
+	}
+
+	var err error
+	switch format {
+	case "ears", "umik", "rew", "frd":
+		err = file.parseColumns(lines)
+	case "csv":
+		err = file.parseCSV(lines)
+	default:
+		err = fmt.Errorf("unknown calibration format '%s'", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.data) == 0 {
+		return nil, fmt.Errorf("no calibration data found in file: %s", file.name)
+	}
+	if format == "ears" && file.channel == -1 {
+		return nil, fmt.Errorf("no channel found in calibration file: %s", file.name)
+	}
+	file.info = calibrationInfo(file)
+	return file, nil
+}
+
+// detectCalibrationFormat guesses the format from the extension and the header
+func detectCalibrationFormat(name string, lines []string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".frd":
+		return "frd"
+	case ".csv":
+		return "csv"
+	}
+
+	sens, earsChannel, data := false, false, ""
+	for _, line := range lines {
+		if isQuotedDataPoint(line) {
+			return "csv"
+		}
+		if isCalibrationHeader(line) {
+			if strings.Contains(line, "Sens Factor") {
+				sens = true
+			}
+			if headerChannel(line) != -1 {
+				earsChannel = true
+			}
+			continue
+		}
+		if data == "" && strings.TrimSpace(line) != "" {
+			data = line
+		}
+	}
+
+	switch {
+	case sens && earsChannel:
+		return "ears"
+	case sens:
+		return "umik"
+	case strings.ContainsAny(data, ",;"):
+		return "csv"
+	default:
+		return "rew"
+	}
+}
+
+// isCalibrationHeader reports comment, quoted and empty lines
+func isCalibrationHeader(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "*") || strings.HasPrefix(trimmed, "\"") ||
+		strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";")
+}
+
+// isQuotedDataPoint reports quoted CSV data rows such as "20","-1.5", which
+// isCalibrationHeader takes for a quoted header
+func isQuotedDataPoint(line string) bool {
+	if !isQuoted(line) {
+		return false
+	}
+	_, ok, err := parseDataPoint(csvFields(line, csvLineSeparator(line)))
+	return ok && err == nil
+}
+
+// channelFromName returns the channel from names like L_HEQ_... or mic_right.cal
+func channelFromName(name string) int {
+	base := strings.ToLower(filepath.Base(name))
+	switch {
+	case strings.HasPrefix(base, "l_") || strings.Contains(base, "left"):
+		return 0
+	case strings.HasPrefix(base, "r_") || strings.Contains(base, "right"):
+		return 1
+	}
+	return -1
+}
+
+// parseHeader picks the channel and sensitivity from a header line
+func (f *calibrationFile) parseHeader(line string) error {
+	if strings.TrimSpace(line) != "" {
+		f.header = append(f.header, line)
+	}
+
+	if channel := headerChannel(line); channel != -1 {
+		f.channel = channel
+	}
+	if strings.Contains(line, "Sens Factor") {
+		// "Sens Factor =-1dB, EARS Serial ..." or "Sens Factor =-1.378dB, SERNO: 7103946"
+		field := strings.Trim(strings.TrimSpace(strings.Split(line, ",")[0]), "\"")
+		p := strings.Split(field, "=")
+		if len(p) != 2 {
+			return fmt.Errorf("invalid sensitivity data parsing factor field: %s", line)
+		}
+		numberOnly := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(p[1]), "dB"))
+		sens, err := strconv.ParseFloat(numberOnly, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sensitivity data parsing float '%s' %v", p[1], err)
+		}
+		f.sensitivity = sens
+	}
+	return nil
+}
+
+// parseColumns parses whitespace separated frequency, SPL and optional phase
+func (f *calibrationFile) parseColumns(lines []string) error {
+	for _, line := range lines {
+		if isCalibrationHeader(line) {
+			if err := f.parseHeader(line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if f.format == "ears" && len(fields) != 3 {
+			return fmt.Errorf("invalid calibration data: %s", line)
+		}
+		point, ok, err := parseDataPoint(fields)
+		if err != nil {
+			return fmt.Errorf("invalid calibration data '%s': %v", line, err)
+		}
+		if !ok {
+			// Column titles of files without comment markers
+			if len(f.data) == 0 {
+				f.header = append(f.header, line)
+				continue
+			}
+			return fmt.Errorf("invalid calibration data: %s", line)
+		}
+		f.data = append(f.data, point)
+	}
+	return nil
+}
+
+// parseCSV parses separated values, quoted or not, a comma within a field is
+// a decimal separator
+func (f *calibrationFile) parseCSV(lines []string) error {
+	// The first line with more than one field decides the separator, quoted
+	// text such as a "Sens Factor =..., SERNO: ..." header does not count
+	separator := ","
+	for _, line := range lines {
+		if isCalibrationHeader(line) && !isQuoted(line) || strings.TrimSpace(unquoted(line)) == "" {
+			continue
+		}
+		separator = csvLineSeparator(line)
+		break
+	}
+
+	for _, line := range lines {
+		fields := csvFields(line, separator)
+		if isCalibrationHeader(line) {
+			if point, ok, err := parseDataPoint(fields); ok && err == nil && isQuoted(line) {
+				f.data = append(f.data, point)
+				continue
+			}
+			if err := f.parseHeader(line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		point, ok, err := parseDataPoint(fields)
+		if err != nil {
+			return fmt.Errorf("invalid calibration data '%s': %v", line, err)
+		}
+		if !ok {
+			if len(f.data) == 0 {
+				f.header = append(f.header, line)
+				continue
+			}
+			return fmt.Errorf("invalid calibration data: %s", line)
+		}
+		f.data = append(f.data, point)
+	}
+	return nil
+}
+
+func isQuoted(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "\"")
+}
+
+// unquoted returns the line without its quoted parts
+func unquoted(line string) string {
+	var b strings.Builder
+	quoted := false
+	for _, r := range line {
+		if r == '"' {
+			quoted = !quoted
+			continue
+		}
+		if !quoted {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// csvLineSeparator returns the separator outside the quotes: semicolon, tab
+// or comma
+func csvLineSeparator(line string) string {
+	outside := unquoted(line)
+	switch {
+	case strings.Contains(outside, ";"):
+		return ";"
+	case strings.Contains(outside, "\t"):
+		return "\t"
+	}
+	return ","
+}
+
+// csvFields splits a line at the separators outside the quotes, trims the
+// quotes and turns decimal commas into points
+func csvFields(line string, separator string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && string(r) == separator:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	fields = append(fields, field.String())
+	for i := range fields {
+		fields[i] = strings.ReplaceAll(strings.TrimSpace(fields[i]), ",", ".")
+	}
+	return fields
+}
+
+// parseDataPoint parses frequency, SPL and an optional phase, ok is false
+// when the first field is not a number (a column title)
+func parseDataPoint(fields []string) (DataPoint, bool, error) {
+	if len(fields) < 2 {
+		return DataPoint{}, false, nil
+	}
+	frequency, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return DataPoint{}, false, nil
+	}
+	spl, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return DataPoint{}, true, fmt.Errorf("error parsing SPL: %v", err)
+	}
+	phase := 0.0
+	if len(fields) > 2 && fields[2] != "" {
+		phase, err = strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return DataPoint{}, true, fmt.Errorf("error parsing phase: %v", err)
+		}
+	}
+	return DataPoint{Frequency: frequency, SPL: spl, Phase: phase}, true, nil
+}
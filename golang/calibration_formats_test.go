@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCalibrationFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		content     string
+		format      string
+		channel     int
+		sensitivity float64
+		data        []DataPoint
+	}{
+		{
+			name: "ears",
+			file: "L_HEQ_8604511.txt",
+			content: `"Sens Factor =-1dB, EARS Serial 860-4511, compensation HEQ V2"
+"Use this file on the LEFT channel. Your sensitive side is LEFT."
+*
+20.000 -1.50 10.0
+1000.000 0.00 0.0
+`,
+			format: "ears", channel: 0, sensitivity: -1,
+			data: []DataPoint{{20, -1.5, 10}, {1000, 0, 0}},
+		},
+		{
+			name: "umik",
+			file: "7012345.txt",
+			content: `"Sens Factor =-1.378dB, SERNO: 7012345"
+10.054	-6.2031
+1000	0
+`,
+			format: "umik", channel: -1, sensitivity: -1.378,
+			data: []DataPoint{{10.054, -6.2031, 0}, {1000, 0, 0}},
+		},
+		{
+			name:    "rew 2 columns",
+			file:    "mic.cal",
+			content: "* REW calibration\n20 -1.5\n1000 0\n",
+			format:  "rew", channel: -1,
+			data: []DataPoint{{20, -1.5, 0}, {1000, 0, 0}},
+		},
+		{
+			name:    "rew 3 columns with column titles",
+			file:    "mic_right.txt",
+			content: "Freq(Hz) SPL(dB) Phase(degrees)\n20 -1.5 12.5\n1000 0 -3\n",
+			format:  "rew", channel: 1,
+			data: []DataPoint{{20, -1.5, 12.5}, {1000, 0, -3}},
+		},
+		{
+			name:    "frd",
+			file:    "left.frd",
+			content: "* measured\n# comment\n20 -1.5 12.5\n1000 0 -3\n",
+			format:  "frd", channel: 0,
+			data: []DataPoint{{20, -1.5, 12.5}, {1000, 0, -3}},
+		},
+		{
+			name:    "csv comma",
+			file:    "mic.csv",
+			content: "Frequency,SPL,Phase\n20,-1.5,12.5\n1000,0.5,0\n",
+			format:  "csv", channel: -1,
+			data: []DataPoint{{20, -1.5, 12.5}, {1000, 0.5, 0}},
+		},
+		{
+			name:    "csv semicolon with decimal commas",
+			file:    "mic.csv",
+			content: "Frequency;SPL\n20;-1,5\n1000;0,5\n",
+			format:  "csv", channel: -1,
+			data: []DataPoint{{20, -1.5, 0}, {1000, 0.5, 0}},
+		},
+		{
+			name:    "csv tab with decimal commas",
+			file:    "mic.csv",
+			content: "Frequency\tSPL\n20\t-1,5\n1000\t0,5\n",
+			format:  "csv", channel: -1,
+			data: []DataPoint{{20, -1.5, 0}, {1000, 0.5, 0}},
+		},
+		{
+			name:    "csv quoted",
+			file:    "mic.csv",
+			content: "\"Frequency\",\"SPL\"\n\"20\",\"-1.5\"\n\"1000\",\"0.5\"\n",
+			format:  "csv", channel: -1,
+			data: []DataPoint{{20, -1.5, 0}, {1000, 0.5, 0}},
+		},
+		{
+			name:    "csv quoted with decimal commas",
+			file:    "mic.csv",
+			content: "\"Frequency\",\"SPL\"\n\"20\",\"-1,5\"\n\"1000\",\"0,5\"\n",
+			format:  "csv", channel: -1,
+			data: []DataPoint{{20, -1.5, 0}, {1000, 0.5, 0}},
+		},
+		{
+			name:    "csv quoted detected in a txt file",
+			file:    "mic.txt",
+			content: "\"20\";\"-1,5\"\n\"1000\";\"0,5\"\n",
+			format:  "csv", channel: -1,
+			data: []DataPoint{{20, -1.5, 0}, {1000, 0.5, 0}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := parseCalibrationFile(test.file, strings.NewReader(test.content), "auto")
+			if err != nil {
+				t.Fatalf("parseCalibrationFile: %v", err)
+			}
+			if file.format != test.format || file.channel != test.channel || file.sensitivity != test.sensitivity {
+				t.Fatalf("format %s channel %d sensitivity %v, want %s %d %v",
+					file.format, file.channel, file.sensitivity, test.format, test.channel, test.sensitivity)
+			}
+			if len(file.data) != len(test.data) {
+				t.Fatalf("data %v, want %v", file.data, test.data)
+			}
+			for i := range test.data {
+				if file.data[i] != test.data[i] {
+					t.Fatalf("data %v, want %v", file.data, test.data)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCalibrationFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		format  string
+	}{
+		{"no data", "mic.csv", "\"Frequency\",\"SPL\"\n", "auto"},
+		{"ears without a channel", "mic.txt", "\"Sens Factor =-1dB\"\n20 -1.5 0\n", "ears"},
+		{"ears with 2 columns", "L_HEQ_1.txt", "\"Use this file on the LEFT channel.\"\n20 -1.5\n", "ears"},
+		{"text after the data", "mic.txt", "20 -1.5\nend\n", "rew"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseCalibrationFile(test.file, strings.NewReader(test.content), test.format); err == nil {
+				t.Fatalf("parseCalibrationFile succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	Calibration file metadata
+	- Parsed from the E.A.R.S (and UMIK) header:
+	  "Sens Factor =-1dB, EARS Serial 860-4511, compensation HEQ V2"
+	  "Use this file on the LEFT channel. Your sensitive side is LEFT."
+	  * Changelog:
+	  * Version 2, 31 March 2018 : More neutral in bass
+	- Serial and compensation fall back to the file name, e.g. L_HEQ_8604511.txt
+	- Left and right files must come from the same unit (serial) and use the
+	  same compensation (HEQ, IDF, RAW, ...), version and sensitive side,
+	  otherwise loading fails
+*/
+
+type CalibrationInfo struct {
+	File          string              `json:"file"`
+	Format        string              `json:"format"`
+	Channel       string              `json:"channel"` // "LEFT", "RIGHT" or "" for both
+	Sensitivity   float64             `json:"sensitivity"`
+	Serial        string              `json:"serial,omitempty"`
+	Compensation  string              `json:"compensation,omitempty"` // e.g. "HEQ", "IDF" or "RAW"
+	Version       string              `json:"version,omitempty"`      // e.g. "V2"
+	SensitiveSide string              `json:"sensitiveSide,omitempty"`
+	Notes         []string            `json:"notes,omitempty"`
+	Changelog     []CalibrationChange `json:"changelog,omitempty"`
+}
+
+type CalibrationChange struct {
+	Version     int    `json:"version"`
+	Date        string `json:"date"`
+	Description string `json:"description"`
+}
+
+var (
+	earsSerialPattern     = regexp.MustCompile(`EARS Serial\s+([0-9A-Za-z-]+)`)
+	umikSerialPattern     = regexp.MustCompile(`SERNO:\s*([0-9A-Za-z-]+)`)
+	compensationPattern   = regexp.MustCompile(`(?i)compensation\s+([A-Za-z0-9]+)(?:\s+(V\d+))?`)
+	channelPattern        = regexp.MustCompile(`Use this file on the (LEFT|RIGHT) channel`)
+	sensitiveSidePattern  = regexp.MustCompile(`sensitive side is (LEFT|RIGHT)`)
+	changelogEntryPattern = regexp.MustCompile(`^Version\s+(\d+),\s*([^:]+?)\s*:\s*(.*)$`)
+	fileNamePattern       = regexp.MustCompile(`^[LR]_([A-Za-z0-9]+)_([0-9]+)$`)
+	anglePattern          = regexp.MustCompile(`(?i)(?:^|[^0-9])(0|90)\s*(?:deg|°)`)
+)
+
+// calibrationAngle returns the angle of incidence in the name of a calibration
+// file, e.g. 7012345_90deg.txt of a UMIK, 0 when the name has none
+func calibrationAngle(name string) int {
+	if m := anglePattern.FindStringSubmatch(name); m != nil && m[1] == "90" {
+		return 90
+	}
+	return 0
+}
+
+// headerChannel returns the channel a header line assigns the file to, -1 if none
+func headerChannel(line string) int {
+	if m := channelPattern.FindStringSubmatch(line); m != nil {
+		if m[1] == "LEFT" {
+			return 0
+		}
+		return 1
+	}
+
+	// Other mentions, but not the sensitive side which names either channel
+	line = sensitiveSidePattern.ReplaceAllString(line, "")
+	if strings.Contains(line, "LEFT") {
+		return 0
+	}
+	if strings.Contains(line, "RIGHT") {
+		return 1
+	}
+	return -1
+}
+
+// calibrationInfo collects the metadata from the header of a calibration file
+func calibrationInfo(file *calibrationFile) CalibrationInfo {
+	info := CalibrationInfo{
+		File:        file.name,
+		Format:      file.format,
+		Sensitivity: file.sensitivity,
+	}
+	switch file.channel {
+	case 0:
+		info.Channel = "LEFT"
+	case 1:
+		info.Channel = "RIGHT"
+	}
+
+	changelog := false
+	for _, line := range file.header {
+		text := strings.TrimSpace(strings.Trim(strings.TrimSpace(line), "*\""))
+
+		switch {
+		case strings.HasPrefix(line, "\""):
+			// Quoted lines hold the serial, compensation and sensitive side
+			if m := earsSerialPattern.FindStringSubmatch(text); m != nil {
+				info.Serial = strings.ReplaceAll(m[1], "-", "")
+			} else if m := umikSerialPattern.FindStringSubmatch(text); m != nil {
+				info.Serial = m[1]
+			}
+			if m := compensationPattern.FindStringSubmatch(text); m != nil {
+				info.Compensation = strings.ToUpper(m[1])
+				info.Version = strings.ToUpper(m[2])
+			}
+			if m := sensitiveSidePattern.FindStringSubmatch(text); m != nil {
+				info.SensitiveSide = m[1]
+			}
+		case strings.EqualFold(text, "Changelog:"):
+			changelog = true
+		case changelog && changelogEntryPattern.MatchString(text):
+			m := changelogEntryPattern.FindStringSubmatch(text)
+			version, _ := strconv.Atoi(m[1])
+			info.Changelog = append(info.Changelog, CalibrationChange{
+				Version:     version,
+				Date:        m[2],
+				Description: m[3],
+			})
+		case text != "" && !strings.HasPrefix(text, "Freq"):
+			changelog = false
+			info.Notes = append(info.Notes, text)
+		}
+	}
+
+	// Fall back to the file name, e.g. L_HEQ_8604511.txt
+	name := strings.TrimSuffix(file.name, filepath.Ext(file.name))
+	if m := fileNamePattern.FindStringSubmatch(name); m != nil {
+		if info.Compensation == "" {
+			info.Compensation = strings.ToUpper(m[1])
+		}
+		if info.Serial == "" {
+			info.Serial = m[2]
+		}
+	}
+
+	return info
+}
+
+// verifyCalibrationInfo checks that the left and right files belong together
+func verifyCalibrationInfo(left, right CalibrationInfo) error {
+	if left.Serial != "" && right.Serial != "" && left.Serial != right.Serial {
+		return fmt.Errorf("calibration files are from different units: LEFT %s has serial %s, RIGHT %s has serial %s",
+			left.File, left.Serial, right.File, right.Serial)
+	}
+	if left.Compensation != "" && right.Compensation != "" && left.Compensation != right.Compensation {
+		return fmt.Errorf("calibration files use different compensations: LEFT %s is %s, RIGHT %s is %s",
+			left.File, left.Compensation, right.File, right.Compensation)
+	}
+	if left.Version != "" && right.Version != "" && left.Version != right.Version {
+		return fmt.Errorf("calibration files have different versions: LEFT %s is %s, RIGHT %s is %s",
+			left.File, left.Version, right.File, right.Version)
+	}
+	if left.SensitiveSide != "" && right.SensitiveSide != "" && left.SensitiveSide != right.SensitiveSide {
+		return fmt.Errorf("calibration files disagree on the sensitive side: LEFT %s says %s, RIGHT %s says %s",
+			left.File, left.SensitiveSide, right.File, right.SensitiveSide)
+	}
+	return nil
+}
+
+// String summarizes the metadata on one line
+func (i CalibrationInfo) String() string {
+	var parts []string
+	parts = append(parts, i.File)
+	if i.Serial != "" {
+		parts = append(parts, "serial "+i.Serial)
+	}
+	if i.Compensation != "" {
+		parts = append(parts, strings.TrimSpace("compensation "+i.Compensation+" "+i.Version))
+	}
+	parts = append(parts, fmt.Sprintf("sensitivity %.2f dB", i.Sensitivity))
+	if i.SensitiveSide != "" {
+		parts = append(parts, "sensitive side "+i.SensitiveSide)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadEarsInfo parses a shipped E.A.R.S file, edit rewrites its content first
+func loadEarsInfo(t *testing.T, name string, edit func(string) string) CalibrationInfo {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("ears", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(content)
+	if edit != nil {
+		text = edit(text)
+	}
+	file, err := parseCalibrationFile(name, strings.NewReader(text), "auto")
+	if err != nil {
+		t.Fatalf("parseCalibrationFile %s: %v", name, err)
+	}
+	return file.info
+}
+
+func TestCalibrationInfoEars(t *testing.T) {
+	left := loadEarsInfo(t, "L_HEQ_8604511.txt", nil)
+	right := loadEarsInfo(t, "R_HEQ_8604511.txt", nil)
+	for channel, info := range map[string]CalibrationInfo{"LEFT": left, "RIGHT": right} {
+		if info.Channel != channel || info.Format != "ears" || info.Sensitivity != -1 {
+			t.Errorf("%s: channel %s format %s sensitivity %v", channel, info.Channel, info.Format, info.Sensitivity)
+		}
+		if info.Serial != "8604511" || info.Compensation != "HEQ" || info.Version != "V2" || info.SensitiveSide != "LEFT" {
+			t.Errorf("%s: serial %s compensation %s %s sensitive side %s", channel, info.Serial, info.Compensation, info.Version, info.SensitiveSide)
+		}
+		want := []CalibrationChange{{1, "24 Feb 2018", "Initial version"}, {2, "31 March 2018", "More neutral in bass"}}
+		if len(info.Changelog) != len(want) || info.Changelog[0] != want[0] || info.Changelog[1] != want[1] {
+			t.Errorf("%s: changelog %+v", channel, info.Changelog)
+		}
+		if len(info.Notes) == 0 || !strings.HasPrefix(info.Notes[0], "HEQ: Default headphone compensation") {
+			t.Errorf("%s: notes %q", channel, info.Notes)
+		}
+	}
+	if err := verifyCalibrationInfo(left, right); err != nil {
+		t.Fatalf("verifyCalibrationInfo: %v", err)
+	}
+	if s := left.String(); s != "L_HEQ_8604511.txt, serial 8604511, compensation HEQ V2, sensitivity -1.00 dB, sensitive side LEFT" {
+		t.Fatalf("String: %s", s)
+	}
+}
+
+func TestCalibrationInfoMismatch(t *testing.T) {
+	left := loadEarsInfo(t, "L_HEQ_8604511.txt", nil)
+	tests := []struct {
+		name  string
+		old   string
+		new   string
+		error string
+	}{
+		{"serial", "EARS Serial 860-4511", "EARS Serial 860-4512", "different units"},
+		{"compensation", "compensation HEQ V2", "compensation IDF V2", "different compensations"},
+		{"version", "compensation HEQ V2", "compensation HEQ V1", "different versions"},
+		{"sensitive side", "sensitive side is LEFT", "sensitive side is RIGHT", "sensitive side"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			right := loadEarsInfo(t, "R_HEQ_8604511.txt", func(content string) string {
+				return strings.Replace(content, test.old, test.new, 1)
+			})
+			err := verifyCalibrationInfo(left, right)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("verifyCalibrationInfo: %v, want %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestCalibrationInfoHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         string
+		content      string
+		serial       string
+		compensation string
+		version      string
+	}{
+		{
+			name:    "umik serial",
+			file:    "7012345.txt",
+			content: "\"Sens Factor =-1.378dB, SERNO: 7012345\"\n20 -1.5\n",
+			serial:  "7012345",
+		},
+		{
+			name:         "compensation without a version",
+			file:         "mic.txt",
+			content:      "\"EARS Serial 860-1234, Compensation idf\"\n20 -1.5\n",
+			serial:       "8601234",
+			compensation: "IDF",
+		},
+		{
+			name:         "file name",
+			file:         "R_RAW_8601234.txt",
+			content:      "\"Use this file on the RIGHT channel.\"\n20 -1.5 0\n",
+			serial:       "8601234",
+			compensation: "RAW",
+		},
+		{
+			name:    "no metadata",
+			file:    "mic.cal",
+			content: "* compensation HEQ V2 outside quotes\n20 -1.5\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := parseCalibrationFile(test.file, strings.NewReader(test.content), "auto")
+			if err != nil {
+				t.Fatalf("parseCalibrationFile: %v", err)
+			}
+			info := file.info
+			if info.Serial != test.serial || info.Compensation != test.compensation || info.Version != test.version {
+				t.Fatalf("serial %q compensation %q %q, want %q %q %q",
+					info.Serial, info.Compensation, info.Version, test.serial, test.compensation, test.version)
+			}
+		})
+	}
+}
+
+func TestHeaderChannel(t *testing.T) {
+	for line, want := range map[string]int{
+		"Use this file on the LEFT channel. Your sensitive side is RIGHT.": 0,
+		"Use this file on the RIGHT channel. Your sensitive side is LEFT.": 1,
+		"Your sensitive side is LEFT.":                                     -1,
+		"RIGHT ear":                                                        1,
+		"Sens Factor =-1dB":                                                -1,
+	} {
+		if got := headerChannel(line); got != want {
+			t.Errorf("headerChannel(%q) = %d, want %d", line, got, want)
+		}
+	}
+}
+
+func TestCalibrationAngle(t *testing.T) {
+	for name, want := range map[string]int{
+		"7012345_90deg.txt": 90,
+		"7012345_0deg.txt":  0,
+		"7012345 90°.txt":   90,
+		"7012345.txt":       0,
+		"7012390deg.txt":    0,
+	} {
+		if got := calibrationAngle(name); got != want {
+			t.Errorf("calibrationAngle(%q) = %d, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+	Raw audio capture
+	- -capture <folder> writes the interleaved stereo input of the direct path
+	  (after -channelmap, before the calibration filter and weighting) to WAV
+	- 32-bit float (-captureformat float32) or 24-bit PCM (-captureformat pcm24)
+	- The bext chunk holds the time of the first sample, so the audio lines up
+	  with the session recording and the REW webhooks
+	- Buffers are copied in the audio callback and go through a writeQueue,
+	  a full queue drops the buffer instead of stalling PortAudio
+	- A new file is started before the 4 GiB WAV limit (about 3 hours of
+	  float32 stereo at 48 kHz), named levels-<start>-<part>.wav
+*/
+
+// captureQueue is the number of buffers waiting for the writer, about 10 s
+// of 2048-frame buffers at 48 kHz
+const captureQueue = 256
+
+type captureBuffer struct {
+	t       time.Time // arrival of the buffer, i.e. the time of its last sample
+	samples []float32
+}
+
+type AudioCapture struct {
+	folder      string
+	format      string
+	sampleRate  float64
+	session     string
+	description string
+
+	queue *writeQueue[captureBuffer]
+	pool  sync.Pool
+
+	mu   sync.Mutex
+	path string // file being written, changed by the writer on rotation
+
+	// Owned by the writer goroutine
+	wav   *wavWriter
+	part  int
+	start time.Time // time of the first sample of the current file
+}
+
+func NewAudioCapture(folder, format string, sampleRate float64, description string) (*AudioCapture, error) {
+	format, err := wavFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, fmt.Errorf("error creating capture folder: %v", err)
+	}
+
+	c := &AudioCapture{
+		folder:      folder,
+		format:      format,
+		sampleRate:  sampleRate,
+		session:     time.Now().Format("20060102-150405"),
+		description: description,
+		queue:       newWriteQueue[captureBuffer]("Capture", "buffers", captureQueue),
+	}
+	c.path = c.partPath(1)
+
+	c.queue.Start(c.writeBuffer, nil)
+	return c, nil
+}
+
+// Write queues a copy of the buffer without blocking
+func (c *AudioCapture) Write(in []float32) {
+	buf, _ := c.pool.Get().([]float32)
+	if cap(buf) < len(in) {
+		buf = make([]float32, len(in))
+	}
+	buf = buf[:len(in)]
+	copy(buf, in)
+
+	if !c.queue.Push(captureBuffer{time.Now(), buf}) {
+		c.pool.Put(buf)
+	}
+}
+
+// Close writes the queued buffers and finishes the file
+func (c *AudioCapture) Close() error {
+	if !c.queue.Close() || c.wav == nil {
+		return nil
+	}
+	return c.wav.Close()
+}
+
+// Path returns the file being written, the first file is created with the
+// first buffer
+func (c *AudioCapture) Path() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.path
+}
+
+func (c *AudioCapture) partPath(part int) string {
+	return filepath.Join(c.folder, fmt.Sprintf("levels-%s-%03d.wav", c.session, part))
+}
+
+// writeBuffer writes a queued buffer and returns it to the pool
+func (c *AudioCapture) writeBuffer(buf captureBuffer) error {
+	err := c.write(buf)
+	c.pool.Put(buf.samples)
+	return err
+}
+
+func (c *AudioCapture) write(buf captureBuffer) error {
+	if c.wav == nil {
+		frames := len(buf.samples) / 2
+		first := buf.t.Add(-time.Duration(float64(frames) / c.sampleRate * float64(time.Second)))
+		if err := c.open(first); err != nil {
+			return err
+		}
+	}
+	if c.wav.Full(len(buf.samples)) {
+		next := c.start.Add(time.Duration(float64(c.wav.Frames()) / c.sampleRate * float64(time.Second)))
+		if err := c.wav.Close(); err != nil {
+			return err
+		}
+		c.wav = nil
+		if err := c.open(next); err != nil {
+			return err
+		}
+	}
+	return c.wav.Write(buf.samples)
+}
+
+// open starts the next part at the time of its first sample
+func (c *AudioCapture) open(start time.Time) error {
+	c.part++
+	c.start = start
+	path := c.partPath(c.part)
+	c.mu.Lock()
+	c.path = path
+	c.mu.Unlock()
+	bits := 32
+	if c.format == "pcm24" {
+		bits = 24
+	}
+	wav, err := createWav(path, c.format, 2, c.sampleRate, BextInfo{
+		Description:         c.description,
+		Originator:          "levels",
+		OriginatorReference: fmt.Sprintf("%s-%03d", c.session, c.part),
+		Origination:         start,
+		CodingHistory:       fmt.Sprintf("A=PCM,F=%.0f,W=%d,M=stereo,T=levels direct path\r\n", c.sampleRate, bits),
+	})
+	if err != nil {
+		return err
+	}
+	c.wav = wav
+	return nil
+}
+
+/*
+	Server wiring
+*/
+
+// setupCapture starts capturing the direct path input to folder
+func (s *Server) setupCapture(folder, format string) error {
+	description := fmt.Sprintf("levels direct path, calibration %s/%s, compensation %s, weighting %s",
+		s.calfiles.info(0).File, s.calfiles.info(1).File, s.calfiles.activeCompensation(), s.direct.Weighting)
+	capture, err := NewAudioCapture(folder, format, s.sampleRate, description)
+	if err != nil {
+		return err
+	}
+	s.capture = capture
+	log.Printf("Capturing audio to %s\n", capture.Path())
+	return nil
+}
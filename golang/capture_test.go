@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAudioCapture(t *testing.T) {
+	folder := t.TempDir()
+	c, err := NewAudioCapture(folder, "pcm24", 48000, "levels test")
+	if err != nil {
+		t.Fatalf("NewAudioCapture: %v", err)
+	}
+	first := c.Path()
+
+	// The buffer is copied, so the caller may reuse it right away
+	in := make([]float32, 2*512)
+	for block := 0; block < 8; block++ {
+		for i := range in {
+			in[i] = float32(block) / 10
+		}
+		c.Write(in)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if c.Path() != first {
+		t.Fatalf("Path %s, want %s", c.Path(), first)
+	}
+	c.Write(in)
+
+	chunks := wavChunks(t, first)
+	if description := string(chunks["bext"][:11]); description != "levels test" {
+		t.Fatalf("bext description %q", description)
+	}
+	r, err := openWav(first)
+	if err != nil {
+		t.Fatalf("openWav: %v", err)
+	}
+	defer r.Close()
+	read := make([]float32, 2*512)
+	for block := 0; block < 8; block++ {
+		n, err := r.Read(read)
+		if err != nil || n != 512 {
+			t.Fatalf("block %d: %d frames, %v", block, n, err)
+		}
+		if !near(float64(read[0]), float64(block)/10, 1e-6) || !near(float64(read[1023]), float64(block)/10, 1e-6) {
+			t.Fatalf("block %d reads %v, want %v", block, read[0], float64(block)/10)
+		}
+	}
+	if files, _ := os.ReadDir(folder); len(files) != 1 {
+		t.Fatalf("%d files, want 1", len(files))
+	}
+}
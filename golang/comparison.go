@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Direct vs REW comparison
+	- Keep the direct dBFS (in both conventions) and dBSPL per channel with
+	  the time of each block
+	- Pair every REW webhook sample with the direct level at the same time,
+	  interpolated between blocks, optionally shifted by -comparelag
+	- Running mean difference (direct - REW), standard deviation, drift of
+	  the difference (dB per minute) and correlation per channel
+	- Flag when the difference leaves the -tolerance band and when it returns
+	- REW dBFS is compared with the rms and the sine convention, the report
+	  names the convention REW matches
+	- End-of-run report as text and optionally as JSON (-comparereport)
+	- GET /comparison returns the running statistics
+*/
+
+// Compared quantities
+const (
+	compareDBFSRMS = iota
+	compareDBFSSine
+	compareDBSPL
+)
+
+var (
+	comparisonQuantities = []string{"dBFS_RMS", "dBFS_Sine", "dBSPL"}
+	comparisonChannels   = []string{"Left", "Right"}
+)
+
+// comparisonHistory is the time the direct levels are kept for pairing
+const comparisonHistory = 10 * time.Second
+
+type ComparisonStats struct {
+	Quantity       string  `json:"quantity"` // "dBFS_RMS", "dBFS_Sine" or "dBSPL"
+	Channel        string  `json:"channel"`  // "Left" or "Right"
+	Pairs          int     `json:"pairs"`
+	Duration       float64 `json:"duration"`       // seconds between the first and last pair
+	MeanDifference float64 `json:"meanDifference"` // direct - REW in dB
+	StdDeviation   float64 `json:"stdDeviation"`
+	Drift          float64 `json:"drift"`       // change of the difference in dB per minute
+	Correlation    float64 `json:"correlation"` // Pearson correlation of the levels
+	MinDifference  float64 `json:"minDifference"`
+	MaxDifference  float64 `json:"maxDifference"`
+	LastDifference float64 `json:"lastDifference"`
+	Exceeded       int     `json:"exceeded"`       // pairs outside the tolerance
+	ExceededTime   float64 `json:"exceededTime"`   // seconds outside the tolerance
+	OutOfTolerance bool    `json:"outOfTolerance"` // the last pair is outside the tolerance
+}
+
+type ComparisonReport struct {
+	Tolerance     float64           `json:"tolerance"`
+	Lag           float64           `json:"lag"`        // seconds the direct levels are shifted
+	Convention    string            `json:"convention"` // dBFS convention of the direct metrics
+	REWConvention string            `json:"rewConvention,omitempty"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	Stats         []ComparisonStats `json:"stats"`
+}
+
+type timedLevel struct {
+	t     time.Time
+	level float64
+}
+
+// comparisonSeries accumulates the pairs of one quantity and channel with
+// Welford updates, so long sessions stay accurate
+type comparisonSeries struct {
+	pairs          int
+	first, last    time.Time
+	meanDirect     float64
+	meanREW        float64
+	meanDiff       float64
+	meanT          float64
+	m2Direct       float64
+	m2REW          float64
+	m2Diff         float64
+	m2T            float64
+	coDirectREW    float64
+	coTDiff        float64
+	minDiff        float64
+	maxDiff        float64
+	lastDiff       float64
+	exceeded       int
+	exceededTime   float64
+	outOfTolerance bool
+}
+
+func (c *comparisonSeries) add(t time.Time, direct, rew, tolerance float64) {
+	if c.pairs == 0 {
+		c.first = t
+		c.minDiff, c.maxDiff = math.Inf(1), math.Inf(-1)
+	} else if c.outOfTolerance {
+		c.exceededTime += t.Sub(c.last).Seconds()
+	}
+	c.pairs++
+	c.last = t
+
+	n := float64(c.pairs)
+	elapsed := t.Sub(c.first).Minutes()
+	diff := direct - rew
+
+	dDirect := direct - c.meanDirect
+	dREW := rew - c.meanREW
+	dDiff := diff - c.meanDiff
+	dT := elapsed - c.meanT
+	c.meanDirect += dDirect / n
+	c.meanREW += dREW / n
+	c.meanDiff += dDiff / n
+	c.meanT += dT / n
+	c.m2Direct += dDirect * (direct - c.meanDirect)
+	c.m2REW += dREW * (rew - c.meanREW)
+	c.m2Diff += dDiff * (diff - c.meanDiff)
+	c.m2T += dT * (elapsed - c.meanT)
+	c.coDirectREW += dDirect * (rew - c.meanREW)
+	c.coTDiff += dT * (diff - c.meanDiff)
+
+	c.minDiff = math.Min(c.minDiff, diff)
+	c.maxDiff = math.Max(c.maxDiff, diff)
+	c.lastDiff = diff
+	c.outOfTolerance = math.Abs(diff) > tolerance
+	if c.outOfTolerance {
+		c.exceeded++
+	}
+}
+
+func (c *comparisonSeries) stats(quantity, channel string) ComparisonStats {
+	stats := ComparisonStats{
+		Quantity:       quantity,
+		Channel:        channel,
+		Pairs:          c.pairs,
+		Exceeded:       c.exceeded,
+		ExceededTime:   c.exceededTime,
+		OutOfTolerance: c.outOfTolerance,
+	}
+	if c.pairs == 0 {
+		return stats
+	}
+	stats.Duration = c.last.Sub(c.first).Seconds()
+	stats.MeanDifference = c.meanDiff
+	stats.MinDifference = c.minDiff
+	stats.MaxDifference = c.maxDiff
+	stats.LastDifference = c.lastDiff
+	if c.pairs > 1 {
+		stats.StdDeviation = math.Sqrt(c.m2Diff / float64(c.pairs-1))
+	}
+	if c.m2T > 0 {
+		stats.Drift = c.coTDiff / c.m2T
+	}
+	if c.m2Direct > 0 && c.m2REW > 0 {
+		stats.Correlation = c.coDirectREW / math.Sqrt(c.m2Direct*c.m2REW)
+	}
+	return stats
+}
+
+type Comparator struct {
+	mu         sync.Mutex
+	tolerance  float64       // dB
+	convention string        // dBFS convention of the direct metrics
+	lag        time.Duration // REW samples are compared with the direct level this much earlier
+	start      time.Time
+	history    [3][2][]timedLevel      // per quantity and channel
+	series     [3][2]*comparisonSeries // per quantity and channel
+	onChange   func(ComparisonStats)   // called when a series leaves or returns to the tolerance
+}
+
+func NewComparator(tolerance float64, lag time.Duration) *Comparator {
+	c := &Comparator{
+		tolerance: tolerance,
+		lag:       lag,
+	}
+	c.Reset()
+	return c
+}
+
+func (c *Comparator) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.start = time.Now()
+	for q := range c.series {
+		for channel := range c.series[q] {
+			c.series[q][channel] = &comparisonSeries{}
+			c.history[q][channel] = nil
+		}
+	}
+}
+
+// AddDirect stores a direct level of a block ending at t
+func (c *Comparator) AddDirect(quantity, channel int, t time.Time, level float64) {
+	if math.IsInf(level, 0) || math.IsNaN(level) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	history := append(c.history[quantity][channel], timedLevel{t, level})
+	expired := 0
+	for expired < len(history)-1 && t.Sub(history[expired].t) > comparisonHistory {
+		expired++
+	}
+	c.history[quantity][channel] = history[expired:]
+}
+
+// AddREW pairs a REW level received at t with the direct level at t - lag,
+// ok is false when there is no direct level for that time yet
+func (c *Comparator) AddREW(quantity, channel int, t time.Time, level float64) (ComparisonStats, bool) {
+	if math.IsInf(level, 0) || math.IsNaN(level) {
+		return ComparisonStats{}, false
+	}
+	c.mu.Lock()
+	direct, ok := c.directAt(quantity, channel, t.Add(-c.lag))
+	if !ok {
+		c.mu.Unlock()
+		return ComparisonStats{}, false
+	}
+	series := c.series[quantity][channel]
+	was := series.outOfTolerance
+	series.add(t, direct, level, c.tolerance)
+	stats := series.stats(comparisonQuantities[quantity], comparisonChannels[channel])
+	onChange := c.onChange
+	c.mu.Unlock()
+
+	if onChange != nil && stats.OutOfTolerance != was {
+		onChange(stats)
+	}
+	return stats, true
+}
+
+// directAt interpolates the direct level at t
+func (c *Comparator) directAt(quantity, channel int, t time.Time) (float64, bool) {
+	history := c.history[quantity][channel]
+	if len(history) == 0 || t.Before(history[0].t) {
+		return 0, false
+	}
+	i := sort.Search(len(history), func(i int) bool { return !history[i].t.Before(t) })
+	if i == len(history) {
+		// REW is ahead of the last block, use it while it is recent
+		last := history[len(history)-1]
+		if t.Sub(last.t) > time.Second {
+			return 0, false
+		}
+		return last.level, true
+	}
+	if i == 0 || history[i].t.Equal(t) {
+		return history[i].level, true
+	}
+	a, b := history[i-1], history[i]
+	fraction := float64(t.Sub(a.t)) / float64(b.t.Sub(a.t))
+	return a.level + fraction*(b.level-a.level), true
+}
+
+func (c *Comparator) Stats(quantity, channel int) ComparisonStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.series[quantity][channel].stats(comparisonQuantities[quantity], comparisonChannels[channel])
+}
+
+func (c *Comparator) Report() ComparisonReport {
+	report := ComparisonReport{
+		Tolerance:  c.tolerance,
+		Lag:        c.lag.Seconds(),
+		Convention: c.convention,
+		End:        time.Now(),
+	}
+	c.mu.Lock()
+	report.Start = c.start
+	c.mu.Unlock()
+
+	for quantity := range comparisonQuantities {
+		for channel := 0; channel < 2; channel++ {
+			report.Stats = append(report.Stats, c.Stats(quantity, channel))
+		}
+	}
+	report.REWConvention = c.rewConvention()
+	return report
+}
+
+// rewConvention returns the dBFS convention with the smallest mean difference
+// to REW, when it is within the tolerance on every channel with pairs
+func (c *Comparator) rewConvention() string {
+	best, bestDifference := "", math.Inf(1)
+	for quantity, convention := range []string{compareDBFSRMS: "rms", compareDBFSSine: "sine"} {
+		worst, pairs := 0.0, 0
+		for channel := 0; channel < 2; channel++ {
+			stats := c.Stats(quantity, channel)
+			if stats.Pairs == 0 {
+				continue
+			}
+			worst = math.Max(worst, math.Abs(stats.MeanDifference))
+			pairs += stats.Pairs
+		}
+		if pairs > 0 && worst <= c.tolerance && worst < bestDifference {
+			best, bestDifference = convention, worst
+		}
+	}
+	return best
+}
+
+// WriteText writes the report as a table
+func (r ComparisonReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Direct vs REW (direct - REW, tolerance %.2f dB, lag %.3f s, direct dBFS %s, %s):\n",
+		r.Tolerance, r.Lag, r.Convention, r.End.Sub(r.Start).Round(time.Second))
+	for _, stats := range r.Stats {
+		if stats.Pairs == 0 {
+			fmt.Fprintf(w, "%-5s %-9s: no pairs\n", stats.Channel, stats.Quantity)
+			continue
+		}
+		fmt.Fprintf(w, "%-5s %-9s: mean %+6.2f dB std %5.2f dB drift %+6.3f dB/min corr %5.3f min %+6.2f max %+6.2f - %d pairs, %d outside (%.1f s)\n",
+			stats.Channel, stats.Quantity, stats.MeanDifference, stats.StdDeviation, stats.Drift, stats.Correlation,
+			stats.MinDifference, stats.MaxDifference, stats.Pairs, stats.Exceeded, stats.ExceededTime)
+	}
+	switch r.REWConvention {
+	case "":
+		fmt.Fprintf(w, "REW dBFS matches neither convention within %.2f dB\n", r.Tolerance)
+	default:
+		fmt.Fprintf(w, "REW dBFS matches the %s convention\n", r.REWConvention)
+	}
+}
+
+/*
+	Server wiring
+*/
+
+// compareDirect stores the direct levels of the block that just ended
+func (s *Server) compareDirect() {
+	if s.comparator == nil {
+		return
+	}
+	now := time.Now()
+	s.comparator.AddDirect(compareDBFSRMS, 0, now, s.directLeftdBFSRMS)
+	s.comparator.AddDirect(compareDBFSRMS, 1, now, s.directRightdBFSRMS)
+	s.comparator.AddDirect(compareDBFSSine, 0, now, s.directLeftdBFSSine)
+	s.comparator.AddDirect(compareDBFSSine, 1, now, s.directRightdBFSSine)
+	s.comparator.AddDirect(compareDBSPL, 0, now, s.directLeftdBSPL)
+	s.comparator.AddDirect(compareDBSPL, 1, now, s.directRightdBSPL)
+}
+
+// compareREWdBFS pairs a REW input level with the direct dBFS in both conventions
+func (s *Server) compareREWdBFS(channel int, level float64) {
+	s.compareREW(compareDBFSRMS, channel, level)
+	s.compareREW(compareDBFSSine, channel, level)
+}
+
+// compareREW pairs a REW webhook level with the direct level and broadcasts
+// the difference, e.g. "Compare_Left_dBSPL_Difference"
+func (s *Server) compareREW(quantity, channel int, level float64) {
+	if s.comparator == nil {
+		return
+	}
+	stats, ok := s.comparator.AddREW(quantity, channel, time.Now(), level)
+	if !ok {
+		return
+	}
+	prefix := "Compare_" + stats.Channel + "_" + stats.Quantity + "_"
+	s.broadcastLevel(prefix+"Difference", stats.LastDifference)
+	s.broadcastLevel(prefix+"MeanDifference", stats.MeanDifference)
+}
+
+// onComparisonChange logs and broadcasts when a difference leaves or returns
+// to the tolerance band
+func (s *Server) onComparisonChange(stats ComparisonStats) {
+	prefix := "Compare_" + stats.Channel + "_" + stats.Quantity + "_"
+	if stats.OutOfTolerance {
+		log.Printf("Direct vs REW: %s %s differs by %+.2f dB, more than %.2f dB\n",
+			stats.Channel, stats.Quantity, stats.LastDifference, s.comparator.tolerance)
+		s.broadcastLevel(prefix+"OutOfTolerance", 1)
+	} else {
+		log.Printf("Direct vs REW: %s %s back within %.2f dB (%+.2f dB)\n",
+			stats.Channel, stats.Quantity, s.comparator.tolerance, stats.LastDifference)
+		s.broadcastLevel(prefix+"OutOfTolerance", 0)
+	}
+}
+
+// setupComparison starts comparing the direct levels with the REW webhooks
+func (s *Server) setupComparison(tolerance float64, lag time.Duration) {
+	s.comparator = NewComparator(tolerance, lag)
+	s.comparator.convention = s.direct.DBFS
+	s.comparator.onChange = s.onComparisonChange
+}
+
+// Handle GET requests for the running comparison
+func (s *Server) handleComparison(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.comparator == nil {
+		http.Error(w, "Comparison is not running", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.comparator.Report()); err != nil {
+		log.Printf("Failed to write comparison: %v", err)
+	}
+}
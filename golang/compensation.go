@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+/*
+	Compensation
+	- Switch the active calibration set (HEQ, IDF, RAW, ...) without restarting
+	- {"command": "compensation", "value": "IDF"} over the WebSocket
+	- GET /compensation returns the active and available compensations
+	- POST /compensation with {"compensation": "IDF"} switches
+	- The next blocks are adjusted with the new set, the calibration filter is
+	  rebuilt when it is on
+	- Broadcast metrics carry the active compensation
+*/
+
+type CompensationStatus struct {
+	Compensation string   `json:"compensation"`
+	Available    []string `json:"available"`
+}
+
+// setCompensation switches the active calibration set
+func (s *Server) setCompensation(compensation string) error {
+	if err := s.calfiles.useCompensation(compensation); err != nil {
+		return err
+	}
+
+	if s.calibrationFiltered() {
+		s.directMu.Lock()
+		for channel := range s.calFilters {
+			filter, err := NewCalibrationFilter(s.direct.CalFilter, s.calfiles.curve(channel), s.sampleRate)
+			if err != nil {
+				s.directMu.Unlock()
+				return fmt.Errorf("failed to setup calibration filter: %v", err)
+			}
+			s.calFilters[channel] = filter
+			s.calFilterSkip = filter.Latency()
+		}
+		s.directMu.Unlock()
+	}
+
+	log.Printf("Compensation %s: LEFT %s, RIGHT %s\n",
+		s.calfiles.activeCompensation(), s.calfiles.info(0).File, s.calfiles.info(1).File)
+	return nil
+}
+
+func (s *Server) compensationStatus() CompensationStatus {
+	return CompensationStatus{
+		Compensation: s.calfiles.activeCompensation(),
+		Available:    s.calfiles.availableCompensations(),
+	}
+}
+
+// Handle GET and POST requests for the active compensation
+func (s *Server) handleCompensation(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		request := CompensationStatus{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := s.setCompensation(request.Compensation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.compensationStatus()); err != nil {
+		log.Printf("Failed to write compensation status: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+	dBFS conventions
+	- rms: raw RMS relative to 1.0, a full-scale square wave is 0 dBFS and a
+	  full-scale sine -3.01 dBFS
+	- sine: AES17, a full-scale sine is 0 dBFS, i.e. rms + 3.01 dB
+	- The direct path reports both, -dbfs selects the one used for the
+	  Direct_<Side>_dBFS metrics and the analysis output
+	- dBSPL does not depend on the convention, the offsets are calibrated
+	  against the raw RMS level
+*/
+
+// sineReferenceOffset is the level of a full-scale sine below a full-scale square wave
+var sineReferenceOffset = 20 * math.Log10(math.Sqrt2)
+
+// dBFSConvention returns the canonical convention name
+func dBFSConvention(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", "rms":
+		return "rms", nil
+	case "sine", "aes17":
+		return "sine", nil
+	default:
+		return "", fmt.Errorf("unknown dBFS convention '%s', use rms or sine", name)
+	}
+}
+
+// dBFSLevel converts a raw RMS level to the convention
+func dBFSLevel(convention string, rmsdBFS float64) float64 {
+	if convention == "sine" {
+		return rmsdBFS + sineReferenceOffset
+	}
+	return rmsdBFS
+}
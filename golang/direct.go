@@ -2,72 +2,162 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math"
-
-	"github.com/gordonklaus/portaudio"
+	"time"
 )
 
 /*
 	Multichannel audio input
-	- Setup portaudio
-	- Open a stream for "E.A.R.S Gain: 18dB"
-	- Read audio samples from the stream
+	- Setup an audio source (PortAudio "E.A.R.S Gain: 18dB", WAV file or synthetic)
+	- Read audio samples from the source
+	- Capture the raw samples to WAV (-capture)
 	- Separate audio samples into left and right channels
-	- Calculate RMS for each channel
-	- Calculate dBFS for each channel
-	- Calculate dBSPL for each channel
+	- Apply the calibration correction filter to each channel (-calfilter)
+	- Apply the frequency weighting (A, C or Z) to each channel
+	- Calculate the block RMS and dBFS for each channel, both RMS and sine
+	  referenced (-dbfs selects the one published as dBFS)
+	- Run the Fast/Slow/Impulse time weighting sample by sample
+	- Calculate the time weighted dBSPL for each channel
+	- Integrate Leq, Lmax, Lmin, SEL and rolling Leq for each channel
+	- Collect level statistics (L10, L50, L90, L95) for each channel
+	- Accumulate the NIOSH and OSHA noise dose from the A-weighted Slow level
+	- Feed the unweighted samples to the spectrum and fractional-octave analyzers
+	- Track the test tone frequency for the calibration lookup (-autotone)
 	- Save the last calculated values in server properties
+	- Keep them for the comparison with the REW webhooks and the recording
+	- Publish the direct metrics to WebSocket clients
 */
 
-func (s *Server) setupAudio() (*portaudio.Stream, error) {
+// DirectOptions select the processing applied on the direct path
+type DirectOptions struct {
+	Weighting     string          // Frequency weighting: "A", "C" or "Z"
+	TimeWeighting string          // Time weighting: "Fast", "Slow" or "Impulse"
+	RollingLeq    []time.Duration // Rolling Leq windows, e.g. 1m and 10m
+	Percentiles   []float64       // Exceedance levels, e.g. 10, 50, 90 and 95
+	DoseAlerts    []float64       // Noise dose alert thresholds in percent
+	Spectrum      SpectrumOptions // FFT spectrum analyzer, disabled when Size is 0
+	Octave        int             // Fractional-octave bands (1, 3, 6 or 12), 0 disables
+	OctaveSize    int             // FFT size of the fractional-octave analyzer
+	AutoTone      bool            // Follow the detected test tone instead of -frequency
+	CalFilter     string          // Calibration correction filter: "off", "minphase" or "measured"
+	DBFS          string          // dBFS convention: "rms" or "sine"
+}
+
+func (s *Server) setupAudio(opts AudioSourceOptions) (AudioSource, error) {
 
-	err := portaudio.Initialize()
+	source, err := NewAudioSource(opts, s.readAudio)
 	if err != nil {
 		return nil, err
 	}
-	defer portaudio.Terminate()
 
-	apis, err := portaudio.HostApis()
-	if err != nil {
+	if err := s.setupDirect(source.SampleRate()); err != nil {
+		source.Close()
 		return nil, err
 	}
 
-	for i, api := range apis {
-		fmt.Printf("Host API %d: %s\n", i, api.Name)
-	}
+	return source, nil
+}
 
-	var inDev *portaudio.DeviceInfo
+// setupDirect prepares the per channel filters for the given sample rate
+func (s *Server) setupDirect(sampleRate float64) error {
+	s.sampleRate = sampleRate
 
-	devices, err := portaudio.Devices()
-	if err != nil {
-		return nil, err
-	}
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
 
-	name := "E.A.R.S Gain: 18dB"
+	s.weightingFilters = nil
+	s.timeWeightings = nil
+	s.meters = nil
+	s.statistics = nil
+	s.doseFilters = nil
+	s.doseDetectors = nil
+	s.doses = nil
+	s.spectra = nil
+	s.octaves = nil
+	s.tones = nil
+	s.calFilters = nil
+	for channel := 0; channel < 2; channel++ {
+		if s.calibrationFiltered() {
+			calFilter, err := NewCalibrationFilter(s.direct.CalFilter, s.calfiles.curve(channel), sampleRate)
+			if err != nil {
+				return fmt.Errorf("failed to setup calibration filter: %v", err)
+			}
+			s.calFilters = append(s.calFilters, calFilter)
+		}
 
-	for i, dev := range devices {
-		fmt.Printf("Device %d: %s\n", i, dev.Name)
-		if dev.Name == name {
-			inDev = devices[i]
+		filter, err := NewWeightingFilter(s.direct.Weighting, sampleRate)
+		if err != nil {
+			return fmt.Errorf("failed to setup weighting filter: %v", err)
 		}
-	}
+		s.weightingFilters = append(s.weightingFilters, filter)
+
+		detector, err := NewTimeWeighting(s.direct.TimeWeighting, sampleRate)
+		if err != nil {
+			return fmt.Errorf("failed to setup time weighting: %v", err)
+		}
+		s.timeWeightings = append(s.timeWeightings, detector)
+
+		meter := NewIntegratingMeter(sampleRate, detector.SettleTime(), s.direct.RollingLeq)
+		s.meters = append(s.meters, meter)
 
-	if inDev == nil {
-		return nil, fmt.Errorf("input device '%s' not found", name)
+		s.statistics = append(s.statistics, NewLevelStatistics())
+
+		// The dose always uses A weighting and Slow time weighting,
+		// independent of the weighting selected for the run
+		doseFilter, err := NewWeightingFilter("A", sampleRate)
+		if err != nil {
+			return fmt.Errorf("failed to setup dose weighting filter: %v", err)
+		}
+		s.doseFilters = append(s.doseFilters, doseFilter)
+
+		doseDetector, err := NewTimeWeighting("Slow", sampleRate)
+		if err != nil {
+			return fmt.Errorf("failed to setup dose time weighting: %v", err)
+		}
+		s.doseDetectors = append(s.doseDetectors, doseDetector)
+
+		s.doses = append(s.doses, []*NoiseDose{
+			NewNoiseDose(NIOSHCriterion, s.direct.DoseAlerts),
+			NewNoiseDose(OSHACriterion, s.direct.DoseAlerts),
+		})
+
+		if s.direct.Spectrum.Size > 0 {
+			analyzer, err := NewSpectrumAnalyzer(s.direct.Spectrum, sampleRate)
+			if err != nil {
+				return fmt.Errorf("failed to setup spectrum analyzer: %v", err)
+			}
+			s.spectra = append(s.spectra, analyzer)
+		}
+
+		if s.direct.Octave > 0 {
+			octave, err := NewOctaveAnalyzer(s.direct.Octave, s.direct.OctaveSize, sampleRate)
+			if err != nil {
+				return fmt.Errorf("failed to setup octave analyzer: %v", err)
+			}
+			s.octaves = append(s.octaves, octave)
+		}
+
+		if s.direct.AutoTone {
+			tone, err := NewToneEstimator(sampleRate)
+			if err != nil {
+				return fmt.Errorf("failed to setup tone estimator: %v", err)
+			}
+			s.tones = append(s.tones, tone)
+		}
 	}
 
-	p := portaudio.HighLatencyParameters(inDev, nil)
-	p.Input.Channels = 2
-	p.Output.Channels = 0
-	p.SampleRate = 48000
-	p.FramesPerBuffer = 2048
+	// Start sampling the statistics once the detectors have charged
+	s.statisticsInterval = int(sampleRate / statisticsRate)
+	s.statisticsCountdown = int(s.timeWeightings[0].SettleTime().Seconds() * sampleRate)
 
-	stream, err := portaudio.OpenStream(p, s.readAudio)
-	if err != nil {
-		return nil, err
+	// Both channels use the same filter length
+	s.calFilterSkip = 0
+	if s.calFilters != nil {
+		s.calFilterSkip = s.calFilters[0].Latency()
 	}
 
-	return stream, nil
+	return nil
 }
 
 func (s *Server) readAudio(in []float32) {
@@ -76,25 +166,298 @@ func (s *Server) readAudio(in []float32) {
 	// This is typical for stereo audio data but should be confirmed with our specific setup.
 
 	var sumSquaresLeft, sumSquaresRight float64
-	numSamples := len(in) / 2 // Number of frames (each frame has two samples: left and right)
+	numSamples := 0 // Number of frames that reach the meters
+
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	if s.capture != nil {
+		s.capture.Write(in)
+	}
 
 	for i := 0; i < len(in); i += 2 {
-		leftSample := in[i]
-		rightSample := in[i+1]
+		left, right := float64(in[i]), float64(in[i+1])
+
+		if s.spectra != nil {
+			s.spectra[0].Process(left)
+			s.spectra[1].Process(right)
+		}
+		if s.octaves != nil {
+			s.octaves[0].Process(left)
+			s.octaves[1].Process(right)
+		}
+		if s.tones != nil {
+			s.tones[0].Process(left)
+			s.tones[1].Process(right)
+		}
+
+		if s.calFilters != nil {
+			left = s.calFilters[0].Process(left)
+			right = s.calFilters[1].Process(right)
+
+			// Drop the leading zeros of the filter delay, they would read as
+			// silence in Lmin, the statistics and Leq
+			if s.calFilterSkip > 0 {
+				s.calFilterSkip--
+				continue
+			}
+		}
+		numSamples++
+
+		leftSample := s.weightingFilters[0].Process(left)
+		rightSample := s.weightingFilters[1].Process(right)
+
+		s.doseDetectors[0].Process(s.doseFilters[0].Process(left))
+		s.doseDetectors[1].Process(s.doseFilters[1].Process(right))
+
+		sumSquaresLeft += leftSample * leftSample
+		sumSquaresRight += rightSample * rightSample
 
-		sumSquaresLeft += float64(leftSample * leftSample)
-		sumSquaresRight += float64(rightSample * rightSample)
+		s.timeWeightings[0].Process(leftSample)
+		s.timeWeightings[1].Process(rightSample)
+
+		s.meters[0].Process(leftSample, s.timeWeightings[0].MeanSquare())
+		s.meters[1].Process(rightSample, s.timeWeightings[1].MeanSquare())
+
+		s.statisticsCountdown--
+		if s.statisticsCountdown <= 0 {
+			s.statisticsCountdown = s.statisticsInterval
+			s.statistics[0].Add(10 * math.Log10(s.timeWeightings[0].MeanSquare()))
+			s.statistics[1].Add(10 * math.Log10(s.timeWeightings[1].MeanSquare()))
+		}
+	}
+
+	if numSamples == 0 {
+		return
 	}
 
 	// Calculate RMS for each channel
 	rmsLeft := math.Sqrt(sumSquaresLeft / float64(numSamples))
 	rmsRight := math.Sqrt(sumSquaresRight / float64(numSamples))
 
-	// Calculate SPL for each channel in dB SPL (using a reference RMS level of 1.0)
-	s.directLeftdBFS = 20 * math.Log10(rmsLeft)
-	s.directRightdBFS = 20 * math.Log10(rmsRight)
-	s.directLeftdBSPL = s.adjust(0, s.directLeftdBFS)
-	s.directRightdBSPL = s.adjust(1, s.directRightdBFS)
+	// Calculate dBFS for each channel (using a reference RMS level of 1.0),
+	// and relative to a full-scale sine
+	s.directLeftdBFSRMS = 20 * math.Log10(rmsLeft)
+	s.directRightdBFSRMS = 20 * math.Log10(rmsRight)
+	s.directLeftdBFSSine = dBFSLevel("sine", s.directLeftdBFSRMS)
+	s.directRightdBFSSine = dBFSLevel("sine", s.directRightdBFSRMS)
+	s.directLeftdBFS = dBFSLevel(s.direct.DBFS, s.directLeftdBFSRMS)
+	s.directRightdBFS = dBFSLevel(s.direct.DBFS, s.directRightdBFSRMS)
+
+	// Follow the detected test tone in the calibration lookup, tones outside
+	// the calibration table keep the last frequency
+	for channel, tone := range s.tones {
+		if tone.Confidence() >= toneMinConfidence {
+			s.calfiles.setToneFrequency(channel, tone.Frequency())
+		}
+	}
+
+	// Calculate SPL for each channel from the time weighted level at the end
+	// of the block, like REW's SPL meter
+	s.directLeftdBSPL = s.adjust(0, 10*math.Log10(s.timeWeightings[0].MeanSquare()))
+	s.directRightdBSPL = s.adjust(1, 10*math.Log10(s.timeWeightings[1].MeanSquare()))
+	s.compareDirect()
+	s.recordDirect()
+
+	// Accumulate the noise dose over the block
+	blockSeconds := float64(numSamples) / s.sampleRate
+	for channel, doses := range s.doses {
+		dBA := s.adjust(channel, 10*math.Log10(s.doseDetectors[channel].MeanSquare()))
+		for _, dose := range doses {
+			dose.Add(dBA, blockSeconds)
+		}
+	}
+}
 
-	s.counter++
+// DirectBlock is a copy of the levels of the last block of one channel
+type DirectBlock struct {
+	DBFS     float64 // in the -dbfs convention
+	DBFSRMS  float64
+	DBFSSine float64
+	DBSPL    float64
+}
+
+// directBlock returns the levels of the last block of a channel, ok is false
+// before the direct path is set up
+func (s *Server) directBlock(channel int) (DirectBlock, bool) {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	if len(s.meters) == 0 {
+		return DirectBlock{}, false
+	}
+	if channel == 1 {
+		return DirectBlock{s.directRightdBFS, s.directRightdBFSRMS, s.directRightdBFSSine, s.directRightdBSPL}, true
+	}
+	return DirectBlock{s.directLeftdBFS, s.directLeftdBFSRMS, s.directLeftdBFSSine, s.directLeftdBSPL}, true
+}
+
+// directLevels returns the integrated levels of a channel in dBSPL
+func (s *Server) directLevels(channel int) IntegratingLevels {
+	s.directMu.Lock()
+	levels := s.meters[channel].Levels()
+	s.directMu.Unlock()
+
+	levels.Leq = s.adjust(channel, levels.Leq)
+	levels.Lmax = s.adjust(channel, levels.Lmax)
+	levels.Lmin = s.adjust(channel, levels.Lmin)
+	levels.SEL = s.adjust(channel, levels.SEL)
+	for i := range levels.RollingLeq {
+		levels.RollingLeq[i] = s.adjust(channel, levels.RollingLeq[i])
+	}
+
+	return levels
+}
+
+// directExceedance returns the configured exceedance levels of a channel in dBSPL
+func (s *Server) directExceedance(channel int) []float64 {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	var levels []float64
+	for _, n := range s.direct.Percentiles {
+		levels = append(levels, s.adjust(channel, s.statistics[channel].Exceedance(n)))
+	}
+	return levels
+}
+
+// DoseStatus is a snapshot of the noise dose of one channel and criterion
+type DoseStatus struct {
+	Criterion     string
+	Dose          float64 // percent
+	ProjectedDose float64 // percent after 8 hours
+	TWA           float64 // dBA
+	Elapsed       float64 // seconds
+}
+
+// directDose returns the dose of a channel for each criterion
+func (s *Server) directDose(channel int) []DoseStatus {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	var status []DoseStatus
+	for _, dose := range s.doses[channel] {
+		status = append(status, DoseStatus{
+			Criterion:     dose.Criterion().Name,
+			Dose:          dose.Dose(),
+			ProjectedDose: dose.ProjectedDose(),
+			TWA:           dose.TWA(),
+			Elapsed:       dose.Elapsed(),
+		})
+	}
+	return status
+}
+
+// DoseAlert is a dose alert threshold crossed by one channel
+type DoseAlert struct {
+	Criterion string
+	Threshold float64 // percent
+}
+
+// directDoseAlerts collects the alert thresholds crossed since the last call.
+// Only publishDirect calls it, so every alert is reported once
+func (s *Server) directDoseAlerts(channel int) []DoseAlert {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	var alerts []DoseAlert
+	for _, dose := range s.doses[channel] {
+		for _, threshold := range dose.CheckAlerts() {
+			alerts = append(alerts, DoseAlert{dose.Criterion().Name, threshold})
+		}
+	}
+	return alerts
+}
+
+// resetDose restarts the noise dose accumulation
+func (s *Server) resetDose() {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	for _, doses := range s.doses {
+		for _, dose := range doses {
+			dose.Reset()
+		}
+	}
+}
+
+// resetDirect restarts the integration of the direct meters and statistics
+func (s *Server) resetDirect() {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	for _, meter := range s.meters {
+		meter.Reset()
+	}
+	for _, statistics := range s.statistics {
+		statistics.Reset()
+	}
+	for _, analyzer := range s.spectra {
+		analyzer.Reset()
+	}
+	for _, octave := range s.octaves {
+		octave.Reset()
+	}
+}
+
+/*
+	Publish direct metrics
+	- Broadcast the direct levels next to the REW webhook metrics
+	- Names are prefixed with "Direct_", e.g. "Direct_Left_Leq"
+*/
+
+func (s *Server) publishDirect(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		for channel, side := range []string{"Left", "Right"} {
+			block, ok := s.directBlock(channel)
+			if !ok {
+				break
+			}
+			levels := s.directLevels(channel)
+
+			prefix := "Direct_" + side + "_"
+			s.broadcastLevel(prefix+"dBFS", block.DBFS)
+			s.broadcastLevel(prefix+"dBFS_RMS", block.DBFSRMS)
+			s.broadcastLevel(prefix+"dBFS_Sine", block.DBFSSine)
+			s.broadcastLevel(prefix+"dBSPL", block.DBSPL)
+			s.broadcastLevel(prefix+"Leq", levels.Leq)
+			s.broadcastLevel(prefix+"Lmax", levels.Lmax)
+			s.broadcastLevel(prefix+"Lmin", levels.Lmin)
+			s.broadcastLevel(prefix+"SEL", levels.SEL)
+			for i, window := range s.direct.RollingLeq {
+				s.broadcastLevel(prefix+rollingLeqLabel(window), levels.RollingLeq[i])
+			}
+			s.broadcastLevel(prefix+"ElapsedTime", levels.ElapsedTime)
+			if frequency, confidence, ok := s.directTone(channel); ok {
+				s.broadcastLevel(prefix+"ToneFrequency", frequency)
+				s.broadcastLevel(prefix+"ToneConfidence", confidence)
+				s.broadcastLevel(prefix+"CalFrequency", s.calfiles.toneFrequency(channel))
+			}
+			for i, level := range s.directExceedance(channel) {
+				s.broadcastLevel(prefix+percentileLabel(s.direct.Percentiles[i]), level)
+			}
+			for _, dose := range s.directDose(channel) {
+				s.broadcastLevel(prefix+dose.Criterion+"_Dose", dose.Dose)
+				s.broadcastLevel(prefix+dose.Criterion+"_ProjectedDose", dose.ProjectedDose)
+				s.broadcastLevel(prefix+dose.Criterion+"_TWA", dose.TWA)
+			}
+			for _, alert := range s.directDoseAlerts(channel) {
+				log.Printf("Noise dose alert: %s ear reached %.0f%% of the %s daily dose\n", side, alert.Threshold, alert.Criterion)
+				s.broadcastLevel(prefix+alert.Criterion+"_Alert", alert.Threshold)
+			}
+		}
+	}
+}
+
+// broadcastLevel broadcasts a metric, skipping levels that are not finite
+// (e.g. before the first block or on digital silence)
+func (s *Server) broadcastLevel(name string, value float64) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return
+	}
+	if err := s.broadcast(name, value); err != nil {
+		log.Printf("Failed to broadcast %s: %v", name, err)
+	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+/*
+	FFT
+	- Iterative radix-2 complex FFT
+	- Twiddle factors and bit reversal table are computed once per size
+*/
+
+type fft struct {
+	size     int
+	twiddles []complex128
+	reversed []int
+}
+
+func newFFT(size int) (*fft, error) {
+	if size < 2 || size&(size-1) != 0 {
+		return nil, fmt.Errorf("FFT size %d is not a power of 2", size)
+	}
+
+	f := &fft{
+		size:     size,
+		twiddles: make([]complex128, size/2),
+		reversed: make([]int, size),
+	}
+
+	for k := range f.twiddles {
+		f.twiddles[k] = cmplx.Exp(complex(0, -2*math.Pi*float64(k)/float64(size)))
+	}
+
+	bits := 0
+	for 1<<bits < size {
+		bits++
+	}
+	for i := range f.reversed {
+		r := 0
+		for b := 0; b < bits; b++ {
+			if i&(1<<b) != 0 {
+				r |= 1 << (bits - 1 - b)
+			}
+		}
+		f.reversed[i] = r
+	}
+
+	return f, nil
+}
+
+// transform computes the forward FFT of x in place
+func (f *fft) transform(x []complex128) {
+	f.permute(x)
+
+	for span := 2; span <= f.size; span <<= 1 {
+		half := span / 2
+		step := f.size / span
+		for start := 0; start < f.size; start += span {
+			for k := 0; k < half; k++ {
+				t := f.twiddles[k*step] * x[start+k+half]
+				x[start+k+half] = x[start+k] - t
+				x[start+k] += t
+			}
+		}
+	}
+}
+
+// inverse computes the inverse FFT of x in place, scaled by 1/size
+func (f *fft) inverse(x []complex128) {
+	for i := range x {
+		x[i] = cmplx.Conj(x[i])
+	}
+	f.transform(x)
+	scale := complex(1/float64(f.size), 0)
+	for i := range x {
+		x[i] = cmplx.Conj(x[i]) * scale
+	}
+}
+
+func (f *fft) permute(x []complex128) {
+	for i, r := range f.reversed {
+		if i < r {
+			x[i], x[r] = x[r], x[i]
+		}
+	}
+}
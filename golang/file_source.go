@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+	File audio source
+	- Stream a recorded WAV or FLAC file through the direct path
+	- Mono files are copied to both channels, extra channels are dropped
+	- Optionally loop the file for long running sessions
+*/
+
+type fileSource struct {
+	*blockPump
+	path string
+	file audioFile
+	loop bool
+	in   []float32
+}
+
+func newFileSource(opts AudioSourceOptions, handler AudioHandler) (*fileSource, error) {
+	file, err := openAudioFile(opts.File)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileSource{
+		path: opts.File,
+		file: file,
+		loop: opts.Loop,
+	}
+	s.blockPump = &blockPump{
+		sampleRate:      file.SampleRate(),
+		channels:        2,
+		framesPerBuffer: opts.FramesPerBuffer,
+		realtime:        opts.Realtime,
+		handler:         handler,
+		next:            s.next,
+	}
+	s.in = make([]float32, opts.FramesPerBuffer*file.Channels())
+
+	fmt.Printf("File source: %s %.0f Hz %d channels\n", opts.File, file.SampleRate(), file.Channels())
+
+	return s, nil
+}
+
+func (s *fileSource) next(buf []float32) (int, error) {
+	frames, err := s.file.Read(s.in)
+	if err == io.EOF && s.loop {
+		if err := s.rewind(); err != nil {
+			return 0, err
+		}
+		frames, err = s.file.Read(s.in)
+	}
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	toStereo(buf, s.in, s.file.Channels(), frames)
+
+	return frames, nil
+}
+
+// toStereo copies frames from in (with the given channel count) to the
+// interleaved stereo buffer out.
+func toStereo(out, in []float32, channels, frames int) {
+	for i := 0; i < frames; i++ {
+		left := in[i*channels]
+		right := left
+		if channels > 1 {
+			right = in[i*channels+1]
+		}
+		out[2*i] = left
+		out[2*i+1] = right
+	}
+}
+
+func (s *fileSource) rewind() error {
+	s.file.Close()
+
+	file, err := openAudioFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+func (s *fileSource) Close() error {
+	s.blockPump.Close()
+	return s.file.Close()
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	FLAC reader
+	- Parse the STREAMINFO metadata block (skipping ID3v2 tags and other blocks)
+	- Decode frames: constant, verbatim, fixed and LPC subframes with Rice coded residuals
+	- Undo left/side, side/right and mid/side stereo decorrelation
+	- Return interleaved float32 samples scaled to [-1.0, 1.0]
+
+	CRCs and the MD5 signature are not verified.
+*/
+
+type flacReader struct {
+	file          *os.File
+	br            *bitReader
+	sampleRate    float64
+	channels      int
+	bitsPerSample int
+	maxBlockSize  int
+
+	// Decoded samples of the current frame, per channel. int64, because the
+	// side channel of a 32-bit stream needs 33 bits
+	block    [][]int64
+	blockLen int
+	blockPos int
+}
+
+func openFlac(path string) (*flacReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening flac file: %w", err)
+	}
+
+	f := &flacReader{file: file, br: newBitReader(bufio.NewReaderSize(file, 64*1024))}
+	if err := f.readMetadata(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading flac file %s: %v", path, err)
+	}
+	return f, nil
+}
+
+func (f *flacReader) readMetadata() error {
+	r := f.br.r
+
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return err
+	}
+
+	// Skip an ID3v2 tag in front of the stream marker. The 10-byte tag header
+	// is "ID3", the version (2 bytes), the flags and a syncsafe size, which
+	// counts the tag without the header and the optional footer
+	if string(marker[0:3]) == "ID3" {
+		var hdr [6]byte // minor version, flags, size
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		size := int(hdr[2]&0x7f)<<21 | int(hdr[3]&0x7f)<<14 | int(hdr[4]&0x7f)<<7 | int(hdr[5]&0x7f)
+		if hdr[1]&0x10 != 0 { // footer present
+			size += 10
+		}
+		if _, err := r.Discard(size); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return err
+		}
+	}
+
+	if string(marker[:]) != "fLaC" {
+		return fmt.Errorf("not a FLAC stream")
+	}
+
+	haveStreamInfo := false
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		last := hdr[0]&0x80 != 0
+		blockType := hdr[0] & 0x7f
+		length := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+
+		if blockType == 0 {
+			if length < 34 {
+				return fmt.Errorf("STREAMINFO block too short")
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return err
+			}
+			f.maxBlockSize = int(binary.BigEndian.Uint16(body[2:4]))
+			packed := binary.BigEndian.Uint64(body[10:18])
+			f.sampleRate = float64(packed >> 44)
+			f.channels = int((packed>>41)&0x7) + 1
+			f.bitsPerSample = int((packed>>36)&0x1f) + 1
+			haveStreamInfo = true
+		} else if _, err := r.Discard(length); err != nil {
+			return err
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if !haveStreamInfo {
+		return fmt.Errorf("no STREAMINFO block found")
+	}
+
+	f.block = make([][]int64, f.channels)
+	for ch := range f.block {
+		f.block[ch] = make([]int64, f.maxBlockSize)
+	}
+	return nil
+}
+
+func (f *flacReader) SampleRate() float64 { return f.sampleRate }
+func (f *flacReader) Channels() int       { return f.channels }
+
+// Read decodes up to len(buf)/Channels() frames into buf and returns the
+// number of frames read, or io.EOF at the end of the stream.
+func (f *flacReader) Read(buf []float32) (int, error) {
+	frames := 0
+	scale := float32(int64(1) << uint(f.bitsPerSample-1))
+
+	for frames < len(buf)/f.channels {
+		if f.blockPos >= f.blockLen {
+			err := f.readFrame()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return frames, err
+			}
+			continue
+		}
+
+		for ch := 0; ch < f.channels; ch++ {
+			buf[frames*f.channels+ch] = float32(f.block[ch][f.blockPos]) / scale
+		}
+		f.blockPos++
+		frames++
+	}
+
+	if frames == 0 {
+		return 0, io.EOF
+	}
+	return frames, nil
+}
+
+func (f *flacReader) Close() error {
+	return f.file.Close()
+}
+
+/*
+	Frame decoding
+*/
+
+func (f *flacReader) readFrame() error {
+	br := f.br
+	br.align()
+
+	sync, err := br.read(14)
+	if err != nil {
+		return err
+	}
+	if sync != 0x3ffe {
+		return fmt.Errorf("lost frame sync")
+	}
+	if _, err := br.read(2); err != nil { // reserved, blocking strategy
+		return err
+	}
+	blockSizeCode, _ := br.read(4)
+	sampleRateCode, _ := br.read(4)
+	channelCode, _ := br.read(4)
+	sampleSizeCode, _ := br.read(3)
+	if _, err := br.read(1); err != nil {
+		return err
+	}
+
+	// Frame or sample number, UTF-8 style coded
+	first, err := br.read(8)
+	if err != nil {
+		return err
+	}
+	leadingOnes := 0
+	for mask := uint64(0x80); first&mask != 0; mask >>= 1 {
+		leadingOnes++
+	}
+	for i := 1; i < leadingOnes; i++ {
+		if _, err := br.read(8); err != nil {
+			return err
+		}
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode >= 2 && blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6:
+		v, err := br.read(8)
+		if err != nil {
+			return err
+		}
+		blockSize = int(v) + 1
+	case blockSizeCode == 7:
+		v, err := br.read(16)
+		if err != nil {
+			return err
+		}
+		blockSize = int(v) + 1
+	case blockSizeCode >= 8:
+		blockSize = 256 << (blockSizeCode - 8)
+	default:
+		return fmt.Errorf("reserved block size code")
+	}
+
+	switch sampleRateCode {
+	case 12:
+		_, err = br.read(8)
+	case 13, 14:
+		_, err = br.read(16)
+	case 15:
+		return fmt.Errorf("invalid sample rate code")
+	}
+	if err != nil {
+		return err
+	}
+
+	bps := f.bitsPerSample
+	switch sampleSizeCode {
+	case 1:
+		bps = 8
+	case 2:
+		bps = 12
+	case 4:
+		bps = 16
+	case 5:
+		bps = 20
+	case 6:
+		bps = 24
+	case 7:
+		bps = 32
+	case 3:
+		return fmt.Errorf("reserved sample size code")
+	}
+
+	if _, err := br.read(8); err != nil { // CRC-8
+		return err
+	}
+
+	if blockSize > len(f.block[0]) {
+		for ch := range f.block {
+			f.block[ch] = make([]int64, blockSize)
+		}
+	}
+
+	channels := int(channelCode) + 1
+	if channelCode >= 8 {
+		if channelCode > 10 {
+			return fmt.Errorf("reserved channel assignment %d", channelCode)
+		}
+		channels = 2
+	}
+	if channels != f.channels {
+		return fmt.Errorf("frame has %d channels, stream has %d", channels, f.channels)
+	}
+
+	for ch := 0; ch < channels; ch++ {
+		sbps := bps
+		// The side channel carries one extra bit
+		if (channelCode == 8 && ch == 1) || (channelCode == 9 && ch == 0) || (channelCode == 10 && ch == 1) {
+			sbps++
+		}
+		if err := f.readSubframe(f.block[ch][:blockSize], sbps); err != nil {
+			return err
+		}
+	}
+
+	decorrelate(f.block, blockSize, channelCode)
+
+	br.align()
+	if _, err := br.read(16); err != nil { // CRC-16
+		return err
+	}
+
+	// Frames may use a smaller sample size than the stream header
+	if bps != f.bitsPerSample {
+		shift := uint(f.bitsPerSample - bps)
+		for ch := 0; ch < channels; ch++ {
+			for i := 0; i < blockSize; i++ {
+				f.block[ch][i] <<= shift
+			}
+		}
+	}
+
+	f.blockLen = blockSize
+	f.blockPos = 0
+	return nil
+}
+
+func decorrelate(block [][]int64, n int, channelCode uint64) {
+	switch channelCode {
+	case 8: // left/side
+		for i := 0; i < n; i++ {
+			block[1][i] = block[0][i] - block[1][i]
+		}
+	case 9: // side/right
+		for i := 0; i < n; i++ {
+			block[0][i] = block[0][i] + block[1][i]
+		}
+	case 10: // mid/side
+		for i := 0; i < n; i++ {
+			side := block[1][i]
+			mid := block[0][i]<<1 | (side & 1)
+			block[0][i] = (mid + side) >> 1
+			block[1][i] = (mid - side) >> 1
+		}
+	}
+}
+
+func (f *flacReader) readSubframe(out []int64, bps int) error {
+	br := f.br
+
+	if _, err := br.read(1); err != nil { // zero padding
+		return err
+	}
+	kind, err := br.read(6)
+	if err != nil {
+		return err
+	}
+
+	wasted := 0
+	flag, err := br.read(1)
+	if err != nil {
+		return err
+	}
+	if flag == 1 {
+		k, err := br.unary()
+		if err != nil {
+			return err
+		}
+		wasted = int(k) + 1
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0: // constant
+		v, err := br.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = v
+		}
+	case kind == 1: // verbatim
+		for i := range out {
+			v, err := br.readSigned(bps)
+			if err != nil {
+				return err
+			}
+			out[i] = v
+		}
+	case kind >= 8 && kind <= 12: // fixed
+		order := int(kind - 8)
+		if err := f.readWarmup(out, order, bps); err != nil {
+			return err
+		}
+		if err := f.readResidual(out, order); err != nil {
+			return err
+		}
+		fixedPredict(out, order)
+	case kind >= 32: // LPC
+		order := int(kind-32) + 1
+		if err := f.readWarmup(out, order, bps); err != nil {
+			return err
+		}
+		precision, err := br.read(4)
+		if err != nil {
+			return err
+		}
+		if precision == 15 {
+			return fmt.Errorf("invalid LPC precision")
+		}
+		shift, err := br.readSigned(5)
+		if err != nil {
+			return err
+		}
+		if shift < 0 {
+			return fmt.Errorf("negative LPC shift")
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			c, err := br.readSigned(int(precision) + 1)
+			if err != nil {
+				return err
+			}
+			coefs[i] = c
+		}
+		if err := f.readResidual(out, order); err != nil {
+			return err
+		}
+		lpcPredict(out, coefs, uint(shift))
+	default:
+		return fmt.Errorf("reserved subframe type %d", kind)
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= uint(wasted)
+		}
+	}
+	return nil
+}
+
+func (f *flacReader) readWarmup(out []int64, order, bps int) error {
+	if order > len(out) {
+		return fmt.Errorf("predictor order %d exceeds block size %d", order, len(out))
+	}
+	for i := 0; i < order; i++ {
+		v, err := f.br.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		out[i] = v
+	}
+	return nil
+}
+
+// readResidual decodes the Rice coded residual into out[order:]
+func (f *flacReader) readResidual(out []int64, order int) error {
+	br := f.br
+
+	method, err := br.read(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return fmt.Errorf("reserved residual coding method %d", method)
+	}
+	paramBits, escape := 4, uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+
+	partitionOrder, err := br.read(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	partitionSize := len(out) >> partitionOrder
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		n := partitionSize
+		if p == 0 {
+			n -= order
+		}
+		if n < 0 || i+n > len(out) {
+			return fmt.Errorf("invalid residual partition")
+		}
+
+		param, err := br.read(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if param == escape {
+			bits, err := br.read(5)
+			if err != nil {
+				return err
+			}
+			for j := 0; j < n; j++ {
+				v, err := br.readSigned(int(bits))
+				if err != nil {
+					return err
+				}
+				out[i] = v
+				i++
+			}
+			continue
+		}
+
+		for j := 0; j < n; j++ {
+			q, err := br.unary()
+			if err != nil {
+				return err
+			}
+			low, err := br.read(int(param))
+			if err != nil {
+				return err
+			}
+			v := q<<param | low
+			out[i] = int64(v>>1) ^ -int64(v&1)
+			i++
+		}
+	}
+
+	return nil
+}
+
+func fixedPredict(out []int64, order int) {
+	switch order {
+	case 1:
+		for i := 1; i < len(out); i++ {
+			out[i] += out[i-1]
+		}
+	case 2:
+		for i := 2; i < len(out); i++ {
+			out[i] += 2*out[i-1] - out[i-2]
+		}
+	case 3:
+		for i := 3; i < len(out); i++ {
+			out[i] += 3*out[i-1] - 3*out[i-2] + out[i-3]
+		}
+	case 4:
+		for i := 4; i < len(out); i++ {
+			out[i] += 4*out[i-1] - 6*out[i-2] + 4*out[i-3] - out[i-4]
+		}
+	}
+}
+
+func lpcPredict(out []int64, coefs []int64, shift uint) {
+	order := len(coefs)
+	for i := order; i < len(out); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += c * out[i-1-j]
+		}
+		out[i] += sum >> shift
+	}
+}
+
+/*
+	Bit reader
+	- MSB first, as used by FLAC frames
+*/
+
+type bitReader struct {
+	r     *bufio.Reader
+	cache uint64
+	n     uint // valid bits in cache
+}
+
+func newBitReader(r *bufio.Reader) *bitReader {
+	return &bitReader{r: r}
+}
+
+func (b *bitReader) read(bits int) (uint64, error) {
+	if bits == 0 {
+		return 0, nil
+	}
+	for b.n < uint(bits) {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && b.n > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.cache = b.cache<<8 | uint64(c)
+		b.n += 8
+	}
+	b.n -= uint(bits)
+	v := (b.cache >> b.n) & (1<<uint(bits) - 1)
+	return v, nil
+}
+
+func (b *bitReader) readSigned(bits int) (int64, error) {
+	v, err := b.read(bits)
+	if err != nil || bits == 0 {
+		return 0, err
+	}
+	// Sign extend
+	shift := 64 - uint(bits)
+	return int64(v<<shift) >> shift, nil
+}
+
+// unary counts zero bits up to the next one bit
+func (b *bitReader) unary() (uint64, error) {
+	var count uint64
+	for {
+		if b.n == 0 {
+			c, err := b.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			b.cache = uint64(c)
+			b.n = 8
+		}
+		bit := (b.cache >> (b.n - 1)) & 1
+		b.n--
+		if bit == 1 {
+			return count, nil
+		}
+		count++
+	}
+}
+
+// align drops the bits left in the current byte
+func (b *bitReader) align() {
+	b.n -= b.n % 8
+}
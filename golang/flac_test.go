@@ -0,0 +1,396 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+	FLAC test streams
+	- Built bit by bit, so every subframe type and stereo mode is covered
+	  without an encoder or sample files
+	- CRCs are written as zero, the reader does not verify them
+*/
+
+type flacBitWriter struct {
+	buf []byte
+	n   uint // bits used in the last byte
+}
+
+func (w *flacBitWriter) write(v uint64, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if (v>>uint(i))&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> w.n
+		}
+		w.n = (w.n + 1) % 8
+	}
+}
+
+func (w *flacBitWriter) writeSigned(v int64, bits int) {
+	w.write(uint64(v)&(1<<uint(bits)-1), bits)
+}
+
+func (w *flacBitWriter) align() {
+	w.n = 0
+}
+
+// rice writes the residual as one partition with a fitting parameter
+func (w *flacBitWriter) rice(residual []int64) {
+	var max uint64
+	coded := make([]uint64, len(residual))
+	for i, r := range residual {
+		if r >= 0 {
+			coded[i] = uint64(r) << 1
+		} else {
+			coded[i] = uint64(-r)<<1 - 1
+		}
+		if coded[i] > max {
+			max = coded[i]
+		}
+	}
+	param := 0
+	for max>>uint(param) > 16 && param < 14 {
+		param++
+	}
+
+	w.write(0, 2) // Rice, 4-bit parameters
+	w.write(0, 4) // partition order
+	w.write(uint64(param), 4)
+	for _, u := range coded {
+		for q := u >> uint(param); q > 0; q-- {
+			w.write(0, 1)
+		}
+		w.write(1, 1)
+		w.write(u, param)
+	}
+}
+
+// flacSubframe writes one channel of a frame
+type flacSubframe func(w *flacBitWriter, x []int64, bps int)
+
+func constantSubframe(w *flacBitWriter, x []int64, bps int) {
+	w.write(0, 8) // padding, type 0, no wasted bits
+	w.writeSigned(x[0], bps)
+}
+
+func verbatimSubframe(w *flacBitWriter, x []int64, bps int) {
+	w.write(0, 1)
+	w.write(1, 6)
+	w.write(0, 1)
+	for _, v := range x {
+		w.writeSigned(v, bps)
+	}
+}
+
+func fixedSubframe(order int) flacSubframe {
+	return func(w *flacBitWriter, x []int64, bps int) {
+		w.write(0, 1)
+		w.write(uint64(8+order), 6)
+		w.write(0, 1)
+		for _, v := range x[:order] {
+			w.writeSigned(v, bps)
+		}
+		residual := make([]int64, 0, len(x)-order)
+		for i := order; i < len(x); i++ {
+			var prediction int64
+			switch order {
+			case 1:
+				prediction = x[i-1]
+			case 2:
+				prediction = 2*x[i-1] - x[i-2]
+			case 3:
+				prediction = 3*x[i-1] - 3*x[i-2] + x[i-3]
+			case 4:
+				prediction = 4*x[i-1] - 6*x[i-2] + 4*x[i-3] - x[i-4]
+			}
+			residual = append(residual, x[i]-prediction)
+		}
+		w.rice(residual)
+	}
+}
+
+func lpcSubframe(coefs []int64, precision, shift int) flacSubframe {
+	return func(w *flacBitWriter, x []int64, bps int) {
+		order := len(coefs)
+		w.write(0, 1)
+		w.write(uint64(32+order-1), 6)
+		w.write(0, 1)
+		for _, v := range x[:order] {
+			w.writeSigned(v, bps)
+		}
+		w.write(uint64(precision-1), 4)
+		w.writeSigned(int64(shift), 5)
+		for _, c := range coefs {
+			w.writeSigned(c, precision)
+		}
+		residual := make([]int64, 0, len(x)-order)
+		for i := order; i < len(x); i++ {
+			var sum int64
+			for j, c := range coefs {
+				sum += c * x[i-1-j]
+			}
+			residual = append(residual, x[i]-sum>>uint(shift))
+		}
+		w.rice(residual)
+	}
+}
+
+type flacTestFrame struct {
+	channelCode int // 0 mono, 1 independent stereo, 8 left/side, 9 side/right, 10 mid/side
+	subframes   []flacSubframe
+	samples     [][]int64 // per channel, before decorrelation
+}
+
+// flacStream returns a FLAC stream with STREAMINFO and the frames
+func flacStream(sampleRate, bps int, frames []flacTestFrame) []byte {
+	channels := len(frames[0].samples)
+	maxBlock := 0
+	total := 0
+	for _, frame := range frames {
+		n := len(frame.samples[0])
+		total += n
+		if n > maxBlock {
+			maxBlock = n
+		}
+	}
+
+	w := &flacBitWriter{}
+	w.write(uint64('f')<<24|uint64('L')<<16|uint64('a')<<8|uint64('C'), 32)
+	w.write(0x80, 8) // last block, STREAMINFO
+	w.write(34, 24)
+	w.write(uint64(maxBlock), 16)
+	w.write(uint64(maxBlock), 16)
+	w.write(0, 24)
+	w.write(0, 24)
+	w.write(uint64(sampleRate), 20)
+	w.write(uint64(channels-1), 3)
+	w.write(uint64(bps-1), 5)
+	w.write(uint64(total), 36)
+	for i := 0; i < 16; i++ { // MD5
+		w.write(0, 8)
+	}
+
+	for index, frame := range frames {
+		n := len(frame.samples[0])
+		w.write(0x3ffe, 14)
+		w.write(0, 2) // reserved, fixed blocking
+		w.write(7, 4) // 16-bit block size follows
+		w.write(0, 4) // sample rate from STREAMINFO
+		w.write(uint64(frame.channelCode), 4)
+		w.write(0, 3) // sample size from STREAMINFO
+		w.write(0, 1)
+		w.write(uint64(index), 8) // frame number, below 128
+		w.write(uint64(n-1), 16)
+		w.write(0, 8) // CRC-8
+
+		coded := correlate(frame.samples, frame.channelCode)
+		for ch, subframe := range frame.subframes {
+			sbps := bps
+			if (frame.channelCode == 8 && ch == 1) || (frame.channelCode == 9 && ch == 0) || (frame.channelCode == 10 && ch == 1) {
+				sbps++
+			}
+			subframe(w, coded[ch], sbps)
+		}
+		w.align()
+		w.write(0, 16) // CRC-16
+	}
+	return w.buf
+}
+
+// correlate applies the stereo mode of the channel code
+func correlate(samples [][]int64, channelCode int) [][]int64 {
+	if channelCode < 8 {
+		return samples
+	}
+	left, right := samples[0], samples[1]
+	a := make([]int64, len(left))
+	b := make([]int64, len(left))
+	for i := range left {
+		side := left[i] - right[i]
+		switch channelCode {
+		case 8:
+			a[i], b[i] = left[i], side
+		case 9:
+			a[i], b[i] = side, right[i]
+		case 10:
+			a[i], b[i] = (left[i]+right[i])>>1, side
+		}
+	}
+	return [][]int64{a, b}
+}
+
+// testSignal is a sine with noise, so the predictors leave a residual
+func testSignal(n int, amplitude float64, seed int64) []int64 {
+	rng := rand.New(rand.NewSource(seed))
+	x := make([]int64, n)
+	for i := range x {
+		v := amplitude*math.Sin(2*math.Pi*float64(i)/37) + amplitude/100*rng.NormFloat64()
+		x[i] = int64(math.Round(v))
+	}
+	return x
+}
+
+// decodeFlac writes the stream to a file and reads all of it
+func decodeFlac(t *testing.T, stream []byte) (*flacReader, []float32) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.flac")
+	if err := os.WriteFile(path, stream, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openFlac(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	var out []float32
+	buf := make([]float32, 100*f.Channels()) // not a multiple of the block size
+	for {
+		n, err := f.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, buf[:n*f.Channels()]...)
+	}
+	return f, out
+}
+
+func checkSamples(t *testing.T, got []float32, frames []flacTestFrame, bps int) {
+	t.Helper()
+	scale := float32(int64(1) << uint(bps-1))
+	i := 0
+	for _, frame := range frames {
+		for pos := range frame.samples[0] {
+			for ch := range frame.samples {
+				if i >= len(got) {
+					t.Fatalf("decoded %d samples, want more", len(got))
+				}
+				want := float32(frame.samples[ch][pos]) / scale
+				if got[i] != want {
+					t.Fatalf("sample %d channel %d: got %v, want %v", pos, ch, got[i], want)
+				}
+				i++
+			}
+		}
+	}
+	if i != len(got) {
+		t.Fatalf("decoded %d samples, want %d", len(got), i)
+	}
+}
+
+func TestFlacSubframes(t *testing.T) {
+	signal := testSignal(256, 20000, 1)
+	constant := make([]int64, 256)
+	for i := range constant {
+		constant[i] = -1234
+	}
+
+	tests := []struct {
+		name     string
+		subframe flacSubframe
+		samples  []int64
+	}{
+		{"constant", constantSubframe, constant},
+		{"verbatim", verbatimSubframe, signal},
+		{"fixed0", fixedSubframe(0), signal},
+		{"fixed1", fixedSubframe(1), signal},
+		{"fixed2", fixedSubframe(2), signal},
+		{"fixed3", fixedSubframe(3), signal},
+		{"fixed4", fixedSubframe(4), signal},
+		{"lpc2", lpcSubframe([]int64{3954, -2048}, 13, 11), signal},
+		{"lpc8", lpcSubframe([]int64{1500, 900, 300, -100, -200, 50, 20, -10}, 13, 11), signal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames := []flacTestFrame{
+				{0, []flacSubframe{test.subframe}, [][]int64{test.samples}},
+				{0, []flacSubframe{test.subframe}, [][]int64{test.samples[:192]}},
+			}
+			f, got := decodeFlac(t, flacStream(44100, 16, frames))
+			if f.SampleRate() != 44100 || f.Channels() != 1 {
+				t.Fatalf("got %v Hz %d channels, want 44100 Hz 1 channel", f.SampleRate(), f.Channels())
+			}
+			checkSamples(t, got, frames, 16)
+		})
+	}
+}
+
+func TestFlacStereoModes(t *testing.T) {
+	left := testSignal(300, 20000, 2)
+	right := testSignal(300, 15000, 3)
+	right[0] = left[0] + 1 // odd sum for mid/side
+
+	for _, test := range []struct {
+		name        string
+		channelCode int
+	}{
+		{"independent", 1},
+		{"left/side", 8},
+		{"side/right", 9},
+		{"mid/side", 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			frames := []flacTestFrame{{
+				test.channelCode,
+				[]flacSubframe{fixedSubframe(2), lpcSubframe([]int64{3954, -2048}, 13, 11)},
+				[][]int64{left, right},
+			}}
+			_, got := decodeFlac(t, flacStream(48000, 16, frames))
+			checkSamples(t, got, frames, 16)
+		})
+	}
+}
+
+func TestFlac32BitSide(t *testing.T) {
+	// Full-scale opposite samples make a side channel that needs 33 bits
+	left := []int64{math.MaxInt32, math.MinInt32, 1 << 30, -5}
+	right := []int64{math.MinInt32, math.MaxInt32, -(1 << 30), math.MaxInt32}
+
+	for _, channelCode := range []int{8, 9, 10} {
+		frames := []flacTestFrame{{
+			channelCode,
+			[]flacSubframe{verbatimSubframe, verbatimSubframe},
+			[][]int64{left, right},
+		}}
+		_, got := decodeFlac(t, flacStream(48000, 32, frames))
+		checkSamples(t, got, frames, 32)
+	}
+}
+
+func TestFlacID3(t *testing.T) {
+	frames := []flacTestFrame{{0, []flacSubframe{fixedSubframe(2)}, [][]int64{testSignal(128, 10000, 4)}}}
+	stream := flacStream(44100, 16, frames)
+
+	for _, test := range []struct {
+		name   string
+		flags  byte
+		footer bool
+	}{
+		{"tag", 0, false},
+		{"tag with footer", 0x10, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := make([]byte, 300) // syncsafe size 300 = 2<<7 | 44
+			for i := range body {
+				body[i] = 'x'
+			}
+			tag := append([]byte{'I', 'D', '3', 4, 0, test.flags, 0, 0, 2, 44}, body...)
+			if test.footer {
+				tag = append(tag, '3', 'D', 'I', 4, 0, test.flags, 0, 0, 2, 44)
+			}
+			_, got := decodeFlac(t, append(tag, stream...))
+			checkSamples(t, got, frames, 16)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+/*
+	Shared options
+	- The live server, analyze and calibrate register the calibration, audio
+	  source and direct path options on their flag set through these helpers,
+	  so the names, defaults and help stay the same everywhere
+	- Each group turns its values into the options it configures, validated
+*/
+
+type calibrationFlags struct {
+	folder        *string
+	format        *string
+	angle         *int
+	compensation  *string
+	interpolation *string
+	extrapolation *string
+	filter        *string
+}
+
+func registerCalibrationFlags(fs *flag.FlagSet) *calibrationFlags {
+	return &calibrationFlags{
+		folder:        fs.String("calfiles", "ears", "Path to the calibration files folder or a single calibration file"),
+		format:        fs.String("calformat", "auto", "Calibration file format: auto, ears, umik, rew, frd or csv"),
+		angle:         fs.Int("calangle", 0, "Angle of incidence of the calibration file when the folder holds 0° and 90° files (UMIK): 0 or 90"),
+		compensation:  fs.String("compensation", "", "Calibration set to start with when the folder holds several compensations, e.g. HEQ, IDF or RAW (default HEQ)"),
+		interpolation: fs.String("calinterpolation", "linear", "Calibration curve interpolation on a log frequency axis: linear, cubic or akima"),
+		extrapolation: fs.String("calextrapolation", "zero", "Calibration curve outside the table: zero (0 dB), hold (end values, alias clamp) or error"),
+		filter:        fs.String("calfilter", "off", "Calibration correction filter on the direct path: off, minphase or measured (when on, dBFS includes the calibration correction)"),
+	}
+}
+
+// load reads the calibration files, looked up at frequency
+func (c *calibrationFlags) load(frequency int) (*CalFiles, error) {
+	calFiles := NewCalfiles(*c.folder, frequency)
+	if err := calFiles.setFormat(*c.format); err != nil {
+		return nil, err
+	}
+	if err := calFiles.setAngle(*c.angle); err != nil {
+		return nil, err
+	}
+	if err := calFiles.setCurveOptions(*c.interpolation, *c.extrapolation); err != nil {
+		return nil, err
+	}
+	if err := calFiles.load(); err != nil {
+		return nil, fmt.Errorf("error loading calibration files: %v", err)
+	}
+	if *c.compensation != "" {
+		if err := calFiles.useCompensation(*c.compensation); err != nil {
+			return nil, err
+		}
+	}
+	return calFiles, nil
+}
+
+// filterMode returns the canonical calibration filter mode
+func (c *calibrationFlags) filterMode() (string, error) {
+	return calibrationFilterMode(*c.filter)
+}
+
+type sourceFlags struct {
+	kind       *string
+	device     *string
+	file       *string
+	sampleRate *float64
+	channelMap *string
+	synthGain  *float64
+}
+
+func registerSourceFlags(fs *flag.FlagSet) *sourceFlags {
+	return &sourceFlags{
+		kind:       fs.String("source", "portaudio", "Audio source for the direct path: portaudio, file or synth"),
+		device:     fs.String("device", defaultDevice, "Audio input device name"),
+		file:       fs.String("file", "", "WAV or FLAC file for the file source"),
+		sampleRate: fs.Float64("samplerate", 48000, "Sample rate for the portaudio and synth sources"),
+		channelMap: fs.String("channelmap", "0,1", "Input channel for left and right, e.g. 1,0 swaps them"),
+		synthGain:  fs.Float64("synthgain", 0.5, "Sine amplitude for the synth source (1.0 is full scale)"),
+	}
+}
+
+// options returns the audio source options, the synth plays frequency
+func (s *sourceFlags) options(frequency int) (AudioSourceOptions, error) {
+	channels, err := parseChannelMap(*s.channelMap)
+	if err != nil {
+		return AudioSourceOptions{}, err
+	}
+	return AudioSourceOptions{
+		Kind:            *s.kind,
+		Device:          *s.device,
+		File:            *s.file,
+		SampleRate:      *s.sampleRate,
+		FramesPerBuffer: 2048,
+		Frequency:       float64(frequency),
+		Gain:            *s.synthGain,
+		ChannelMap:      channels,
+	}, nil
+}
+
+type directFlags struct {
+	weighting     *string
+	timeWeighting *string
+	dBFS          *string
+	autoTone      *bool
+}
+
+func registerDirectFlags(fs *flag.FlagSet) *directFlags {
+	return &directFlags{
+		weighting:     fs.String("weighting", "Z", "Frequency weighting of the direct path: A, C or Z, the live server sets the REW SPL meters to it too"),
+		timeWeighting: fs.String("timeweighting", "Fast", "Time weighting of the direct path: Fast, Slow or Impulse, the live server sets the REW SPL meters to it too"),
+		dBFS:          fs.String("dbfs", "rms", "dBFS convention of the direct path: rms (full-scale square is 0 dBFS) or sine (AES17, full-scale sine is 0 dBFS)"),
+		autoTone:      fs.Bool("autotone", false, "Detect the test tone frequency for the calibration instead of using -frequency"),
+	}
+}
+
+// options returns the weighting, time weighting, dBFS convention and tone
+// detection of the direct path
+func (d *directFlags) options() (DirectOptions, error) {
+	timeWeighting, err := timeWeightingName(*d.timeWeighting)
+	if err != nil {
+		return DirectOptions{}, err
+	}
+	convention, err := dBFSConvention(*d.dBFS)
+	if err != nil {
+		return DirectOptions{}, err
+	}
+	return DirectOptions{
+		Weighting:     strings.ToUpper(*d.weighting),
+		TimeWeighting: timeWeighting,
+		DBFS:          convention,
+		AutoTone:      *d.autoTone,
+	}, nil
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+
+	"spl/rew"
 )
 
 /*
@@ -18,141 +20,32 @@ import (
 	- Forward input-levels JSON data to WebSocket clients
 */
 
-type InputLevelsCommandRequest struct {
-	Command    string   `json:"command"`
-	Parameters []string `json:"parameters"`
-}
-
-// Subscribe to REW.app for "input-levels"
+// Start/stop input-levels in REW.app
 func (s *Server) inputLevelsCommand(command string) error {
-
-	// Construct subscription request body
-	subReq := InputLevelsCommandRequest{Command: command, Parameters: []string{}}
-	reqBody, err := json.Marshal(subReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal inputLevelsCommand request: %v", err)
-	}
-
-	fmt.Printf("reqBody: %s\n", string(reqBody))
-
-	// Make the POST request
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/input-levels/command", bytes.NewBuffer(reqBody))
+	message, err := s.rewClient.InputLevelsCommand(context.Background(), command)
 	if err != nil {
-		return fmt.Errorf("failed to post inputLevelsCommand request: %v", err)
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("inputLevelsCommand request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check response
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("inputLevelsCommand request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
-type InputLevelsSubscribeParameters struct {
-	Unit string `json:"unit"`
-}
-type InputLevelsSubscribeRequest struct {
-	Url        string                         `json:"url"`
-	Parameters InputLevelsSubscribeParameters `json:"parameters"`
-}
-
+// Subscribe to REW.app for "input-levels"
 func (s *Server) inputLevelsSubscribe(url string, unit string) error {
-	parameters := InputLevelsSubscribeParameters{Unit: unit}
-	// Construct subscription request body
-	subReq := InputLevelsSubscribeRequest{
-		Url:        url,
-		Parameters: parameters,
-	}
-	reqBody, err := json.Marshal(subReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal inputLevelsSubscribe request: %v", err)
-	}
-
-	// Make the POST request
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/input-levels/subscribe", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to post inputLevelsSubscribe request: %v", err)
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	message, err := s.rewClient.InputLevelsSubscribe(context.Background(), url, unit)
 	if err != nil {
-		return fmt.Errorf("inputLevelsSubscribe request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check response
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("inputLevelsSubscribe request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
-type InputLevelsUnsubscribeRequest struct {
-	Url        string                         `json:"url"`
-	Parameters InputLevelsSubscribeParameters `json:"parameters"`
-}
-
 func (s *Server) inputLevelsUnsubscribe(url string, unit string) error {
-	parameters := InputLevelsSubscribeParameters{Unit: unit}
-	// Construct subscription request body
-	subReq := InputLevelsSubscribeRequest{
-		Url:        url,
-		Parameters: parameters,
-	}
-	reqBody, err := json.Marshal(subReq)
+	message, err := s.rewClient.InputLevelsUnsubscribe(context.Background(), url, unit)
 	if err != nil {
-		return fmt.Errorf("failed to marshal inputLevelsUnsubscribe request: %v", err)
-	}
-
-	// Make the POST request
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/input-levels/unsubscribe", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to post inputLevelsUnsubscribe request: %v", err)
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("inputLevelsUnsubscribe request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check response
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("inputLevelsUnsubscribe request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
@@ -193,15 +86,9 @@ func (server *Server) stopInputLevels(hook string) error {
 */
 
 type Metric struct {
-	Name  string  `json:"name"`
-	Value float64 `json:"value"`
-}
-
-type InputLevelsSample struct {
-	Unit            string    `json:"unit"`
-	RMS             []float64 `json:"rms"`
-	Peak            []float64 `json:"peak"`
-	TimeSpanSeconds float64   `json:"timeSpanSeconds"`
+	Name         string  `json:"name"`
+	Value        float64 `json:"value"`
+	Compensation string  `json:"compensation,omitempty"` // active calibration set
 }
 
 // Handle HTTP POST requests and forward JSON to WebSocket clients
@@ -221,14 +108,18 @@ func (s *Server) handleDBFS(w http.ResponseWriter, r *http.Request) {
 	// fmt.Printf("Received JSON: %s\n", body)
 
 	// Verify if it's valid JSON
-	sample := InputLevelsSample{}
+	sample := rew.InputLevelsSample{}
 	if err := json.Unmarshal(body, &sample); err != nil {
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
 		return
 	}
 
 	if len(sample.RMS) > 0 {
+		s.rewMu.Lock()
 		s.rewAPILeftdBFS = sample.RMS[0] // REW unit is configured as dBFS
+		s.rewMu.Unlock()
+		s.compareREWdBFS(0, sample.RMS[0])
+		s.record("rew", 0, "Left_dBFS", sample.RMS[0], "dBFS")
 		err = s.broadcast("Left_dBFS", sample.RMS[0])
 		if err != nil {
 			http.Error(w, "Failed to marshal metric JSON", http.StatusInternalServerError)
@@ -237,7 +128,11 @@ func (s *Server) handleDBFS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(sample.RMS) > 1 {
+		s.rewMu.Lock()
 		s.rewAPIRightdBFS = sample.RMS[1] // REW Unit is configured as dBFS
+		s.rewMu.Unlock()
+		s.compareREWdBFS(1, sample.RMS[1])
+		s.record("rew", 1, "Right_dBFS", sample.RMS[1], "dBFS")
 		err = s.broadcast("Right_dBFS", sample.RMS[1])
 		if err != nil {
 			http.Error(w, "Failed to marshal metric JSON", http.StatusInternalServerError)
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+/*
+	Integrating meter
+	- Leq and SEL from the frequency weighted samples since the last reset
+	- Lmax and Lmin from the time weighted level
+	- Rolling Leq over configurable windows (e.g. 1m and 10m like REW)
+	- Elapsed time since the last reset
+	- All levels are in dBFS, Server.adjust turns them into dBSPL
+*/
+
+type IntegratingLevels struct {
+	Leq         float64   `json:"leq"`
+	Lmax        float64   `json:"lmax"`
+	Lmin        float64   `json:"lmin"`
+	SEL         float64   `json:"sel"`
+	RollingLeq  []float64 `json:"rollingLeq"`
+	ElapsedTime float64   `json:"elapsedTime"`
+}
+
+type IntegratingMeter struct {
+	sampleRate float64
+	energy     float64 // sum of squared samples since reset
+	samples    int64   // samples since reset
+	maxMS      float64 // max time weighted mean square
+	minMS      float64 // min time weighted mean square
+	settle     int64   // samples to skip for Lmin while the detector charges
+	processed  int64   // samples since the meter was created
+	rolling    []*rollingLeq
+}
+
+func NewIntegratingMeter(sampleRate float64, settle time.Duration, windows []time.Duration) *IntegratingMeter {
+	m := &IntegratingMeter{
+		sampleRate: sampleRate,
+		settle:     int64(settle.Seconds() * sampleRate),
+	}
+	for _, window := range windows {
+		m.rolling = append(m.rolling, newRollingLeq(window, sampleRate))
+	}
+	m.Reset()
+	return m
+}
+
+// Process feeds one frequency weighted sample and the current time weighted
+// mean square into the meter
+func (m *IntegratingMeter) Process(x float64, timeWeightedMS float64) {
+	sq := x * x
+	m.energy += sq
+	m.samples++
+	m.processed++
+
+	if timeWeightedMS > m.maxMS {
+		m.maxMS = timeWeightedMS
+	}
+	if m.processed > m.settle && timeWeightedMS < m.minMS {
+		m.minMS = timeWeightedMS
+	}
+
+	for _, r := range m.rolling {
+		r.process(sq)
+	}
+}
+
+func (m *IntegratingMeter) Reset() {
+	m.energy = 0
+	m.samples = 0
+	m.maxMS = 0
+	m.minMS = math.Inf(1)
+	for _, r := range m.rolling {
+		r.reset()
+	}
+}
+
+func (m *IntegratingMeter) Levels() IntegratingLevels {
+	levels := IntegratingLevels{
+		Leq:         math.Inf(-1),
+		Lmax:        10 * math.Log10(m.maxMS),
+		Lmin:        math.Inf(-1),
+		SEL:         math.Inf(-1),
+		ElapsedTime: float64(m.samples) / m.sampleRate,
+	}
+
+	if m.samples > 0 {
+		levels.Leq = 10 * math.Log10(m.energy/float64(m.samples))
+		// SEL normalizes the sound energy to 1 second
+		levels.SEL = 10 * math.Log10(m.energy/m.sampleRate)
+	}
+	if !math.IsInf(m.minMS, 1) {
+		levels.Lmin = 10 * math.Log10(m.minMS)
+	}
+	for _, r := range m.rolling {
+		levels.RollingLeq = append(levels.RollingLeq, r.leq())
+	}
+
+	return levels
+}
+
+/*
+	Rolling Leq
+	- Energy per one second bucket in a ring buffer
+	- The Leq covers the last complete buckets up to the window length
+*/
+
+type rollingLeq struct {
+	window        time.Duration
+	bucketSamples int64
+	energy        []float64 // ring of complete buckets
+	next          int       // next bucket to overwrite
+	filled        int       // number of complete buckets
+	current       float64   // energy of the bucket being filled
+	currentN      int64
+}
+
+func newRollingLeq(window time.Duration, sampleRate float64) *rollingLeq {
+	buckets := int(window / time.Second)
+	if buckets < 1 {
+		buckets = 1
+	}
+	return &rollingLeq{
+		window:        window,
+		bucketSamples: int64(sampleRate),
+		energy:        make([]float64, buckets),
+	}
+}
+
+func (r *rollingLeq) process(sq float64) {
+	r.current += sq
+	r.currentN++
+	if r.currentN < r.bucketSamples {
+		return
+	}
+
+	r.energy[r.next] = r.current
+	r.next = (r.next + 1) % len(r.energy)
+	if r.filled < len(r.energy) {
+		r.filled++
+	}
+	r.current = 0
+	r.currentN = 0
+}
+
+func (r *rollingLeq) reset() {
+	r.next = 0
+	r.filled = 0
+	r.current = 0
+	r.currentN = 0
+}
+
+func (r *rollingLeq) leq() float64 {
+	// Until the first bucket completes use the partial bucket
+	if r.filled == 0 {
+		if r.currentN == 0 {
+			return math.Inf(-1)
+		}
+		return 10 * math.Log10(r.current/float64(r.currentN))
+	}
+
+	var sum float64
+	for i := 0; i < r.filled; i++ {
+		sum += r.energy[i]
+	}
+	return 10 * math.Log10(sum/float64(int64(r.filled)*r.bucketSamples))
+}
+
+// rollingLeqLabel names a window like REW does, e.g. "Leq1m" or "Leq30s"
+func rollingLeqLabel(window time.Duration) string {
+	if window%time.Minute == 0 {
+		return fmt.Sprintf("Leq%dm", int(window/time.Minute))
+	}
+	return fmt.Sprintf("Leq%ds", int(window/time.Second))
+}
+
+// parseRollingWindows parses a comma separated list of durations, e.g. "1m,10m"
+func parseRollingWindows(value string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		window, err := time.ParseDuration(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rolling Leq window '%s': %v", field, err)
+		}
+		if window < time.Second {
+			return nil, fmt.Errorf("rolling Leq window '%s' shorter than 1s", field)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
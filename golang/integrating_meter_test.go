@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const meterRate = 8000 // a 1 kHz sine has whole periods of 8 samples
+
+type meterSegment struct {
+	amplitude float64
+	seconds   float64
+}
+
+// runMeter feeds 1 kHz sine segments through the detector into the meter
+func runMeter(m *IntegratingMeter, tw *TimeWeighting, segments []meterSegment) {
+	i := 0
+	for _, segment := range segments {
+		for n := int(segment.seconds * meterRate); n > 0; n-- {
+			x := segment.amplitude * math.Sin(2*math.Pi*1000*float64(i)/meterRate)
+			tw.Process(x)
+			m.Process(x, tw.MeanSquare())
+			i++
+		}
+	}
+}
+
+// sineLevel is the level of a sine in dBFS rms
+func sineLevel(amplitude float64) float64 {
+	return 10 * math.Log10(amplitude*amplitude/2)
+}
+
+func TestIntegratingMeter(t *testing.T) {
+	quiet, loud := sineLevel(0.1), sineLevel(1)
+	tests := []struct {
+		name     string
+		segments []meterSegment
+		leq      float64
+		sel      float64
+		lmin     float64
+		lmax     float64
+		rolling  float64 // 2 s window
+		elapsed  float64
+	}{
+		{
+			name:     "constant sine",
+			segments: []meterSegment{{0.1, 10}},
+			leq:      quiet, sel: quiet + 10, lmin: quiet, lmax: quiet, rolling: quiet, elapsed: 10,
+		},
+		{
+			name:     "step up",
+			segments: []meterSegment{{0.1, 5}, {1, 5}},
+			leq:      10 * math.Log10((0.01+1)/4), sel: 10 * math.Log10(5*0.005+5*0.5),
+			lmin: quiet, lmax: loud, rolling: loud, elapsed: 10,
+		},
+		{
+			// The rolling Leq keeps the complete buckets, the last half second
+			// is not in it yet
+			name:     "partial bucket",
+			segments: []meterSegment{{0.1, 4}, {1, 0.5}},
+			leq:      10 * math.Log10((4*0.005+0.5*0.5)/4.5), sel: 10 * math.Log10(4*0.005+0.5*0.5),
+			lmin: quiet, lmax: loud, rolling: quiet, elapsed: 4.5,
+		},
+		{
+			// Before the first bucket completes the partial bucket is used
+			name:     "first bucket",
+			segments: []meterSegment{{1, 0.5}},
+			leq:      loud, sel: loud - 3.0103, lmin: math.Inf(-1), lmax: loud, rolling: loud, elapsed: 0.5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewIntegratingMeter(meterRate, time.Second, []time.Duration{2 * time.Second})
+			tw, _ := NewTimeWeighting("Fast", meterRate)
+			runMeter(m, tw, test.segments)
+			levels := m.Levels()
+
+			exact := func(name string, got, want float64) {
+				if math.Abs(got-want) > 1e-3 {
+					t.Errorf("%s %.4f, want %.4f", name, got, want)
+				}
+			}
+			exact("Leq", levels.Leq, test.leq)
+			exact("SEL", levels.SEL, test.sel)
+			exact("rolling Leq", levels.RollingLeq[0], test.rolling)
+			exact("elapsed time", levels.ElapsedTime, test.elapsed)
+
+			// Lmin and Lmax follow the Fast detector, which needs time to
+			// fall after the step; Lmin waits for the settle time
+			if math.IsInf(test.lmin, -1) != math.IsInf(levels.Lmin, -1) || !math.IsInf(test.lmin, -1) && math.Abs(levels.Lmin-test.lmin) > 0.1 {
+				t.Errorf("Lmin %.2f, want %.2f", levels.Lmin, test.lmin)
+			}
+			if math.Abs(levels.Lmax-test.lmax) > 0.1 {
+				t.Errorf("Lmax %.2f, want %.2f", levels.Lmax, test.lmax)
+			}
+		})
+	}
+}
+
+func TestIntegratingMeterReset(t *testing.T) {
+	m := NewIntegratingMeter(meterRate, time.Second, []time.Duration{time.Minute})
+	tw, _ := NewTimeWeighting("Fast", meterRate)
+	runMeter(m, tw, []meterSegment{{1, 3}})
+	m.Reset()
+	levels := m.Levels()
+	if !math.IsInf(levels.Leq, -1) || !math.IsInf(levels.RollingLeq[0], -1) || levels.ElapsedTime != 0 {
+		t.Fatalf("levels after Reset: %+v", levels)
+	}
+
+	// The detector is charged, so Lmin counts right after a reset
+	runMeter(m, tw, []meterSegment{{0.1, 0.5}})
+	if levels := m.Levels(); math.IsInf(levels.Lmin, 0) || levels.Lmin > sineLevel(1)-10 {
+		t.Fatalf("Lmin %.2f after a reset and a drop of 20 dB", levels.Lmin)
+	}
+}
+
+func TestParseRollingWindows(t *testing.T) {
+	windows, err := parseRollingWindows("1m, 10m,30s")
+	if err != nil || len(windows) != 3 || windows[2] != 30*time.Second {
+		t.Fatalf("parseRollingWindows: %v %v", windows, err)
+	}
+	if label := rollingLeqLabel(windows[0]) + rollingLeqLabel(windows[2]); label != "Leq1mLeq30s" {
+		t.Fatalf("labels %s", label)
+	}
+	for _, value := range []string{"500ms", "1x"} {
+		if _, err := parseRollingWindows(value); err == nil {
+			t.Errorf("parseRollingWindows accepted %s", value)
+		}
+	}
+}
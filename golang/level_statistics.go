@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+	Level statistics
+	- Histogram of the time weighted level with 0.1 dB bins
+	- Sampled every 10 ms from the direct stream
+	- Exceedance levels LN: the level exceeded N% of the time (L10, L50, L90, L95)
+	- All levels are in dBFS, Server.adjust turns them into dBSPL
+*/
+
+const (
+	statisticsMinLevel   = -160.0 // dBFS, lower levels count in the first bin
+	statisticsMaxLevel   = 10.0   // dBFS, higher levels count in the last bin
+	statisticsResolution = 0.1    // dB per bin
+	statisticsRate       = 100.0  // level samples per second
+)
+
+type LevelStatistics struct {
+	counts []int64
+	total  int64
+}
+
+func NewLevelStatistics() *LevelStatistics {
+	bins := int(math.Round((statisticsMaxLevel-statisticsMinLevel)/statisticsResolution)) + 1
+	return &LevelStatistics{
+		counts: make([]int64, bins),
+	}
+}
+
+// Add counts one level (dBFS) in the histogram
+func (l *LevelStatistics) Add(level float64) {
+	if math.IsNaN(level) {
+		return
+	}
+	bin := 0
+	if level >= statisticsMaxLevel {
+		bin = len(l.counts) - 1
+	} else if level > statisticsMinLevel {
+		bin = int(math.Round((level - statisticsMinLevel) / statisticsResolution))
+	}
+	l.counts[bin]++
+	l.total++
+}
+
+// Exceedance returns the level exceeded n percent of the time, or -Inf when
+// nothing has been counted yet
+func (l *LevelStatistics) Exceedance(n float64) float64 {
+	if l.total == 0 {
+		return math.Inf(-1)
+	}
+
+	// Walk down from the loudest bin until n percent of the samples are above
+	target := float64(l.total) * n / 100
+	var above int64
+	for bin := len(l.counts) - 1; bin >= 0; bin-- {
+		above += l.counts[bin]
+		if float64(above) >= target {
+			return statisticsMinLevel + float64(bin)*statisticsResolution
+		}
+	}
+	return statisticsMinLevel
+}
+
+func (l *LevelStatistics) Count() int64 {
+	return l.total
+}
+
+func (l *LevelStatistics) Reset() {
+	for i := range l.counts {
+		l.counts[i] = 0
+	}
+	l.total = 0
+}
+
+// percentileLabel names an exceedance level, e.g. "L90" or "L99.9"
+func percentileLabel(n float64) string {
+	return "L" + strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// parsePercentiles parses a comma separated list of percentages, e.g. "10,50,90,95"
+func parsePercentiles(value string) ([]float64, error) {
+	var percentiles []float64
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil || n <= 0 || n >= 100 {
+			return nil, fmt.Errorf("invalid percentile '%s'", field)
+		}
+		percentiles = append(percentiles, n)
+	}
+	return percentiles, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLevelStatisticsExceedance(t *testing.T) {
+	l := NewLevelStatistics()
+	if !math.IsInf(l.Exceedance(50), -1) {
+		t.Fatalf("L50 %v before any level", l.Exceedance(50))
+	}
+
+	// 10% at -20 dB, 40% at -30 dB, 40% at -40 dB and 10% at -50 dB, the
+	// levels round to the nearest 0.1 dB bin
+	for level, count := range map[float64]int{-20: 10, -30.04: 40, -39.96: 40, -50: 10} {
+		for i := 0; i < count; i++ {
+			l.Add(level)
+		}
+	}
+	l.Add(math.NaN())
+	if l.Count() != 100 {
+		t.Fatalf("count %d, want 100", l.Count())
+	}
+	for n, want := range map[float64]float64{1: -20, 10: -20, 11: -30, 50: -30, 90: -40, 95: -50, 99.9: -50} {
+		if got := l.Exceedance(n); math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s %.2f, want %.2f", percentileLabel(n), got, want)
+		}
+	}
+
+	l.Reset()
+	if l.Count() != 0 || !math.IsInf(l.Exceedance(10), -1) {
+		t.Fatalf("count %d L10 %v after Reset", l.Count(), l.Exceedance(10))
+	}
+}
+
+func TestLevelStatisticsRange(t *testing.T) {
+	l := NewLevelStatistics()
+	l.Add(math.Inf(-1))
+	l.Add(-200)
+	l.Add(20)
+	if got := l.Exceedance(30); got != statisticsMaxLevel {
+		t.Fatalf("L30 %v, want the last bin %v", got, statisticsMaxLevel)
+	}
+	if got := l.Exceedance(90); got != statisticsMinLevel {
+		t.Fatalf("L90 %v, want the first bin %v", got, statisticsMinLevel)
+	}
+}
+
+func TestParsePercentiles(t *testing.T) {
+	percentiles, err := parsePercentiles("10, 50,90,99.9,")
+	if err != nil || len(percentiles) != 4 || percentiles[3] != 99.9 {
+		t.Fatalf("parsePercentiles: %v %v", percentiles, err)
+	}
+	if label := percentileLabel(percentiles[0]) + percentileLabel(percentiles[3]); label != "L10L99.9" {
+		t.Fatalf("labels %s", label)
+	}
+	for _, value := range []string{"0", "100", "L10"} {
+		if _, err := parsePercentiles(value); err == nil {
+			t.Errorf("parsePercentiles accepted %s", value)
+		}
+	}
+}
@@ -1,70 +1,205 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gordonklaus/portaudio"
+	"spl/rew"
 )
 
 /*
 	Main
-	- Start REW and start server
+	- Run a subcommand (analyze, calibrate, profile, replay) when given
+	- Attach to a running REW or start one (unless -norew or a file or synth
+	  source), and start server
 	- Subscribe to REW input-levels and SPL-meters
 	- Start server
 	- Wait (Use Ctrl-C to stop)
+	- Print the session summary and the direct vs REW report
+	- Close the audio capture and the session recording
 	- Unsubscribe from REW input-levels and SPL-meters
 	- Stop REW
 */
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "calibrate":
+			runCalibrate(os.Args[2:])
+			return
+		case "profile":
+			runProfile(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+
 	// Define the -withgui flag
 	withGUI := flag.Bool("withgui", false, "Start with GUI")
+	rewPath := flag.String("rewpath", "", "REW install: app bundle, launcher, jar or folder (default is $REW_HOME or the usual install locations)")
+	rewJava := flag.String("rewjava", "", "Java to run a REW jar with (default is $JAVA_HOME/bin/java or java on the PATH)")
+	rewJVM := flag.String("rewjvm", "", "JVM options for REW, space separated, e.g. -Xmx2g")
+	rewLog := flag.String("rewlog", "", "Write REW's stdout and stderr to this file")
+	rewAttach := flag.Bool("rewattach", false, "Only attach to a running REW, fail instead of starting one")
+	noREW := flag.Bool("norew", false, "Run the direct path without REW (implied by the file and synth sources)")
+	rewShutdown := flag.Duration("rewshutdown", 10*time.Second, "Time REW gets to shut down through the API before it is signalled")
 	frequency := flag.Int("frequency", 1000, "Frequency for SPL meter")
-	calfiles := flag.String("calfiles", "ears", "Path to calibration files")
 	sploffset := flag.Int("sploffset", 94, "Fixed SPL offset")
+	profileName := flag.String("profile", "", "Rig profile name or file, sets the options not given and replaces -sploffset with its offsets")
+	calibration := registerCalibrationFlags(flag.CommandLine)
+	audioSource := registerSourceFlags(flag.CommandLine)
+	direct := registerDirectFlags(flag.CommandLine)
+	rollingLeq := flag.String("rollingleq", "1m,10m", "Rolling Leq windows for the direct path")
+	percentiles := flag.String("percentiles", "10,50,90,95", "Exceedance levels for the direct path statistics")
+	doseAlerts := flag.String("dosealerts", "50,100", "Noise dose alert thresholds in percent")
+	fftSize := flag.Int("fftsize", 0, "FFT size of the spectrum analyzer (power of 2, 0 disables)")
+	fftWindow := flag.String("fftwindow", "hann", "FFT window: hann, blackman-harris or flattop")
+	fftAveraging := flag.String("fftaveraging", "exponential", "Spectrum averaging: none, linear, exponential or peak")
+	fftAverages := flag.Int("fftaverages", 8, "Frames in the linear average or exponential time constant in frames")
+	spectrumInterval := flag.Duration("spectruminterval", 250*time.Millisecond, "Interval between spectrum broadcasts")
+	octave := flag.Int("octave", 0, "Fractional-octave bands: 1, 3, 6 or 12 (0 disables)")
+	octaveSize := flag.Int("octavefftsize", 16384, "FFT size of the fractional-octave analyzer")
+	tolerance := flag.Float64("tolerance", 1, "Difference between the direct and REW levels in dB that is flagged")
+	compareLag := flag.Duration("comparelag", 0, "Delay of the REW webhooks behind the direct levels")
+	record := flag.String("record", "", "Record the direct blocks and REW webhooks to this folder")
+	recordFormatName := flag.String("recordformat", "jsonl", "Recording format: jsonl or csv")
+	recordRotate := flag.Duration("recordrotate", time.Hour, "Start a new recording file after this time (0 disables)")
+	recordMaxSize := flag.Int64("recordmaxsize", 100, "Start a new recording file at this size in MB (0 disables)")
+	capture := flag.String("capture", "", "Capture the direct path audio to WAV files in this folder")
+	captureFormat := flag.String("captureformat", "float32", "Capture format: float32 or pcm24")
+	compareReport := flag.String("comparereport", "", "Write the direct vs REW report as JSON to this file at the end of the run")
 
 	// Parse the command-line flags
 	flag.Parse()
 
-	rewEndpoint := "http://localhost:4735"
+	// Options not given on the command line come from the rig profile
+	var profile *Profile
+	if *profileName != "" {
+		var err error
+		profile, err = loadProfile(*profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyProfile(flag.CommandLine, profile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The file and synth sources run without the E.A.R.S, so REW has nothing to measure
+	rewEndpoint := rew.DefaultURL
+	if *noREW || *audioSource.kind != "portaudio" {
+		rewEndpoint = ""
+		log.Println("Running without REW")
+	}
 	dBFSWebHook := "http://localhost:8080/dbfs"
 	SPLWebHook := "http://localhost:8080/spl"
 	c := make(chan os.Signal, 1)
 
-	err := portaudio.Initialize()
+	directOptions, err := direct.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	directOptions.RollingLeq, err = parseRollingWindows(*rollingLeq)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	directOptions.Percentiles, err = parsePercentiles(*percentiles)
 	if err != nil {
-		log.Fatal("Failed to initialize PortAudio:", err)
+		log.Fatal(err)
+	}
+
+	directOptions.DoseAlerts, err = parseDoseAlerts(*doseAlerts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	directOptions.Spectrum = SpectrumOptions{
+		Size:      *fftSize,
+		Window:    *fftWindow,
+		Averaging: *fftAveraging,
+		Averages:  *fftAverages,
 	}
+	directOptions.Octave = *octave
+	directOptions.OctaveSize = *octaveSize
 
-	calFiles := NewCalfiles(*calfiles, *frequency)
-	err = calFiles.load()
+	directOptions.CalFilter, err = calibration.filterMode()
 	if err != nil {
-		log.Fatalf("Error loading calibration files: %v", err)
+		log.Fatal(err)
 	}
 
+	calFiles, err := calibration.load(*frequency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Compensations: %s\n", strings.Join(calFiles.availableCompensations(), ", "))
+	log.Printf("Calibration LEFT: %s\n", calFiles.info(0))
+	log.Printf("Calibration RIGHT: %s\n", calFiles.info(1))
+
 	server := NewServer(
 		rewEndpoint,
 		calFiles,
 		*sploffset,
+		directOptions,
 	)
 
-	// Setup direct stream via portaudio
+	if profile != nil && len(profile.Offsets) == 2 {
+		server.offsets = profile.Offsets
+		log.Printf("Profile %s: offsets LEFT %.2f dB, RIGHT %.2f dB\n", profile.Name, profile.Offsets[0], profile.Offsets[1])
+	}
+
+	// Compare the direct levels with the REW webhooks
+	if server.rewClient != nil {
+		server.setupComparison(*tolerance, *compareLag)
+	}
+
+	// Record the session
+	if *record != "" {
+		err = server.setupRecorder(*record, *recordFormatName, *recordRotate, *recordMaxSize*1024*1024, sessionOptions(flag.CommandLine), profile)
+		if err != nil {
+			log.Fatalf("Failed to start recording: %v", err)
+		}
+	}
 
-	stream, err := server.setupAudio()
+	// Setup direct stream via portaudio, a WAV file or a synthetic signal
+
+	sourceOptions, err := audioSource.options(*frequency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sourceOptions.Realtime = true
+	sourceOptions.Loop = true
+	stream, err := server.setupAudio(sourceOptions)
 	if err != nil {
 		log.Fatalf("Failed to setup audio: %v", err)
 	}
+	defer stream.Close()
+
+	// Capture the raw audio next to the metrics
+	if *capture != "" {
+		err = server.setupCapture(*capture, *captureFormat)
+		if err != nil {
+			log.Fatalf("Failed to start capture: %v", err)
+		}
+	}
 
 	err = stream.Start()
 	if err != nil {
-		log.Fatal("Failed to start PortAudio stream:", err)
+		log.Fatal("Failed to start audio stream:", err)
 	}
 
 	// Handle WebSocket connections from browser and webhook callbacks from REW
@@ -72,49 +207,80 @@ func main() {
 	http.HandleFunc("/ws", server.handleWebSocket)
 	http.HandleFunc("/dbfs", server.handleDBFS)
 	http.HandleFunc("/spl", server.handleSPL)
+	http.HandleFunc("/compensation", server.handleCompensation)
+	http.HandleFunc("/comparison", server.handleComparison)
 
 	// Start the server with error handling for port conflict
 
-	proc, err := server.startREW(rewEndpoint, *withGUI)
-	if err != nil {
-		log.Fatalf("Failed to start REW: %v", err)
-	}
+	var proc *rew.Process
+	if rewEndpoint != "" {
+		proc, err = server.startREW(rew.LaunchOptions{
+			Path:       *rewPath,
+			Java:       *rewJava,
+			JVMOptions: strings.Fields(*rewJVM),
+			GUI:        *withGUI,
+			LogFile:    *rewLog,
+			AttachOnly: *rewAttach,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start REW: %v", err)
+		}
 
-	// Subscribe to REW input-levels and SPL-meters
+		// Subscribe to REW input-levels and SPL-meters
 
-	err = server.rewSelectInputDevice("E.A.R.S Gain: 18dB")
-	if err != nil {
-		log.Printf("Failed to select input device: %v\n", err)
-		goto process_stop
-	}
+		err = server.rewSelectInputDevice(*audioSource.device)
+		if err != nil {
+			log.Printf("Failed to select input device: %v\n", err)
+			goto process_stop
+		}
 
-	err = server.startInputLevels(dBFSWebHook)
-	if err != nil {
-		log.Printf("Failed to start input-levels: %v\n", err)
-		goto process_stop
-	}
+		err = server.startInputLevels(dBFSWebHook)
+		if err != nil {
+			log.Printf("Failed to start input-levels: %v\n", err)
+			goto process_stop
+		}
 
-	err = server.startSPLMeters(SPLWebHook)
-	if err != nil {
-		log.Printf("Failed to start spl-meters: %v\n", err)
-		goto spl_meter_unsubscribe
+		err = server.startSPLMeters(SPLWebHook)
+		if err != nil {
+			log.Printf("Failed to start spl-meters: %v\n", err)
+			goto spl_meter_unsubscribe
+		}
 	}
 
 	// Show last levels
 	go func() {
 		for {
+			left, _ := server.directBlock(0)
+			right, _ := server.directBlock(1)
 			fmt.Printf("Direct Left: %7.2f dBFS %7.2f dBSPL - Right: %7.2f dBFS %7.2f dBSPL\n",
-				server.directLeftdBFS, server.directLeftdBSPL,
-				server.directRightdBFS, server.directRightdBSPL,
+				left.DBFS, left.DBSPL,
+				right.DBFS, right.DBSPL,
 			)
+			fmt.Printf("Direct Left: %7.2f dBFS rms %7.2f dBFS sine - Right: %7.2f dBFS rms %7.2f dBFS sine\n",
+				left.DBFSRMS, left.DBFSSine,
+				right.DBFSRMS, right.DBFSSine,
+			)
+			rewLeft, rewRight := server.rewLevels(0), server.rewLevels(1)
 			fmt.Printf("REWAPI Left: %7.2f dBFS %7.2f dBSPL - Right: %7.2f dBFS %7.2f dBSPL\n",
-				server.rewAPILeftdBFS, server.rewAPILeftdBSPL,
-				server.rewAPIRightdBFS, server.rewAPIRightdBSPL,
+				rewLeft.DBFS, rewLeft.DBSPL,
+				rewRight.DBFS, rewRight.DBSPL,
 			)
+			printIntegrated(server)
+			printTone(server)
+			printComparison(server)
 			time.Sleep(1000 * time.Millisecond)
 		}
 	}()
 
+	// Publish direct metrics and spectra to WebSocket clients
+	go server.publishDirect(1000 * time.Millisecond)
+	if *fftSize > 0 {
+		go server.publishSpectrum(*spectrumInterval)
+	}
+	if *octave > 0 {
+		go server.publishOctave(1000 * time.Millisecond)
+	}
+
 	// Start server in go routine
 	go func() {
 		err := http.ListenAndServe(":8080", nil)
@@ -128,21 +294,138 @@ func main() {
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	<-c
 
+	printSummary(server)
+	printComparisonReport(server, *compareReport)
+
 spl_meter_unsubscribe:
 
-	err = server.stopSPLMeters(SPLWebHook)
+	if rewEndpoint != "" {
+		err = server.stopSPLMeters(SPLWebHook)
+		if err != nil {
+			log.Printf("Failed to unsubscribe to spl-meter: %v\n", err)
+		}
+
+		err = server.stopInputLevels(dBFSWebHook)
+		if err != nil {
+			log.Printf("Failed to stop input-levels: %v", err)
+		}
+	}
+
+process_stop:
+
+	if server.capture != nil {
+		stream.Stop()
+		err = server.capture.Close()
+		if err != nil {
+			log.Printf("Failed to close capture: %v\n", err)
+		}
+	}
+
+	if server.recorder != nil {
+		err = server.recorder.Close()
+		if err != nil {
+			log.Printf("Failed to close recording: %v\n", err)
+		}
+	}
+
+	err = server.stopREW(proc, *rewShutdown)
 	if err != nil {
-		log.Printf("Failed to unsubscribe to spl-meter: %v\n", err)
+		log.Printf("Failed to stop REW: %v\n", err)
+	}
+
+	log.Println("Server stopped")
+}
+
+// printIntegrated shows the direct and REW integrated levels side by side
+func printIntegrated(server *Server) {
+	for channel, side := range []string{"Left ", "Right"} {
+		direct := server.directLevels(channel)
+		rew := server.rewLevels(channel).SPL
+
+		rolling := ""
+		for i, window := range server.direct.RollingLeq {
+			rolling += fmt.Sprintf(" %s %7.2f", rollingLeqLabel(window), direct.RollingLeq[i])
+		}
+
+		fmt.Printf("Direct %s: Leq %7.2f Lmax %7.2f Lmin %7.2f SEL %7.2f%s - %7.1f s\n",
+			side, direct.Leq, direct.Lmax, direct.Lmin, direct.SEL, rolling, direct.ElapsedTime)
+		fmt.Printf("REWAPI %s: Leq %7.2f SEL %7.2f Leq1m %7.2f Leq10m %7.2f - %7.1f s\n",
+			side, rew.Leq, rew.Sel, rew.Leq1m, rew.Leq10m, rew.ElapsedTime)
+	}
+}
+
+// printComparison shows the running difference between the direct and REW levels
+func printComparison(server *Server) {
+	if server.comparator == nil {
+		return
+	}
+	for channel, side := range []string{"Left ", "Right"} {
+		line := ""
+		for quantity, name := range comparisonQuantities {
+			stats := server.comparator.Stats(quantity, channel)
+			if stats.Pairs == 0 {
+				continue
+			}
+			line += fmt.Sprintf(" %s %+6.2f (mean %+6.2f std %5.2f)", name, stats.LastDifference, stats.MeanDifference, stats.StdDeviation)
+		}
+		if line != "" {
+			fmt.Printf("Diff   %s:%s\n", side, line)
+		}
+	}
+}
+
+// printComparisonReport shows the direct vs REW report and writes it as JSON
+func printComparisonReport(server *Server, path string) {
+	if server.comparator == nil {
+		return
+	}
+	report := server.comparator.Report()
+	report.WriteText(os.Stdout)
+	if path == "" {
+		return
 	}
 
-	err = server.stopInputLevels(dBFSWebHook)
+	body, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		log.Printf("Failed to stop input-levels: %v", err)
+		log.Printf("Failed to marshal comparison report: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, append(body, '\n'), 0644); err != nil {
+		log.Printf("Failed to write comparison report: %v", err)
+		return
 	}
+	fmt.Printf("Saved the comparison report to %s\n", path)
+}
 
-process_stop:
+// printTone shows the detected test tone and the calibration frequency in use
+func printTone(server *Server) {
+	for channel, side := range []string{"Left ", "Right"} {
+		frequency, confidence, ok := server.directTone(channel)
+		if !ok {
+			continue
+		}
+		fmt.Printf("Tone   %s: %8.1f Hz confidence %4.2f - calibration at %8.1f Hz\n",
+			side, frequency, confidence, server.calfiles.toneFrequency(channel))
+	}
+}
 
-	server.stopREW(proc)
+// printSummary shows the end of session levels of the direct path
+func printSummary(server *Server) {
+	fmt.Println("Session summary (direct path, dBSPL):")
+	for channel, side := range []string{"Left ", "Right"} {
+		levels := server.directLevels(channel)
 
-	log.Println("Server stopped")
+		statistics := ""
+		for i, level := range server.directExceedance(channel) {
+			statistics += fmt.Sprintf(" %s %7.2f", percentileLabel(server.direct.Percentiles[i]), level)
+		}
+
+		fmt.Printf("%s: Leq %7.2f Lmax %7.2f Lmin %7.2f SEL %7.2f%s - %7.1f s\n",
+			side, levels.Leq, levels.Lmax, levels.Lmin, levels.SEL, statistics, levels.ElapsedTime)
+
+		for _, dose := range server.directDose(channel) {
+			fmt.Printf("%s: %-5s dose %7.2f %% projected 8h %7.2f %% TWA %7.2f dBA\n",
+				side, dose.Criterion, dose.Dose, dose.ProjectedDose, dose.TWA)
+		}
+	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+	Noise dose
+	- Accumulate the A-weighted, Slow time weighted level at the ear
+	- NIOSH: 85 dBA criterion, 3 dB exchange rate, no threshold
+	- OSHA: 90 dBA criterion, 5 dB exchange rate, 80 dBA threshold
+	- Dose in percent of the daily allowance, projected to 8 hours and TWA
+	  (NIOSH 10*log10(D/100) + 85, OSHA 16.61*log10(D/100) + 90)
+	- Alert thresholds in percent of the dose, reported once when crossed
+*/
+
+const doseReferenceDuration = 8 * 3600.0 // seconds
+
+type DoseCriterion struct {
+	Name           string
+	CriterionLevel float64 // dBA allowed for 8 hours (100% dose)
+	ExchangeRate   float64 // dB per halving of the allowed time
+	Threshold      float64 // dBA below which exposure is not counted
+	TWAFactor      float64 // dB per decade of dose in the TWA formula
+}
+
+var (
+	NIOSHCriterion = DoseCriterion{Name: "NIOSH", CriterionLevel: 85, ExchangeRate: 3, Threshold: 0, TWAFactor: 10}
+	OSHACriterion  = DoseCriterion{Name: "OSHA", CriterionLevel: 90, ExchangeRate: 5, Threshold: 80, TWAFactor: 16.61}
+)
+
+type NoiseDose struct {
+	criterion DoseCriterion
+	dose      float64   // percent
+	elapsed   float64   // seconds
+	alerts    []float64 // alert thresholds in percent, ascending
+	nextAlert int       // index of the next alert to report
+}
+
+func NewNoiseDose(criterion DoseCriterion, alerts []float64) *NoiseDose {
+	return &NoiseDose{
+		criterion: criterion,
+		alerts:    alerts,
+	}
+}
+
+// Add accumulates the exposure to level (dBA) during the given seconds
+func (d *NoiseDose) Add(level float64, seconds float64) {
+	d.elapsed += seconds
+
+	if math.IsNaN(level) || level < d.criterion.Threshold {
+		return
+	}
+
+	// Allowed time at this level halves for every exchange rate above the criterion
+	allowed := doseReferenceDuration / math.Pow(2, (level-d.criterion.CriterionLevel)/d.criterion.ExchangeRate)
+	d.dose += 100 * seconds / allowed
+}
+
+func (d *NoiseDose) Criterion() DoseCriterion {
+	return d.criterion
+}
+
+// Dose returns the accumulated dose in percent
+func (d *NoiseDose) Dose() float64 {
+	return d.dose
+}
+
+// ProjectedDose returns the dose in percent after 8 hours at the same exposure
+func (d *NoiseDose) ProjectedDose() float64 {
+	if d.elapsed == 0 {
+		return 0
+	}
+	return d.dose * doseReferenceDuration / d.elapsed
+}
+
+// TWA returns the 8 hour time weighted average level in dBA for the dose so far
+func (d *NoiseDose) TWA() float64 {
+	if d.dose <= 0 {
+		return math.Inf(-1)
+	}
+	return d.criterion.CriterionLevel + d.criterion.TWAFactor*math.Log10(d.dose/100)
+}
+
+// Elapsed returns the exposure time in seconds
+func (d *NoiseDose) Elapsed() float64 {
+	return d.elapsed
+}
+
+// CheckAlerts returns the alert thresholds crossed since the last call
+func (d *NoiseDose) CheckAlerts() []float64 {
+	var crossed []float64
+	for d.nextAlert < len(d.alerts) && d.dose >= d.alerts[d.nextAlert] {
+		crossed = append(crossed, d.alerts[d.nextAlert])
+		d.nextAlert++
+	}
+	return crossed
+}
+
+func (d *NoiseDose) Reset() {
+	d.dose = 0
+	d.elapsed = 0
+	d.nextAlert = 0
+}
+
+// parseDoseAlerts parses a comma separated list of dose percentages, e.g. "50,100"
+func parseDoseAlerts(value string) ([]float64, error) {
+	var alerts []float64
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid dose alert '%s'", field)
+		}
+		if len(alerts) > 0 && n <= alerts[len(alerts)-1] {
+			return nil, fmt.Errorf("dose alerts must be ascending: %s", value)
+		}
+		alerts = append(alerts, n)
+	}
+	return alerts, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+/*
+	Fractional-octave band analyzer (ANSI S1.11 / IEC 61260-1)
+	- 1/1, 1/3, 1/6 and 1/12 octave bands from 20 Hz to 20 kHz
+	- Base-10 band centers and edges (G = 10^(3/10)) around 1 kHz
+	- FFT based band summation with fractional bin overlap at the band edges
+	- Band Leq since the last reset, calibrated at each band center
+	- Bands narrower than the FFT resolution are approximated, use a larger FFT size
+*/
+
+const octaveRatio = 1.9952623149688795 // G = 10^(3/10)
+
+type octaveBand struct {
+	center  float64
+	lower   float64
+	upper   float64
+	bins    []int     // FFT bins overlapping the band
+	weights []float64 // fraction of each bin inside the band
+}
+
+type OctaveAnalyzer struct {
+	fraction int
+	analyzer *SpectrumAnalyzer
+	bands    []octaveBand
+	energy   []float64 // summed band power since reset
+	frames   int
+}
+
+// octaveBands returns the base-10 bands of 1/fraction octave between 20 Hz and 20 kHz
+func octaveBands(fraction int, nyquist float64) []octaveBand {
+	b := float64(fraction)
+	var bands []octaveBand
+	for x := -6 * fraction; x <= 5*fraction; x++ {
+		var center float64
+		if fraction%2 == 1 {
+			center = 1000 * math.Pow(octaveRatio, float64(x)/b)
+		} else {
+			center = 1000 * math.Pow(octaveRatio, float64(2*x+1)/(2*b))
+		}
+		if center < 20*math.Pow(octaveRatio, -0.5/b) || center > 20000*math.Pow(octaveRatio, 0.5/b) {
+			continue
+		}
+		band := octaveBand{
+			center: center,
+			lower:  center * math.Pow(octaveRatio, -0.5/b),
+			upper:  center * math.Pow(octaveRatio, 0.5/b),
+		}
+		if band.upper >= nyquist {
+			break
+		}
+		bands = append(bands, band)
+	}
+	return bands
+}
+
+func NewOctaveAnalyzer(fraction int, size int, sampleRate float64) (*OctaveAnalyzer, error) {
+	switch fraction {
+	case 1, 3, 6, 12:
+	default:
+		return nil, fmt.Errorf("unsupported octave fraction 1/%d", fraction)
+	}
+
+	analyzer, err := NewSpectrumAnalyzer(SpectrumOptions{Size: size, Window: "hann"}, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &OctaveAnalyzer{
+		fraction: fraction,
+		analyzer: analyzer,
+		bands:    octaveBands(fraction, sampleRate/2),
+	}
+	o.energy = make([]float64, len(o.bands))
+	analyzer.onFrame = o.addFrame
+
+	// Each bin k covers [(k-0.5)df, (k+0.5)df], weight it by its overlap with the band
+	df := sampleRate / float64(size)
+	for i := range o.bands {
+		band := &o.bands[i]
+		first := int(math.Floor(band.lower/df + 0.5))
+		last := int(math.Floor(band.upper/df + 0.5))
+		for k := first; k <= last && k <= size/2; k++ {
+			lo := math.Max(band.lower, (float64(k)-0.5)*df)
+			hi := math.Min(band.upper, (float64(k)+0.5)*df)
+			if hi > lo {
+				band.bins = append(band.bins, k)
+				band.weights = append(band.weights, (hi-lo)/df)
+			}
+		}
+	}
+
+	return o, nil
+}
+
+func (o *OctaveAnalyzer) Process(x float64) {
+	o.analyzer.Process(x)
+}
+
+func (o *OctaveAnalyzer) addFrame(power []float64) {
+	enbw := o.analyzer.ENBW()
+	for i, band := range o.bands {
+		sum := 0.0
+		for j, k := range band.bins {
+			sum += power[k] * band.weights[j]
+		}
+		o.energy[i] += sum / enbw
+	}
+	o.frames++
+}
+
+// Centers returns the exact band center frequencies
+func (o *OctaveAnalyzer) Centers() []float64 {
+	centers := make([]float64, len(o.bands))
+	for i, band := range o.bands {
+		centers[i] = band.center
+	}
+	return centers
+}
+
+// Leq returns the band Leq in dBFS since the last reset
+func (o *OctaveAnalyzer) Leq() []float64 {
+	levels := make([]float64, len(o.bands))
+	for i := range o.bands {
+		levels[i] = 10 * math.Log10(o.energy[i]/float64(o.frames))
+	}
+	return levels
+}
+
+func (o *OctaveAnalyzer) Frames() int {
+	return o.frames
+}
+
+func (o *OctaveAnalyzer) Reset() {
+	for i := range o.energy {
+		o.energy[i] = 0
+	}
+	o.frames = 0
+}
+
+/*
+	Publish band levels
+	- Band Leq in dBSPL, calibrated at each band center
+	- Broadcast as {"name": "Direct_Left_Octave3", "frequencies": [...], "values": [...]}
+	- The energy sum of the calibrated bands as "Direct_Left_BandTotal"
+*/
+
+// directOctave returns the calibrated band Leq of a channel in dBSPL and
+// the energy sum of the bands
+func (s *Server) directOctave(channel int) (Spectrum, float64, bool) {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	if s.octaves == nil || s.octaves[channel].Frames() == 0 {
+		return Spectrum{}, 0, false
+	}
+
+	octave := s.octaves[channel]
+	spectrum := Spectrum{
+		Frequencies:  octave.Centers(),
+		Values:       octave.Leq(),
+		Compensation: s.calfiles.activeCompensation(),
+	}
+
+	total := 0.0
+	for i, center := range spectrum.Frequencies {
+		level := s.adjustAt(channel, center, spectrum.Values[i])
+		total += math.Pow(10, level/10)
+		spectrum.Values[i] = floorLevel(level)
+	}
+
+	return spectrum, 10 * math.Log10(total), true
+}
+
+func (s *Server) publishOctave(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		for channel, side := range []string{"Left", "Right"} {
+			spectrum, total, ok := s.directOctave(channel)
+			if !ok {
+				continue
+			}
+			spectrum.Name = fmt.Sprintf("Direct_%s_Octave%d", side, s.direct.Octave)
+			if err := s.broadcastJSON(spectrum); err != nil {
+				log.Printf("Failed to broadcast %s: %v", spectrum.Name, err)
+			}
+			s.broadcastLevel("Direct_"+side+"_BandTotal", total)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//go:build !noportaudio
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+/*
+	PortAudio source
+	- Setup portaudio
+	- Open a stream for the named input device (e.g. "E.A.R.S Gain: 18dB")
+	- Deliver the stream callback buffers to the handler
+
+	Build with -tags noportaudio on machines without the PortAudio library.
+*/
+
+type portAudioSource struct {
+	stream          *portaudio.Stream
+	sampleRate      float64
+	framesPerBuffer int
+}
+
+func newPortAudioSource(opts AudioSourceOptions, handler AudioHandler) (AudioSource, error) {
+
+	err := portaudio.Initialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize PortAudio: %v", err)
+	}
+
+	stream, err := openPortAudioStream(opts, handler)
+	if err != nil {
+		portaudio.Terminate()
+		return nil, err
+	}
+
+	return &portAudioSource{
+		stream:          stream,
+		sampleRate:      opts.SampleRate,
+		framesPerBuffer: opts.FramesPerBuffer,
+	}, nil
+}
+
+func openPortAudioStream(opts AudioSourceOptions, handler AudioHandler) (*portaudio.Stream, error) {
+
+	apis, err := portaudio.HostApis()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, api := range apis {
+		fmt.Printf("Host API %d: %s\n", i, api.Name)
+	}
+
+	var inDev *portaudio.DeviceInfo
+
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, dev := range devices {
+		fmt.Printf("Device %d: %s\n", i, dev.Name)
+		if dev.Name == opts.Device {
+			inDev = devices[i]
+		}
+	}
+
+	if inDev == nil {
+		return nil, fmt.Errorf("input device '%s' not found", opts.Device)
+	}
+
+	p := portaudio.HighLatencyParameters(inDev, nil)
+	p.Input.Channels = 2
+	p.Output.Channels = 0
+	p.SampleRate = opts.SampleRate
+	p.FramesPerBuffer = opts.FramesPerBuffer
+
+	// PortAudio needs a func value with a concrete signature
+	callback := func(in []float32) { handler(in) }
+
+	return portaudio.OpenStream(p, callback)
+}
+
+func (p *portAudioSource) Start() error         { return p.stream.Start() }
+func (p *portAudioSource) Stop() error          { return p.stream.Stop() }
+func (p *portAudioSource) SampleRate() float64  { return p.sampleRate }
+func (p *portAudioSource) Channels() int        { return 2 }
+func (p *portAudioSource) FramesPerBuffer() int { return p.framesPerBuffer }
+
+func (p *portAudioSource) Close() error {
+	err := p.stream.Close()
+	portaudio.Terminate()
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build noportaudio
+
+package main
+
+import "fmt"
+
+/*
+	PortAudio source (disabled)
+	- Built with -tags noportaudio, only the file and synth sources are available
+*/
+
+func newPortAudioSource(opts AudioSourceOptions, handler AudioHandler) (AudioSource, error) {
+	return nil, fmt.Errorf("PortAudio support not built in (built with -tags noportaudio)")
+}
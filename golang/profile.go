@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Measurement rig profiles
+	- JSON file per rig: device, sample rate, channel map, calibration files,
+	  per-channel offsets, weighting and time weighting
+	- Stored in the profiles folder ($LEVELS_PROFILES or <user config>/levels/profiles)
+	  as <name>.json, or anywhere when given as a path
+	- -profile <name|path> on the main command, analyze and calibrate fills in
+	  every option that is not given on the command line
+	- The offsets replace -sploffset in Server.adjust
+	- levels profile list|show|save manage the profiles, levels calibrate
+	  writes the offsets
+*/
+
+type Profile struct {
+	Name             string              `json:"name"`
+	Device           string              `json:"device,omitempty"`
+	Source           string              `json:"source,omitempty"`
+	SampleRate       float64             `json:"sampleRate,omitempty"`
+	ChannelMap       []int               `json:"channelMap,omitempty"` // input channel for left and right
+	CalFiles         string              `json:"calfiles,omitempty"`
+	CalFormat        string              `json:"calformat,omitempty"`
+	CalAngle         int                 `json:"calangle,omitempty"` // 0 or 90
+	CalInterpolation string              `json:"calinterpolation,omitempty"`
+	CalExtrapolation string              `json:"calextrapolation,omitempty"`
+	Compensation     string              `json:"compensation,omitempty"`
+	Frequency        int                 `json:"frequency,omitempty"`
+	Weighting        string              `json:"weighting,omitempty"`
+	TimeWeighting    string              `json:"timeWeighting,omitempty"`
+	Offsets          []float64           `json:"offsets,omitempty"` // dB per channel, added to dBFS instead of -sploffset
+	Calibration      *ProfileCalibration `json:"calibration,omitempty"`
+}
+
+// ProfileCalibration records how the offsets were measured
+type ProfileCalibration struct {
+	Date          time.Time `json:"date"`
+	Reference     float64   `json:"reference"` // dBSPL of the calibrator or tone
+	Frequency     float64   `json:"frequency"` // Hz
+	Duration      float64   `json:"duration"`  // seconds averaged
+	Measured      []float64 `json:"measured"`  // Leq per channel in dBFS
+	ToneFrequency []float64 `json:"toneFrequency,omitempty"`
+	CalFiles      string    `json:"calfiles"`
+	Compensation  string    `json:"compensation,omitempty"`
+	Weighting     string    `json:"weighting"`
+}
+
+// profilesDir returns the folder with the named profiles
+func profilesDir() (string, error) {
+	if dir := os.Getenv("LEVELS_PROFILES"); dir != "" {
+		return dir, nil
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no profiles folder: %v", err)
+	}
+	return filepath.Join(config, "levels", "profiles"), nil
+}
+
+// profilePath returns the file of a profile given by name or path
+func profilePath(nameOrPath string) (string, error) {
+	if strings.ContainsAny(nameOrPath, `/\`) || strings.HasSuffix(nameOrPath, ".json") {
+		return nameOrPath, nil
+	}
+	dir, err := profilesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, nameOrPath+".json"), nil
+}
+
+func loadProfile(nameOrPath string) (*Profile, error) {
+	path, err := profilePath(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading profile: %v", err)
+	}
+
+	profile := &Profile{}
+	if err := json.Unmarshal(body, profile); err != nil {
+		return nil, fmt.Errorf("error parsing profile %s: %v", path, err)
+	}
+	if len(profile.Offsets) != 0 && len(profile.Offsets) != 2 {
+		return nil, fmt.Errorf("profile %s must have 2 offsets, found %d", path, len(profile.Offsets))
+	}
+	if profile.ChannelMap != nil {
+		if err := validateChannelMap(profile.ChannelMap); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", path, err)
+		}
+	}
+	if profile.Name == "" {
+		profile.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+	}
+	return profile, nil
+}
+
+func (p *Profile) save(nameOrPath string) error {
+	path, err := profilePath(nameOrPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating profiles folder: %v", err)
+	}
+
+	body, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(body, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing profile: %v", err)
+	}
+	return nil
+}
+
+// flagValues returns the profile settings by option name
+func (p *Profile) flagValues() map[string]string {
+	values := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	set("device", p.Device)
+	set("source", p.Source)
+	if p.SampleRate > 0 {
+		set("samplerate", strconv.FormatFloat(p.SampleRate, 'g', -1, 64))
+	}
+	if p.ChannelMap != nil {
+		set("channelmap", formatChannelMap(p.ChannelMap))
+	}
+	set("calfiles", p.CalFiles)
+	set("calformat", p.CalFormat)
+	if p.CalAngle > 0 {
+		set("calangle", strconv.Itoa(p.CalAngle))
+	}
+	set("calinterpolation", p.CalInterpolation)
+	set("calextrapolation", p.CalExtrapolation)
+	set("compensation", p.Compensation)
+	if p.Frequency > 0 {
+		set("frequency", strconv.Itoa(p.Frequency))
+	}
+	set("weighting", p.Weighting)
+	set("timeweighting", p.TimeWeighting)
+	return values
+}
+
+// setFlag stores an option value in the profile
+func (p *Profile) setFlag(name, value string) error {
+	var err error
+	switch name {
+	case "device":
+		p.Device = value
+	case "source":
+		p.Source = value
+	case "samplerate":
+		p.SampleRate, err = strconv.ParseFloat(value, 64)
+	case "channelmap":
+		p.ChannelMap, err = parseChannelMap(value)
+	case "calfiles":
+		p.CalFiles = value
+	case "calformat":
+		p.CalFormat = value
+	case "calangle":
+		p.CalAngle, err = strconv.Atoi(value)
+	case "calinterpolation":
+		p.CalInterpolation, err = curveInterpolation(value)
+	case "calextrapolation":
+		p.CalExtrapolation, err = curveExtrapolation(value)
+	case "compensation":
+		p.Compensation = value
+	case "frequency":
+		p.Frequency, err = strconv.Atoi(value)
+	case "weighting":
+		p.Weighting = strings.ToUpper(value)
+	case "timeweighting":
+		p.TimeWeighting, err = timeWeightingName(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s '%s': %v", name, value, err)
+	}
+	return nil
+}
+
+// setFlags stores the options given on the command line in the profile, or
+// all options including the defaults
+func (p *Profile) setFlags(fs *flag.FlagSet, all bool) error {
+	visit := fs.Visit
+	if all {
+		visit = fs.VisitAll
+	}
+	var err error
+	visit(func(f *flag.Flag) {
+		if err == nil {
+			err = p.setFlag(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// applyProfile sets the options of fs that were not given on the command line
+// from the profile
+func applyProfile(fs *flag.FlagSet, profile *Profile) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for name, value := range profile.flagValues() {
+		if given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("profile %s: invalid %s '%s': %v", profile.Name, name, value, err)
+		}
+	}
+	return nil
+}
+
+// parseChannelMap parses the input channel for left and right, e.g. "1,0" swaps them
+func parseChannelMap(value string) ([]int, error) {
+	var channels []int
+	for _, field := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel map '%s'", value)
+		}
+		channels = append(channels, n)
+	}
+	if err := validateChannelMap(channels); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+func validateChannelMap(channels []int) error {
+	if len(channels) != 2 {
+		return fmt.Errorf("channel map needs an input channel for left and right, found %d", len(channels))
+	}
+	for _, n := range channels {
+		if n < 0 || n > 1 {
+			return fmt.Errorf("input channel %d is out of range, the sources deliver 2 channels", n)
+		}
+	}
+	return nil
+}
+
+func formatChannelMap(channels []int) string {
+	fields := make([]string, len(channels))
+	for i, n := range channels {
+		fields[i] = strconv.Itoa(n)
+	}
+	return strings.Join(fields, ",")
+}
+
+/*
+	levels profile list
+	levels profile show <name|path>
+	levels profile save [options] <name|path>
+*/
+
+func runProfile(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: levels profile list|show|save\n")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		if err := listProfiles(); err != nil {
+			log.Fatal(err)
+		}
+	case "show":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: levels profile show <name|path>\n")
+			os.Exit(2)
+		}
+		profile, err := loadProfile(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := json.MarshalIndent(profile, "", "  ")
+		fmt.Println(string(body))
+	case "save":
+		saveProfile(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown profile command '%s', use list, show or save\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func listProfiles() error {
+	dir, err := profilesDir()
+	if err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	fmt.Printf("Profiles in %s:\n", dir)
+	for _, path := range paths {
+		profile, err := loadProfile(path)
+		if err != nil {
+			fmt.Printf("%-20s %v\n", filepath.Base(path), err)
+			continue
+		}
+		calibrated := "not calibrated"
+		if profile.Calibration != nil {
+			calibrated = "calibrated " + profile.Calibration.Date.Format("2006-01-02")
+		}
+		fmt.Printf("%-20s device %q, calfiles %q, %s\n", profile.Name, profile.Device, profile.CalFiles, calibrated)
+	}
+	return nil
+}
+
+// saveProfile creates or updates a profile with the given options, options
+// that are not given keep their value in an existing profile
+func saveProfile(args []string) {
+	fs := flag.NewFlagSet("profile save", flag.ExitOnError)
+	fs.String("device", defaultDevice, "Audio input device name")
+	fs.String("source", "portaudio", "Audio source: portaudio, file or synth")
+	fs.Float64("samplerate", 48000, "Sample rate")
+	fs.String("channelmap", "0,1", "Input channel for left and right, e.g. 1,0 swaps them")
+	fs.String("calfiles", "ears", "Path to the calibration files folder or a single calibration file")
+	fs.String("calformat", "auto", "Calibration file format: auto, ears, umik, rew, frd or csv")
+	fs.Int("calangle", 0, "Angle of incidence of the calibration file when the folder holds 0° and 90° files (UMIK): 0 or 90")
+	fs.String("compensation", "", "Calibration set, e.g. HEQ, IDF or RAW")
+	fs.String("calinterpolation", "linear", "Calibration curve interpolation on a log frequency axis: linear, cubic or akima")
+	fs.String("calextrapolation", "zero", "Calibration curve outside the table: zero (0 dB), hold (end values, alias clamp) or error")
+	fs.Int("frequency", 1000, "Frequency for calibration")
+	fs.String("weighting", "Z", "Frequency weighting: A, C or Z")
+	fs.String("timeweighting", "Fast", "Time weighting: Fast, Slow or Impulse")
+	offsets := fs.String("offsets", "", "Per-channel SPL offsets, e.g. 103.8,104.0 (normally written by levels calibrate)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: levels profile save [options] <name|path>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+
+	// Update an existing profile with the given options, a new one gets the defaults too
+	path, err := profilePath(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile, all := &Profile{Name: strings.TrimSuffix(filepath.Base(path), ".json")}, true
+	if _, err := os.Stat(path); err == nil {
+		if profile, err = loadProfile(path); err != nil {
+			log.Fatal(err)
+		}
+		all = false
+	}
+	if err := profile.setFlags(fs, all); err != nil {
+		log.Fatal(err)
+	}
+	if *offsets != "" {
+		profile.Offsets = nil
+		for _, field := range strings.Split(*offsets, ",") {
+			offset, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				log.Fatalf("Invalid offsets '%s'", *offsets)
+			}
+			profile.Offsets = append(profile.Offsets, offset)
+		}
+		if len(profile.Offsets) != 2 {
+			log.Fatalf("Offsets need a value for left and right: '%s'", *offsets)
+		}
+	}
+
+	if err := profile.save(path); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Saved profile %s to %s\n", profile.Name, path)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Session recording
+	- -record <folder> writes every direct block (dBFS and dBSPL per channel)
+	  and every REW /dbfs and /spl webhook sample to disk
+	- Each entry has the time, source (direct or rew), channel, metric name
+	  as broadcast (e.g. "Direct_Left_dBFS"), value, unit and compensation
+	- JSON Lines (-recordformat jsonl) or CSV (-recordformat csv)
+	- Every file starts with a session header: the command line, all options,
+	  the calibration files, offsets and the profile
+	- A new file is started every -recordrotate or when a file reaches
+	  -recordmaxsize, named levels-<start>-<part>.<ext>
+	- Entries go through a writeQueue, so the audio callback and the webhooks
+	  never wait for the disk; entries are dropped when the queue is full
+*/
+
+// recorderQueue is the number of entries waiting for the writer
+const recorderQueue = 8192
+
+type RecordEntry struct {
+	Time         time.Time `json:"time"`
+	Source       string    `json:"source"`  // "direct" or "rew"
+	Channel      string    `json:"channel"` // "Left" or "Right"
+	Name         string    `json:"name"`    // metric name as broadcast
+	Value        float64   `json:"value"`
+	Unit         string    `json:"unit"` // "dBFS" or "dBSPL"
+	Compensation string    `json:"compensation,omitempty"`
+}
+
+type SessionHeader struct {
+	Session      string            `json:"session"` // start time, shared by all parts
+	Part         int               `json:"part"`
+	Start        time.Time         `json:"start"`
+	Format       string            `json:"format"`
+	Command      []string          `json:"command"`
+	Options      map[string]string `json:"options"`
+	Profile      *Profile          `json:"profile,omitempty"`
+	SPLOffset    int               `json:"splOffset"`
+	Offsets      []float64         `json:"offsets,omitempty"`
+	Compensation string            `json:"compensation,omitempty"`
+	Calibration  []CalibrationInfo `json:"calibration"`
+}
+
+// recordFormat returns the canonical recording format
+func recordFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", "jsonl", "json":
+		return "jsonl", nil
+	case "csv":
+		return "csv", nil
+	default:
+		return "", fmt.Errorf("unknown recording format '%s', use jsonl or csv", format)
+	}
+}
+
+type Recorder struct {
+	folder  string
+	format  string
+	rotate  time.Duration // 0 disables rotation by time
+	maxSize int64         // bytes, 0 disables rotation by size
+	header  SessionHeader
+	queue   *writeQueue[RecordEntry]
+
+	mu   sync.Mutex
+	path string // file being written, changed by the writer on rotation
+
+	// Owned by the writer goroutine
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+func NewRecorder(folder, format string, rotate time.Duration, maxSize int64, header SessionHeader) (*Recorder, error) {
+	format, err := recordFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, fmt.Errorf("error creating recording folder: %v", err)
+	}
+
+	header.Start = time.Now()
+	header.Session = header.Start.Format("20060102-150405")
+	header.Part = 1
+	header.Format = format
+	r := &Recorder{
+		folder:  folder,
+		format:  format,
+		rotate:  rotate,
+		maxSize: maxSize,
+		header:  header,
+		queue:   newWriteQueue[RecordEntry]("Recorder", "entries", recorderQueue),
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	r.queue.Start(r.write, r.flush)
+	return r, nil
+}
+
+// Record queues an entry without blocking
+func (r *Recorder) Record(entry RecordEntry) {
+	r.queue.Push(entry)
+}
+
+// Close writes the queued entries and closes the file
+func (r *Recorder) Close() error {
+	if !r.queue.Close() {
+		return nil
+	}
+	return r.closeFile()
+}
+
+// Path returns the file being written
+func (r *Recorder) Path() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+func (r *Recorder) write(entry RecordEntry) error {
+	if (r.rotate > 0 && time.Since(r.opened) >= r.rotate) || (r.maxSize > 0 && r.size >= r.maxSize) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		r.header.Part++
+		r.header.Start = time.Now()
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	var line []byte
+	switch r.format {
+	case "csv":
+		record := []string{
+			entry.Time.Format(time.RFC3339Nano),
+			entry.Source,
+			entry.Channel,
+			entry.Name,
+			strconv.FormatFloat(entry.Value, 'f', 4, 64),
+			entry.Unit,
+			entry.Compensation,
+		}
+		line = []byte(strings.Join(record, ",") + "\n")
+	default:
+		body, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(body, '\n')
+	}
+
+	n, err := r.writer.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+// open starts a new file with the session header
+func (r *Recorder) open() error {
+	path := filepath.Join(r.folder, fmt.Sprintf("levels-%s-%03d.%s", r.header.Session, r.header.Part, r.format))
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating recording: %v", err)
+	}
+	r.mu.Lock()
+	r.path = path
+	r.mu.Unlock()
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.opened = time.Now()
+	r.size = 0
+
+	header, err := json.Marshal(r.header)
+	if err != nil {
+		return err
+	}
+	switch r.format {
+	case "csv":
+		// The header is a comment line, followed by the column names
+		fmt.Fprintf(r.writer, "# %s\n", header)
+		fmt.Fprintln(r.writer, "time,source,channel,name,value,unit,compensation")
+	default:
+		fmt.Fprintf(r.writer, "{\"header\":%s}\n", header)
+	}
+	return r.writer.Flush()
+}
+
+func (r *Recorder) flush() error {
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer.Flush()
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	r.writer = nil
+	return err
+}
+
+// sessionOptions returns the value of every option of fs
+func sessionOptions(fs *flag.FlagSet) map[string]string {
+	options := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		options[f.Name] = f.Value.String()
+	})
+	return options
+}
+
+/*
+	Server wiring
+*/
+
+// setupRecorder starts recording the session to folder
+func (s *Server) setupRecorder(folder, format string, rotate time.Duration, maxSize int64, options map[string]string, profile *Profile) error {
+	header := SessionHeader{
+		Command:      os.Args,
+		Options:      options,
+		Profile:      profile,
+		SPLOffset:    s.sploffset,
+		Offsets:      s.offsets,
+		Compensation: s.calfiles.activeCompensation(),
+		Calibration:  []CalibrationInfo{s.calfiles.info(0), s.calfiles.info(1)},
+	}
+	recorder, err := NewRecorder(folder, format, rotate, maxSize, header)
+	if err != nil {
+		return err
+	}
+	s.recorder = recorder
+	log.Printf("Recording to %s\n", recorder.Path())
+	return nil
+}
+
+// record queues a metric for the recording, if there is one, levels that are
+// not finite (e.g. digital silence) are skipped
+func (s *Server) record(source string, channel int, name string, value float64, unit string) {
+	if s.recorder == nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return
+	}
+	s.recorder.Record(RecordEntry{
+		Time:         time.Now(),
+		Source:       source,
+		Channel:      comparisonChannels[channel],
+		Name:         name,
+		Value:        value,
+		Unit:         unit,
+		Compensation: s.calfiles.activeCompensation(),
+	})
+}
+
+// recordDirect queues the levels of the block that just ended
+func (s *Server) recordDirect() {
+	if s.recorder == nil {
+		return
+	}
+	s.record("direct", 0, "Direct_Left_dBFS", s.directLeftdBFS, "dBFS")
+	s.record("direct", 0, "Direct_Left_dBSPL", s.directLeftdBSPL, "dBSPL")
+	s.record("direct", 1, "Direct_Right_dBFS", s.directRightdBFS, "dBFS")
+	s.record("direct", 1, "Direct_Right_dBSPL", s.directRightdBSPL, "dBSPL")
+}
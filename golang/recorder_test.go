@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEntries returns n entries 100 ms apart, alternating the channels
+func testEntries(n int) []RecordEntry {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	entries := make([]RecordEntry, n)
+	for i := range entries {
+		channel := comparisonChannels[i%2]
+		entries[i] = RecordEntry{
+			Time:         start.Add(time.Duration(i) * 100 * time.Millisecond),
+			Source:       "direct",
+			Channel:      channel,
+			Name:         "Direct_" + channel + "_dBSPL",
+			Value:        60 + float64(i)/8,
+			Unit:         "dBSPL",
+			Compensation: "HEQ",
+		}
+	}
+	return entries
+}
+
+func TestRecorderRoundTrip(t *testing.T) {
+	const maxSize = 2000
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			folder := t.TempDir()
+			recorder, err := NewRecorder(folder, format, 0, maxSize, SessionHeader{
+				Options:     map[string]string{"weighting": "A"},
+				SPLOffset:   94,
+				Calibration: []CalibrationInfo{{File: "L_HEQ_8604511.txt"}, {File: "R_HEQ_8604511.txt"}},
+			})
+			if err != nil {
+				t.Fatalf("NewRecorder: %v", err)
+			}
+			entries := testEntries(100)
+			for _, entry := range entries {
+				recorder.Record(entry)
+				recorder.Path()
+			}
+			if err := recorder.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			parts, _ := filepath.Glob(filepath.Join(folder, "levels-*."+format))
+			if len(parts) < 3 {
+				t.Fatalf("%d parts, want the recording rotated by size", len(parts))
+			}
+			if last := parts[len(parts)-1]; recorder.Path() != last {
+				t.Fatalf("Path %s, want the last part %s", recorder.Path(), last)
+			}
+
+			var read []RecordEntry
+			var session string
+			for i, part := range parts {
+				header, partEntries, err := readRecording(part)
+				if err != nil {
+					t.Fatalf("readRecording: %v", err)
+				}
+				if header.Part != i+1 || header.Format != format || header.SPLOffset != 94 ||
+					header.Options["weighting"] != "A" || len(header.Calibration) != 2 {
+					t.Fatalf("part %d header %+v", i+1, header)
+				}
+				if session == "" {
+					session = header.Session
+				} else if header.Session != session {
+					t.Fatalf("part %d of session %s, want %s", i+1, header.Session, session)
+				}
+
+				// The session header does not count towards the size, the
+				// entry that reaches it finishes the part
+				info, _ := os.Stat(part)
+				if info.Size() >= maxSize+1024 || (i < len(parts)-1 && info.Size() < maxSize) {
+					t.Fatalf("part %d has %d bytes, rotating at %d", i+1, info.Size(), maxSize)
+				}
+				read = append(read, partEntries...)
+			}
+
+			if len(read) != len(entries) {
+				t.Fatalf("read %d entries, want %d", len(read), len(entries))
+			}
+			for i, entry := range entries {
+				got := read[i]
+				if !got.Time.Equal(entry.Time) || got.Value != entry.Value ||
+					got.Source != entry.Source || got.Channel != entry.Channel || got.Name != entry.Name ||
+					got.Unit != entry.Unit || got.Compensation != entry.Compensation {
+					t.Fatalf("entry %d: %+v, want %+v", i, got, entry)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordFormat(t *testing.T) {
+	for format, want := range map[string]string{"": "jsonl", "JSON": "jsonl", "csv": "csv"} {
+		if got, err := recordFormat(format); err != nil || got != want {
+			t.Errorf("recordFormat(%q) = %q, %v, want %q", format, got, err, want)
+		}
+	}
+	if _, err := recordFormat("xml"); err == nil {
+		t.Errorf("recordFormat accepted xml")
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Replay
+	- levels replay [options] <session>
+	- <session> is a recording file (all parts of its session are played), or
+	  a recording folder (the latest session in it is played)
+	- Re-broadcast the recorded metrics over /ws as the same Metric JSON the
+	  live server sends, in real time or at -speed times real time
+	- WebSocket commands:
+	  {"command": "pause"}, {"command": "play"}
+	  {"command": "seek", "value": "90s"} from the start, "+10s" or "-10s" from
+	  the current position
+	  {"command": "speed", "value": "4"}
+	- GET /replay returns the position, duration, speed and state, the position
+	  is also broadcast every second as "Replay_Position"
+	- No E.A.R.S, PortAudio or REW needed
+*/
+
+var recordingNamePattern = regexp.MustCompile(`^levels-(\d{8}-\d{6})-(\d+)\.(jsonl|csv)$`)
+
+type ReplayStatus struct {
+	Session  string  `json:"session"`
+	Position float64 `json:"position"` // seconds from the start
+	Duration float64 `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	Entries  int     `json:"entries"`
+}
+
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Playback speed, 2 plays twice as fast as recorded")
+	loop := fs.Bool("loop", false, "Start over at the end of the session")
+	paused := fs.Bool("paused", false, "Start paused, waiting for a play command")
+	addr := fs.String("addr", ":8080", "Address of the WebSocket server")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: levels replay [options] <recording file or folder>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	header, entries, err := loadSession(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *speed <= 0 {
+		log.Fatalf("Invalid speed %v", *speed)
+	}
+
+	server := NewServer("", nil, header.SPLOffset, DirectOptions{})
+	replayer := NewReplayer(header.Session, entries, *speed, *loop, func(entry RecordEntry) {
+		metric := Metric{
+			Name:         entry.Name,
+			Value:        entry.Value,
+			Compensation: entry.Compensation,
+		}
+		if err := server.broadcastJSON(metric); err != nil {
+			log.Printf("Failed to broadcast %s: %v", entry.Name, err)
+		}
+	})
+	server.replay = replayer
+
+	status := replayer.Status()
+	log.Printf("Replaying session %s: %d entries, %.1f s at %gx\n", status.Session, status.Entries, status.Duration, status.Speed)
+
+	http.HandleFunc("/ws", server.handleWebSocket)
+	http.HandleFunc("/replay", server.handleReplay)
+
+	go server.publishReplay(time.Second)
+	if !*paused {
+		replayer.Play()
+	}
+	go replayer.Run()
+
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatal("ListenAndServe error:", err)
+	}
+}
+
+// loadSession reads all parts of the session of a recording file, or the
+// latest session in a folder
+func loadSession(path string) (SessionHeader, []RecordEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return SessionHeader{}, nil, fmt.Errorf("error opening session: %v", err)
+	}
+
+	folder, session := path, ""
+	if !info.IsDir() {
+		folder = filepath.Dir(path)
+		m := recordingNamePattern.FindStringSubmatch(filepath.Base(path))
+		if m == nil {
+			// A single file with another name
+			return readRecording(path)
+		}
+		session = m[1]
+	}
+
+	names, err := os.ReadDir(folder)
+	if err != nil {
+		return SessionHeader{}, nil, fmt.Errorf("error reading recording folder: %v", err)
+	}
+	parts := make(map[string][]string)
+	var sessions []string
+	for _, name := range names {
+		m := recordingNamePattern.FindStringSubmatch(name.Name())
+		if m == nil {
+			continue
+		}
+		if parts[m[1]] == nil {
+			sessions = append(sessions, m[1])
+		}
+		parts[m[1]] = append(parts[m[1]], filepath.Join(folder, name.Name()))
+	}
+	if len(sessions) == 0 {
+		return SessionHeader{}, nil, fmt.Errorf("no recordings found in %s", folder)
+	}
+	if session == "" {
+		sort.Strings(sessions)
+		session = sessions[len(sessions)-1]
+	}
+
+	// Parts are numbered with leading zeros, so they sort by name
+	files := parts[session]
+	sort.Strings(files)
+
+	var header SessionHeader
+	var entries []RecordEntry
+	for i, file := range files {
+		partHeader, partEntries, err := readRecording(file)
+		if err != nil {
+			return SessionHeader{}, nil, err
+		}
+		if i == 0 {
+			header = partHeader
+		}
+		entries = append(entries, partEntries...)
+	}
+	return header, entries, nil
+}
+
+// readRecording reads a JSON Lines or CSV recording
+func readRecording(path string) (SessionHeader, []RecordEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SessionHeader{}, nil, fmt.Errorf("error opening recording: %v", err)
+	}
+	defer file.Close()
+
+	var header SessionHeader
+	var entries []RecordEntry
+	csvFile := strings.EqualFold(filepath.Ext(path), ".csv")
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "":
+			continue
+		case csvFile && strings.HasPrefix(text, "#"):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(text, "#")), &header); err != nil {
+				return SessionHeader{}, nil, fmt.Errorf("invalid session header in %s: %v", path, err)
+			}
+		case csvFile:
+			if strings.HasPrefix(text, "time,") {
+				continue
+			}
+			entry, err := parseRecordCSV(text)
+			if err != nil {
+				return SessionHeader{}, nil, fmt.Errorf("invalid entry in %s line %d: %v", path, line, err)
+			}
+			entries = append(entries, entry)
+		case strings.HasPrefix(text, `{"header"`):
+			wrapper := struct {
+				Header SessionHeader `json:"header"`
+			}{}
+			if err := json.Unmarshal([]byte(text), &wrapper); err != nil {
+				return SessionHeader{}, nil, fmt.Errorf("invalid session header in %s: %v", path, err)
+			}
+			header = wrapper.Header
+		default:
+			entry := RecordEntry{}
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				return SessionHeader{}, nil, fmt.Errorf("invalid entry in %s line %d: %v", path, line, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return SessionHeader{}, nil, fmt.Errorf("error reading recording: %v", err)
+	}
+	if header.Session == "" {
+		header.Session = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return header, entries, nil
+}
+
+func parseRecordCSV(line string) (RecordEntry, error) {
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return RecordEntry{}, err
+	}
+	if len(fields) < 6 {
+		return RecordEntry{}, fmt.Errorf("expected 7 columns, found %d", len(fields))
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return RecordEntry{}, err
+	}
+	value, err := strconv.ParseFloat(fields[4], 64)
+	if err != nil {
+		return RecordEntry{}, err
+	}
+	entry := RecordEntry{
+		Time:    t,
+		Source:  fields[1],
+		Channel: fields[2],
+		Name:    fields[3],
+		Value:   value,
+		Unit:    fields[5],
+	}
+	if len(fields) > 6 {
+		entry.Compensation = fields[6]
+	}
+	return entry, nil
+}
+
+/*
+	Replayer
+	- Plays the entries on a schedule anchored at the last play, seek or
+	  speed change: an entry is due when the wall time since the anchor,
+	  times the speed, reaches its time in the session
+	- Commands wake the player, so a pause or seek takes effect immediately
+*/
+
+type Replayer struct {
+	session   string
+	entries   []RecordEntry
+	loop      bool
+	broadcast func(RecordEntry)
+
+	mu         sync.Mutex
+	position   int // next entry
+	speed      float64
+	paused     bool
+	anchorWall time.Time // wall time when the entry at anchorTime was due
+	anchorTime time.Time // session time at the anchor
+	wake       chan struct{}
+}
+
+func NewReplayer(session string, entries []RecordEntry, speed float64, loop bool, broadcast func(RecordEntry)) *Replayer {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return &Replayer{
+		session:   session,
+		entries:   entries,
+		loop:      loop,
+		broadcast: broadcast,
+		speed:     speed,
+		paused:    true,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Run plays the entries, it does not return
+func (r *Replayer) Run() {
+	for {
+		r.mu.Lock()
+		if r.position >= len(r.entries) {
+			if r.loop && len(r.entries) > 0 {
+				r.position = 0
+				r.setAnchor()
+			} else if !r.paused {
+				r.paused = true
+				log.Println("Replay finished")
+			}
+		}
+		if r.paused {
+			r.mu.Unlock()
+			<-r.wake
+			continue
+		}
+
+		entry := r.entries[r.position]
+		due := r.anchorWall.Add(time.Duration(float64(entry.Time.Sub(r.anchorTime)) / r.speed))
+		r.mu.Unlock()
+
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.wake:
+				// Paused, moved or changed speed, schedule again
+				timer.Stop()
+				continue
+			}
+		}
+
+		r.mu.Lock()
+		if r.paused || r.position >= len(r.entries) || !r.entries[r.position].Time.Equal(entry.Time) {
+			r.mu.Unlock()
+			continue
+		}
+		r.position++
+		r.mu.Unlock()
+
+		r.broadcast(entry)
+	}
+}
+
+func (r *Replayer) Play() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.position >= len(r.entries) {
+		r.position = 0
+	}
+	r.paused = false
+	r.setAnchor()
+	r.notify()
+}
+
+func (r *Replayer) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = true
+	r.notify()
+}
+
+// Seek moves to an offset from the start of the session
+func (r *Replayer) Seek(offset time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	target := r.entries[0].Time.Add(offset)
+	r.position = sort.Search(len(r.entries), func(i int) bool { return !r.entries[i].Time.Before(target) })
+	r.setAnchor()
+	r.notify()
+}
+
+func (r *Replayer) SetSpeed(speed float64) error {
+	if speed <= 0 || speed > 1000 {
+		return fmt.Errorf("speed %v is out of range", speed)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.speed = speed
+	r.setAnchor()
+	r.notify()
+	return nil
+}
+
+func (r *Replayer) Status() ReplayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ReplayStatus{
+		Session:  r.session,
+		Position: r.offset().Seconds(),
+		Duration: r.duration().Seconds(),
+		Speed:    r.speed,
+		Paused:   r.paused,
+		Entries:  len(r.entries),
+	}
+}
+
+// command handles a WebSocket command
+func (r *Replayer) command(command Command) error {
+	switch command.Command {
+	case "play", "resume":
+		r.Play()
+	case "pause":
+		r.Pause()
+	case "seek":
+		value := strings.TrimSpace(command.Value)
+		relative := strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+		offset, err := parseReplayOffset(value)
+		if err != nil {
+			return err
+		}
+		if relative {
+			r.mu.Lock()
+			offset += r.offset()
+			r.mu.Unlock()
+		}
+		if offset < 0 {
+			offset = 0
+		}
+		r.Seek(offset)
+	case "speed":
+		speed, err := strconv.ParseFloat(strings.TrimSuffix(command.Value, "x"), 64)
+		if err != nil {
+			return fmt.Errorf("invalid speed '%s'", command.Value)
+		}
+		return r.SetSpeed(speed)
+	default:
+		return fmt.Errorf("command '%s' is not available in replay", command.Command)
+	}
+	return nil
+}
+
+// parseReplayOffset parses a duration ("1m30s") or seconds ("90")
+func parseReplayOffset(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	offset, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid seek position '%s'", value)
+	}
+	return offset, nil
+}
+
+// setAnchor restarts the schedule at the current position, the caller holds mu
+func (r *Replayer) setAnchor() {
+	r.anchorWall = time.Now()
+	if r.position < len(r.entries) {
+		r.anchorTime = r.entries[r.position].Time
+	}
+}
+
+// offset returns the session time of the current position, the caller holds mu
+func (r *Replayer) offset() time.Duration {
+	if len(r.entries) == 0 {
+		return 0
+	}
+	if r.position >= len(r.entries) {
+		return r.duration()
+	}
+	current := r.entries[r.position].Time
+	if !r.paused {
+		// Between entries, follow the wall clock
+		played := r.anchorTime.Add(time.Duration(float64(time.Since(r.anchorWall)) * r.speed))
+		if played.Before(current) {
+			current = played
+		}
+	}
+	return current.Sub(r.entries[0].Time)
+}
+
+func (r *Replayer) duration() time.Duration {
+	if len(r.entries) == 0 {
+		return 0
+	}
+	return r.entries[len(r.entries)-1].Time.Sub(r.entries[0].Time)
+}
+
+func (r *Replayer) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+	Server wiring
+*/
+
+// publishReplay broadcasts the replay position
+func (s *Server) publishReplay(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		status := s.replay.Status()
+		if err := s.broadcastJSON(Metric{Name: "Replay_Position", Value: status.Position}); err != nil {
+			log.Printf("Failed to broadcast the replay position: %v", err)
+		}
+	}
+}
+
+// Handle GET requests for the replay status
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.replay.Status()); err != nil {
+		log.Printf("Failed to write replay status: %v", err)
+	}
+}
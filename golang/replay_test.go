@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordSession writes the entries with a Recorder rotating by size and
+// returns its parts
+func recordSession(t *testing.T, folder string, entries []RecordEntry) []string {
+	t.Helper()
+	recorder, err := NewRecorder(folder, "jsonl", 0, 1500, SessionHeader{SPLOffset: 94})
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	for _, entry := range entries {
+		recorder.Record(entry)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	parts, _ := filepath.Glob(filepath.Join(folder, "levels-*.jsonl"))
+	if len(parts) < 2 {
+		t.Fatalf("%d parts, want more than one", len(parts))
+	}
+	return parts
+}
+
+func TestLoadSession(t *testing.T) {
+	folder := t.TempDir()
+	entries := testEntries(60)
+	parts := recordSession(t, folder, entries)
+
+	// An older session in the same folder, and a file of another name
+	older := filepath.Join(folder, "levels-20200101-000000-001.jsonl")
+	if err := os.WriteFile(older, []byte("{\"header\":{\"session\":\"20200101-000000\",\"part\":1}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(folder, "evening.jsonl")
+	if err := os.WriteFile(single, []byte("{\"time\":\"2026-03-01T20:00:00Z\",\"name\":\"REW_Left_dBFS\",\"value\":-30}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, path := range map[string]string{"folder": folder, "last part": parts[len(parts)-1], "first part": parts[0]} {
+		header, loaded, err := loadSession(path)
+		if err != nil {
+			t.Fatalf("%s: loadSession: %v", name, err)
+		}
+		if header.Part != 1 || header.SPLOffset != 94 || header.Session == "20200101-000000" {
+			t.Fatalf("%s: header %+v, want the first part of the latest session", name, header)
+		}
+		if len(loaded) != len(entries) {
+			t.Fatalf("%s: %d entries, want %d from %d parts", name, len(loaded), len(entries), len(parts))
+		}
+		for i := range entries {
+			if !loaded[i].Time.Equal(entries[i].Time) || loaded[i].Value != entries[i].Value {
+				t.Fatalf("%s: entry %d %+v, want %+v", name, i, loaded[i], entries[i])
+			}
+		}
+	}
+
+	header, loaded, err := loadSession(older)
+	if err != nil || header.Session != "20200101-000000" || len(loaded) != 0 {
+		t.Fatalf("older session: %+v %d entries %v", header, len(loaded), err)
+	}
+	header, loaded, err = loadSession(single)
+	if err != nil || header.Session != "evening" || len(loaded) != 1 || loaded[0].Value != -30 {
+		t.Fatalf("single file: %+v %v %v", header, loaded, err)
+	}
+	if _, _, err := loadSession(t.TempDir()); err == nil {
+		t.Fatalf("loadSession of an empty folder succeeded")
+	}
+}
+
+func TestReplayerSeek(t *testing.T) {
+	// 100 entries 100 ms apart, 9.9 s
+	r := NewReplayer("test", testEntries(100), 1, false, func(RecordEntry) {})
+	tests := []struct {
+		value    string
+		position float64
+	}{
+		{"5s", 5},
+		{"+2s", 7},
+		{"-1.5s", 5.5},
+		{"-10s", 0},
+		{"90", 9.9},
+		{"1m", 9.9},
+		{"2.25", 2.3}, // the next entry
+	}
+	for _, test := range tests {
+		if err := r.command(Command{Command: "seek", Value: test.value}); err != nil {
+			t.Fatalf("seek %s: %v", test.value, err)
+		}
+		if status := r.Status(); !near(status.Position, test.position, 1e-9) || !status.Paused {
+			t.Fatalf("seek %s: position %v paused %v, want %v", test.value, status.Position, status.Paused, test.position)
+		}
+	}
+	for _, command := range []Command{{"seek", "soon"}, {"speed", "fast"}, {"speed", "0"}, {"speed", "2000"}, {"record", ""}} {
+		if err := r.command(command); err == nil {
+			t.Errorf("%s %s accepted", command.Command, command.Value)
+		}
+	}
+	if err := r.command(Command{Command: "speed", Value: "4x"}); err != nil || r.Status().Speed != 4 {
+		t.Fatalf("speed 4x: %v %v", err, r.Status().Speed)
+	}
+}
+
+func TestReplayerPlayback(t *testing.T) {
+	// 100 entries 20 ms apart, about 2 s at normal speed
+	entries := testEntries(100)
+	for i := range entries {
+		entries[i].Time = entries[0].Time.Add(time.Duration(i) * 20 * time.Millisecond)
+	}
+	played := make(chan RecordEntry, len(entries))
+	r := NewReplayer("test", entries, 1, false, func(entry RecordEntry) { played <- entry })
+	go r.Run()
+
+	receive := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			select {
+			case entry := <-played:
+				if !entry.Time.Equal(entries[i].Time) {
+					t.Fatalf("played %v, want entry %d at %v", entry.Time, i, entries[i].Time)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("entry %d was not played", i)
+			}
+		}
+	}
+
+	start := time.Now()
+	r.Play()
+	receive(0, 5)
+	if err := r.SetSpeed(20); err != nil {
+		t.Fatal(err)
+	}
+	receive(5, 100)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("played in %v, the speed change did not take effect", elapsed)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if status := r.Status(); !status.Paused || !near(status.Position, 1.98, 1e-9) {
+		t.Fatalf("status %+v at the end", status)
+	}
+
+	// Seek back while paused, then play the second half
+	r.Seek(time.Second)
+	r.Play()
+	receive(50, 100)
+	select {
+	case entry := <-played:
+		t.Fatalf("played %v after the end", entry.Time)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,58 @@
+package rew
+
+import (
+	"context"
+	"net/http"
+)
+
+/*
+	Audio devices and application control
+	- POST /audio/java/input-device selects the input of the Java audio driver
+	- GET /audio/java/input-devices lists the inputs
+	- GET /application/commands lists the application commands
+	- POST /application/command runs one, e.g. "Shutdown"
+*/
+
+type AudioSelectInputDeviceRequest struct {
+	Device string `json:"device"`
+}
+
+type ApplicationCommandRequest struct {
+	Command    string   `json:"command"`
+	Parameters []string `json:"parameters"`
+}
+
+// SelectInputDevice selects the input of the Java audio driver
+func (c *Client) SelectInputDevice(ctx context.Context, device string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, "/audio/java/input-device", AudioSelectInputDeviceRequest{Device: device}, &message)
+	return message, err
+}
+
+// InputDevices lists the inputs of the Java audio driver
+func (c *Client) InputDevices(ctx context.Context) ([]string, error) {
+	var devices []string
+	err := c.do(ctx, http.MethodGet, "/audio/java/input-devices", nil, &devices)
+	return devices, err
+}
+
+// ApplicationCommands lists the commands ApplicationCommand accepts
+func (c *Client) ApplicationCommands(ctx context.Context) ([]string, error) {
+	var commands []string
+	err := c.do(ctx, http.MethodGet, "/application/commands", nil, &commands)
+	return commands, err
+}
+
+// ApplicationCommand runs an application command
+func (c *Client) ApplicationCommand(ctx context.Context, command string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, "/application/command",
+		ApplicationCommandRequest{Command: command, Parameters: []string{}}, &message)
+	return message, err
+}
+
+// Shutdown asks REW to exit
+func (c *Client) Shutdown(ctx context.Context) error {
+	_, err := c.ApplicationCommand(ctx, "Shutdown")
+	return err
+}
@@ -0,0 +1,136 @@
+// Package rew is a client for the REW (Room EQ Wizard) REST API
+package rew
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+	REW API client
+	- REW serves the API on http://localhost:4735 when started with -api
+	- One configured Client: base URL, HTTP client and timeout
+	- Every call takes a context
+	- Failed calls return an *Error with the status code and the response body
+	- Typed requests and responses for input-levels, spl-meter, audio device
+	  selection and application control
+*/
+
+// DefaultURL is where REW serves the API by default
+const DefaultURL = "http://localhost:4735"
+
+// DefaultTimeout limits each request unless the client is configured otherwise
+const DefaultTimeout = 10 * time.Second
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+type Option func(*Client)
+
+// WithHTTPClient uses the given HTTP client, e.g. with its own transport
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout limits each request, 0 waits for the context only
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		client := *c.httpClient
+		client.Timeout = timeout
+		c.httpClient = &client
+	}
+}
+
+func NewClient(baseURL string, options ...Option) *Client {
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// BaseURL returns the URL of the REW API
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// Error is a response from REW with a status other than 2xx
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("REW %s %s failed with status %d: %s", e.Method, e.Path, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Message is the response REW sends to most commands
+type Message struct {
+	Message string `json:"message"`
+}
+
+// do sends request as JSON and decodes the response into response, either
+// may be nil
+func (c *Client) do(ctx context.Context, method, path string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		reqBody, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("failed to marshal REW %s request: %v", path, err)
+		}
+		body = bytes.NewReader(reqBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create REW %s request: %v", path, err)
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("REW %s %s request failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read REW %s response: %v", path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &Error{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	if response != nil && len(bytes.TrimSpace(respBody)) > 0 {
+		if err := json.Unmarshal(respBody, response); err != nil {
+			return fmt.Errorf("failed to parse REW %s response: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Ping checks that the API answers
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/", nil, nil)
+}
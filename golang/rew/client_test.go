@@ -0,0 +1,140 @@
+package rew_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"spl/rew"
+	"spl/rew/rewtest"
+)
+
+func TestClientError(t *testing.T) {
+	s := rewtest.NewServer()
+	defer s.Close()
+	client := s.Client()
+	ctx := context.Background()
+
+	s.SetFaults(rewtest.Faults{ErrorRate: 1, ErrorStatus: http.StatusServiceUnavailable, ErrorPaths: []string{"/spl-meter/1/command"}})
+	_, err := client.SPLMeterCommand(ctx, 1, "start")
+	var apiErr *rew.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("SPLMeterCommand: %v, want an *Error", err)
+	}
+	if apiErr.Method != http.MethodPost || apiErr.Path != "/spl-meter/1/command" ||
+		apiErr.StatusCode != http.StatusServiceUnavailable || !strings.Contains(apiErr.Body, "injected fault 503") {
+		t.Fatalf("error %+v", apiErr)
+	}
+	if !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("error text %q", err.Error())
+	}
+
+	// Other paths still work, and REW's own errors carry its message
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	_, err = client.SPLMeterCommand(ctx, 9, "start")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || !strings.Contains(apiErr.Body, "No SPL meter 9") {
+		t.Fatalf("SPLMeterCommand on meter 9: %v", err)
+	}
+	message, err := client.SPLMeterCommand(ctx, 2, "start")
+	if err != nil || message.Message != "SPL meter 2 start" {
+		t.Fatalf("SPLMeterCommand: %+v %v", message, err)
+	}
+}
+
+func TestClientEmptyBody(t *testing.T) {
+	status := http.StatusOK
+	body := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	client := rew.NewClient(server.URL + "/")
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusNoContent, ""},
+		{http.StatusAccepted, " \n"},
+	} {
+		status, body = test.status, test.body
+		message, err := client.SelectInputDevice(ctx, "UMIK-1")
+		if err != nil || message.Message != "" {
+			t.Fatalf("status %d body %q: %+v %v", test.status, test.body, message, err)
+		}
+		devices, err := client.InputDevices(ctx)
+		if err != nil || devices != nil {
+			t.Fatalf("status %d body %q: devices %v %v", test.status, test.body, devices, err)
+		}
+	}
+
+	status, body = http.StatusInternalServerError, ""
+	var apiErr *rew.Error
+	if err := client.Ping(ctx); !errors.As(err, &apiErr) || apiErr.Body != "" || apiErr.Path != "/" {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	status, body = http.StatusOK, "not json"
+	if _, err := client.InputDevices(ctx); err == nil || errors.As(err, &apiErr) {
+		t.Fatalf("InputDevices with an invalid body: %v", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	s := rewtest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+	s.SetFaults(rewtest.Faults{Latency: 300 * time.Millisecond})
+
+	start := time.Now()
+	err := s.Client(rew.WithTimeout(50 * time.Millisecond)).Ping(ctx)
+	var apiErr *rew.Error
+	if err == nil || errors.As(err, &apiErr) {
+		t.Fatalf("Ping with a timeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("timed out after %v", elapsed)
+	}
+
+	// 0 waits for the context only, and the HTTP client passed in keeps its
+	// own timeout
+	httpClient := &http.Client{Timeout: 50 * time.Millisecond}
+	if err := s.Client(rew.WithHTTPClient(httpClient), rew.WithTimeout(0)).Ping(ctx); err != nil {
+		t.Fatalf("Ping without a timeout: %v", err)
+	}
+	if httpClient.Timeout != 50*time.Millisecond {
+		t.Fatalf("WithTimeout changed the HTTP client to %v", httpClient.Timeout)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	s := rewtest.NewServer()
+	defer s.Close()
+	s.SetFaults(rewtest.Faults{Latency: 2 * time.Second})
+	client := s.Client()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := client.InputDevices(ctx); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("InputDevices after cancel: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Ping(ctx); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("Ping past the deadline: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the requests took %v, the context did not stop them", elapsed)
+	}
+}
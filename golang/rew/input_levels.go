@@ -0,0 +1,63 @@
+package rew
+
+import (
+	"context"
+	"net/http"
+)
+
+/*
+	Input levels
+	- POST /input-levels/command with "start" or "stop"
+	- POST /input-levels/subscribe and /input-levels/unsubscribe with a
+	  webhook URL, REW posts an InputLevelsSample to it for every update
+*/
+
+type InputLevelsCommandRequest struct {
+	Command    string   `json:"command"`
+	Parameters []string `json:"parameters"`
+}
+
+type InputLevelsSubscribeParameters struct {
+	Unit string `json:"unit"` // e.g. "dBFS"
+}
+
+type InputLevelsSubscribeRequest struct {
+	Url        string                         `json:"url"`
+	Parameters InputLevelsSubscribeParameters `json:"parameters"`
+}
+
+// InputLevelsSample is the webhook payload of the input levels
+type InputLevelsSample struct {
+	Unit            string    `json:"unit"`
+	RMS             []float64 `json:"rms"`
+	Peak            []float64 `json:"peak"`
+	TimeSpanSeconds float64   `json:"timeSpanSeconds"`
+}
+
+// InputLevelsCommand sends a command, e.g. "start" or "stop"
+func (c *Client) InputLevelsCommand(ctx context.Context, command string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, "/input-levels/command",
+		InputLevelsCommandRequest{Command: command, Parameters: []string{}}, &message)
+	return message, err
+}
+
+// InputLevelsSubscribe registers url for the input levels in unit
+func (c *Client) InputLevelsSubscribe(ctx context.Context, url, unit string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, "/input-levels/subscribe", InputLevelsSubscribeRequest{
+		Url:        url,
+		Parameters: InputLevelsSubscribeParameters{Unit: unit},
+	}, &message)
+	return message, err
+}
+
+// InputLevelsUnsubscribe removes url
+func (c *Client) InputLevelsUnsubscribe(ctx context.Context, url, unit string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, "/input-levels/unsubscribe", InputLevelsSubscribeRequest{
+		Url:        url,
+		Parameters: InputLevelsSubscribeParameters{Unit: unit},
+	}, &message)
+	return message, err
+}
@@ -0,0 +1,323 @@
+package rew
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	REW process management
+	- Launch attaches to a REW that already answers on the API URL, or starts
+	  one and waits until the API is up
+	- The install is an app bundle (macOS), the install4j launcher, a jar
+	  (run with java -jar) or the install folder; it is discovered in
+	  $REW_HOME and the usual places when not given
+	- JVM options go before -jar, or as -J<option> to the install4j launcher
+	- REW's stdout and stderr can go to a log file
+	- Stop asks REW to shut down through the API and signals the process
+	  (SIGTERM, then SIGKILL) when it does not exit in time. An attached REW
+	  is left running
+*/
+
+// DefaultStartTimeout is how long Launch waits for the API of a started REW
+const DefaultStartTimeout = 2 * time.Minute
+
+// DefaultSettle is the time REW needs after the API answers before it
+// handles the audio and meter commands reliably
+const DefaultSettle = 3 * time.Second
+
+type LaunchOptions struct {
+	Path         string        // REW install, discovered when empty
+	Java         string        // java for a jar, default $JAVA_HOME/bin/java or java on the PATH
+	JVMOptions   []string      // e.g. -Xmx2g
+	GUI          bool          // start with the GUI instead of -nogui
+	LogFile      string        // REW stdout and stderr, stdout is discarded when empty
+	AttachOnly   bool          // fail when no REW answers instead of starting one
+	StartTimeout time.Duration // default is DefaultStartTimeout
+	Settle       time.Duration // default is DefaultSettle, negative skips it
+}
+
+type Process struct {
+	client  *Client
+	cmd     *exec.Cmd // nil when attached
+	logFile *os.File
+	exited  chan struct{}
+	exitErr error
+
+	mu       sync.Mutex
+	stopping bool
+}
+
+// Launch attaches to the REW on the client's URL or starts one
+func Launch(ctx context.Context, client *Client, options LaunchOptions) (*Process, error) {
+	if client.Ping(ctx) == nil {
+		return &Process{client: client}, nil
+	}
+	if options.AttachOnly {
+		return nil, fmt.Errorf("no REW API on %s to attach to", client.BaseURL())
+	}
+
+	path, args, err := launchCommand(options)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Process{client: client, exited: make(chan struct{})}
+	p.cmd = exec.Command(path, args...)
+	p.cmd.SysProcAttr = sysProcAttr() // keep Ctrl-C of the terminal away from REW
+	p.cmd.Stderr = os.Stderr
+	if options.LogFile != "" {
+		p.logFile, err = os.OpenFile(options.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening REW log file: %v", err)
+		}
+		fmt.Fprintf(p.logFile, "--- %s %s %s\n", time.Now().Format(time.RFC3339), path, strings.Join(args, " "))
+		p.cmd.Stdout = p.logFile
+		p.cmd.Stderr = p.logFile
+	}
+
+	if err := p.cmd.Start(); err != nil {
+		p.closeLog()
+		return nil, fmt.Errorf("error starting REW %s: %v", path, err)
+	}
+	go func() {
+		p.exitErr = p.cmd.Wait()
+		p.closeLog()
+		close(p.exited)
+	}()
+
+	if err := p.waitReady(ctx, options); err != nil {
+		p.kill()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Attached is true when Launch found a running REW
+func (p *Process) Attached() bool {
+	return p.cmd == nil
+}
+
+// Pid returns the process id of a started REW, 0 when attached
+func (p *Process) Pid() int {
+	if p.cmd == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+// Exited is closed when a started REW exits, nil when attached
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Err returns the exit error of a started REW after Exited, nil when Stop
+// ended it
+func (p *Process) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return nil
+	}
+	return p.exitErr
+}
+
+// Stop shuts a started REW down through the API, signals it when it has not
+// exited after timeout and waits for it
+func (p *Process) Stop(timeout time.Duration) error {
+	if p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.client.Shutdown(ctx); err == nil {
+		select {
+		case <-p.exited:
+			return nil
+		case <-ctx.Done():
+		}
+	}
+
+	if err := terminate(p.cmd.Process); err == nil {
+		select {
+		case <-p.exited:
+			return nil
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	p.kill()
+	<-p.exited
+	return nil
+}
+
+func (p *Process) waitReady(ctx context.Context, options LaunchOptions) error {
+	timeout := options.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultStartTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for p.client.Ping(ctx) != nil {
+		select {
+		case <-p.exited:
+			return fmt.Errorf("REW exited before the API was up: %v", p.exitErr)
+		case <-deadline.C:
+			return fmt.Errorf("REW API not up on %s after %v", p.client.BaseURL(), timeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+
+	settle := options.Settle
+	if settle == 0 {
+		settle = DefaultSettle
+	}
+	if settle > 0 {
+		time.Sleep(settle)
+	}
+	return nil
+}
+
+func (p *Process) kill() {
+	kill(p.cmd.Process)
+}
+
+func (p *Process) closeLog() {
+	if p.logFile != nil {
+		p.logFile.Close()
+	}
+}
+
+/*
+	Install discovery
+*/
+
+// launchCommand returns the program and arguments that start REW with the API
+func launchCommand(options LaunchOptions) (string, []string, error) {
+	path := options.Path
+	if path == "" {
+		var err error
+		path, err = discoverREW()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	path, err := resolveREW(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rewArgs := []string{"-api"}
+	if !options.GUI {
+		rewArgs = append(rewArgs, "-nogui")
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".jar") {
+		java, err := javaPath(options.Java)
+		if err != nil {
+			return "", nil, err
+		}
+		args := append([]string{}, options.JVMOptions...)
+		args = append(args, "-jar", path)
+		return java, append(args, rewArgs...), nil
+	}
+
+	// install4j launchers take the JVM options as -J<option>
+	var args []string
+	for _, option := range options.JVMOptions {
+		args = append(args, "-J"+option)
+	}
+	return path, append(args, rewArgs...), nil
+}
+
+// installCandidates are the usual REW installs, in order of preference
+func installCandidates() []string {
+	home, _ := os.UserHomeDir()
+	var candidates []string
+	if dir := os.Getenv("REW_HOME"); dir != "" {
+		candidates = append(candidates, dir)
+	}
+	if runtime.GOOS == "darwin" {
+		candidates = append(candidates, "/Applications/REW/REW.app", "/Applications/REW.app")
+		if home != "" {
+			candidates = append(candidates, filepath.Join(home, "Applications", "REW", "REW.app"))
+		}
+		return candidates
+	}
+	if home != "" {
+		candidates = append(candidates, filepath.Join(home, "REW"))
+	}
+	return append(candidates, "/opt/REW", "/usr/local/REW")
+}
+
+func discoverREW() (string, error) {
+	candidates := installCandidates()
+	for _, candidate := range candidates {
+		if path, err := resolveREW(candidate); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("REW not found in %s, set the install path or $REW_HOME", strings.Join(candidates, ", "))
+}
+
+// resolveREW turns an app bundle or install folder into the launcher or jar
+func resolveREW(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("REW install %s: %v", path, err)
+	}
+	if !info.IsDir() {
+		return path, nil
+	}
+
+	candidates := []string{
+		filepath.Join(path, "Contents", "MacOS", "JavaApplicationStub"), // app bundle
+		filepath.Join(path, "REW.app", "Contents", "MacOS", "JavaApplicationStub"),
+		filepath.Join(path, "roomeqwizard"), // Linux install4j launcher
+		filepath.Join(path, "roomeqwizard.jar"),
+		filepath.Join(path, "REW.jar"),
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	jars, _ := filepath.Glob(filepath.Join(path, "*.jar"))
+	if len(jars) == 1 {
+		return jars[0], nil
+	}
+	return "", fmt.Errorf("no REW launcher or jar in %s", path)
+}
+
+func javaPath(java string) (string, error) {
+	if java != "" {
+		return java, nil
+	}
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		return filepath.Join(home, "bin", "java"), nil
+	}
+	path, err := exec.LookPath("java")
+	if err != nil {
+		return "", fmt.Errorf("java not found to run the REW jar, set the java path or $JAVA_HOME")
+	}
+	return path, nil
+}
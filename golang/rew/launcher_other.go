@@ -0,0 +1,20 @@
+//go:build !unix
+
+package rew
+
+import (
+	"os"
+	"syscall"
+)
+
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func terminate(process *os.Process) error {
+	return process.Kill()
+}
+
+func kill(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,145 @@
+package rew
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// touch creates an empty file and its folders below dir
+func touch(t *testing.T, dir string, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveREW(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		path  string // below the temp dir
+		want  string // below the temp dir, "" when resolving fails
+	}{
+		{"app bundle", []string{"REW.app/Contents/MacOS/JavaApplicationStub"}, "REW.app", "REW.app/Contents/MacOS/JavaApplicationStub"},
+		{"folder with an app bundle", []string{"REW.app/Contents/MacOS/JavaApplicationStub"}, "", "REW.app/Contents/MacOS/JavaApplicationStub"},
+		{"install4j launcher", []string{"roomeqwizard", "roomeqwizard.jar"}, "", "roomeqwizard"},
+		{"known jar", []string{"roomeqwizard.jar", "lib.jar"}, "", "roomeqwizard.jar"},
+		{"single jar", []string{"REW_linux_5_31.jar"}, "", "REW_linux_5_31.jar"},
+		{"jar file", []string{"rew.jar"}, "rew.jar", "rew.jar"},
+		{"several unknown jars", []string{"a.jar", "b.jar"}, "", ""},
+		{"empty folder", nil, "", ""},
+		{"missing", nil, "REW", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range test.files {
+				touch(t, dir, file)
+			}
+			path, err := resolveREW(filepath.Join(dir, test.path))
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("resolveREW = %s, want an error", path)
+				}
+				return
+			}
+			if err != nil || path != filepath.Join(dir, test.want) {
+				t.Fatalf("resolveREW = %s, %v, want %s", path, err, test.want)
+			}
+		})
+	}
+}
+
+func TestLaunchCommand(t *testing.T) {
+	dir := t.TempDir()
+	jar := touch(t, dir, "jar/roomeqwizard.jar")
+	launcher := touch(t, dir, "install/roomeqwizard")
+	javaHome := filepath.Join(dir, "jdk")
+	t.Setenv("JAVA_HOME", javaHome)
+	t.Setenv("REW_HOME", filepath.Dir(launcher))
+
+	tests := []struct {
+		name    string
+		options LaunchOptions
+		program string
+		args    []string
+	}{
+		{
+			name:    "jar",
+			options: LaunchOptions{Path: jar, Java: "/usr/bin/java", JVMOptions: []string{"-Xmx2g", "-Dsun.java2d.uiScale=2"}},
+			program: "/usr/bin/java",
+			args:    []string{"-Xmx2g", "-Dsun.java2d.uiScale=2", "-jar", jar, "-api", "-nogui"},
+		},
+		{
+			name:    "jar with java from JAVA_HOME",
+			options: LaunchOptions{Path: filepath.Dir(jar), GUI: true},
+			program: filepath.Join(javaHome, "bin", "java"),
+			args:    []string{"-jar", jar, "-api"},
+		},
+		{
+			name:    "install4j launcher",
+			options: LaunchOptions{Path: filepath.Dir(launcher), JVMOptions: []string{"-Xmx2g"}},
+			program: launcher,
+			args:    []string{"-J-Xmx2g", "-api", "-nogui"},
+		},
+		{
+			name:    "discovered in REW_HOME",
+			options: LaunchOptions{GUI: true},
+			program: launcher,
+			args:    []string{"-api"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, args, err := launchCommand(test.options)
+			if err != nil {
+				t.Fatalf("launchCommand: %v", err)
+			}
+			if program != test.program || strings.Join(args, " ") != strings.Join(test.args, " ") {
+				t.Fatalf("launchCommand = %s %v, want %s %v", program, args, test.program, test.args)
+			}
+		})
+	}
+
+	if _, _, err := launchCommand(LaunchOptions{Path: filepath.Join(dir, "missing")}); err == nil {
+		t.Fatalf("launchCommand succeeded for a missing install")
+	}
+}
+
+func TestInstallCandidates(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("REW_HOME", "/srv/rew")
+
+	candidates := installCandidates()
+	want := []string{"/srv/rew", filepath.Join(home, "REW"), "/opt/REW", "/usr/local/REW"}
+	if runtime.GOOS == "darwin" {
+		want = []string{"/srv/rew", "/Applications/REW/REW.app", "/Applications/REW.app", filepath.Join(home, "Applications", "REW", "REW.app")}
+	}
+	if strings.Join(candidates, " ") != strings.Join(want, " ") {
+		t.Fatalf("installCandidates = %v, want %v", candidates, want)
+	}
+
+	// Without REW_HOME the discovery fails when none of them is installed
+	t.Setenv("REW_HOME", "")
+	if runtime.GOOS != "darwin" {
+		if _, err := os.Stat("/opt/REW"); err == nil {
+			t.Skip("REW is installed in /opt/REW")
+		}
+		if _, err := os.Stat("/usr/local/REW"); err == nil {
+			t.Skip("REW is installed in /usr/local/REW")
+		}
+		if _, err := discoverREW(); err == nil || !strings.Contains(err.Error(), "$REW_HOME") {
+			t.Fatalf("discoverREW: %v", err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package rew
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysProcAttr starts REW in its own process group
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminate sends SIGTERM to the process group, so the JVM a launcher
+// started exits as well
+func terminate(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGTERM)
+}
+
+func kill(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
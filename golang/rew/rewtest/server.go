@@ -0,0 +1,604 @@
+// Package rewtest is an in-process fake REW API for integration tests
+package rewtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"spl/rew"
+)
+
+/*
+	Fake REW
+	- httptest server with the REW API endpoints levels uses:
+	  /input-levels/command|subscribe|unsubscribe,
+	  /spl-meter/{n}/configuration|command|subscribe|unsubscribe,
+	  /audio/java/input-device(s) and GET / to check that the API is up
+	- While input levels or a meter are started, synthetic InputLevelsSample
+	  and SPLMeterSample payloads are POSTed to the subscribed webhooks every
+	  interval, with the levels set by SetLevel
+	- Fault injection: error status for a fraction of the API requests, slow
+	  API responses and dropped webhook callbacks
+	- Stats counts the requests, callbacks and faults, so a test can wait for
+	  and check them
+*/
+
+// DefaultInterval is the time between webhook callbacks, REW updates about
+// ten times per second
+const DefaultInterval = 100 * time.Millisecond
+
+// Meters is the number of SPL meters
+const Meters = 4
+
+type Faults struct {
+	ErrorRate   float64       // fraction of API requests answered with ErrorStatus
+	ErrorStatus int           // default is 500
+	ErrorPaths  []string      // only fail requests to these paths, all when empty
+	Latency     time.Duration // added to every API response
+	DropRate    float64       // fraction of webhook callbacks not sent
+}
+
+type Stats struct {
+	Requests  map[string]int // API requests per path
+	Errors    int            // injected error responses
+	Callbacks int            // webhook callbacks sent
+	Dropped   int            // injected dropped callbacks
+	Failed    int            // callbacks that did not reach the webhook
+}
+
+type meter struct {
+	configuration rew.SPLMeterConfiguration
+	running       bool
+	hooks         map[string]bool
+	start         time.Time
+	energy        []timedEnergy // for Leq1m, Leq10m and the rolling Leq
+	total         float64       // energy since the start, for Leq and Sel
+	samples       int
+}
+
+type timedEnergy struct {
+	t      time.Time
+	energy float64
+}
+
+type Server struct {
+	URL string // base URL of the API
+
+	server   *httptest.Server
+	hooks    *http.Client
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	posts    sync.WaitGroup
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	faults      Faults
+	stats       Stats
+	levels      [2]float64 // dBFS per channel
+	splOffset   float64    // dBSPL at 0 dBFS
+	devices     []string
+	device      string
+	inputLevels bool
+	levelHooks  map[string]string // url to unit
+	meters      [Meters]*meter
+}
+
+type Option func(*Server)
+
+// WithInterval sets the time between webhook callbacks
+func WithInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.interval = interval
+	}
+}
+
+// WithDevices sets the input devices, SelectInputDevice fails for others
+func WithDevices(devices ...string) Option {
+	return func(s *Server) {
+		s.devices = devices
+	}
+}
+
+// WithSeed makes the fault injection repeatable
+func WithSeed(seed int64) Option {
+	return func(s *Server) {
+		s.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// NewServer starts a fake REW, Close stops it
+func NewServer(options ...Option) *Server {
+	s := &Server{
+		hooks:      &http.Client{Timeout: 2 * time.Second},
+		interval:   DefaultInterval,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		rand:       rand.New(rand.NewSource(1)),
+		stats:      Stats{Requests: map[string]int{}},
+		levels:     [2]float64{-20, -20},
+		splOffset:  100,
+		levelHooks: map[string]string{},
+	}
+	for i := range s.meters {
+		s.meters[i] = &meter{
+			configuration: rew.SPLMeterConfiguration{Mode: "SPL", Weighting: "A", Filter: "Slow"},
+			hooks:         map[string]bool{},
+		}
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	go s.run()
+	return s
+}
+
+// Client returns a REW client for the server
+func (s *Server) Client(options ...rew.Option) *rew.Client {
+	return rew.NewClient(s.URL, options...)
+}
+
+// Close stops the callbacks, waits for the ones in flight and stops the server
+func (s *Server) Close() {
+	close(s.stop)
+	<-s.done
+	s.posts.Wait()
+	s.server.Close()
+}
+
+// SetLevel sets the dBFS level of a channel (0 left, 1 right), meter n
+// measures channel (n-1)%2
+func (s *Server) SetLevel(channel int, dBFS float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.levels[channel] = dBFS
+}
+
+// SetSPLOffset sets the dBSPL the meters read at 0 dBFS, default is 100
+func (s *Server) SetSPLOffset(offset float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.splOffset = offset
+}
+
+// SetFaults replaces the injected faults, Faults{} turns them off
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if faults.ErrorStatus == 0 {
+		faults.ErrorStatus = http.StatusInternalServerError
+	}
+	s.faults = faults
+}
+
+// Stats returns a copy of the counters
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Requests = map[string]int{}
+	for path, n := range s.stats.Requests {
+		stats.Requests[path] = n
+	}
+	return stats
+}
+
+// InputDevice returns the selected input device
+func (s *Server) InputDevice() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.device
+}
+
+// SPLMeterConfiguration returns the configuration of meter n
+func (s *Server) SPLMeterConfiguration(n int) rew.SPLMeterConfiguration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meters[n-1].configuration
+}
+
+// Subscribers returns the webhooks of the input levels and of every meter
+func (s *Server) Subscribers() (inputLevels []string, meters [Meters][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for url := range s.levelHooks {
+		inputLevels = append(inputLevels, url)
+	}
+	for i, m := range s.meters {
+		for url := range m.hooks {
+			meters[i] = append(meters[i], url)
+		}
+	}
+	return inputLevels, meters
+}
+
+/*
+	API
+*/
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	status, latency := s.fault(r.URL.Path)
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"injected fault %d"}`, status), status)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		reply(w, http.StatusOK, "REW API")
+	case len(parts) == 2 && parts[0] == "input-levels":
+		s.handleInputLevels(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "spl-meter":
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 || n > Meters {
+			reply(w, http.StatusNotFound, fmt.Sprintf("No SPL meter %s", parts[1]))
+			return
+		}
+		s.handleSPLMeter(w, r, n, parts[2])
+	case path == "audio/java/input-device" || path == "audio/java/input-devices":
+		s.handleAudio(w, r, parts[2])
+	default:
+		reply(w, http.StatusNotFound, "Unknown endpoint "+r.URL.Path)
+	}
+}
+
+// fault counts the request and decides on the injected error and latency
+func (s *Server) fault(path string) (status int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Requests[path]++
+	faults := s.faults
+	if faults.ErrorRate <= 0 || s.rand.Float64() >= faults.ErrorRate {
+		return 0, faults.Latency
+	}
+	if len(faults.ErrorPaths) > 0 {
+		matched := false
+		for _, p := range faults.ErrorPaths {
+			matched = matched || p == path
+		}
+		if !matched {
+			return 0, faults.Latency
+		}
+	}
+	s.stats.Errors++
+	return faults.ErrorStatus, faults.Latency
+}
+
+func (s *Server) handleInputLevels(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	switch endpoint {
+	case "command":
+		request := rew.InputLevelsCommandRequest{}
+		if !decode(w, r, &request) {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch request.Command {
+		case "start":
+			s.inputLevels = true
+		case "stop":
+			s.inputLevels = false
+		default:
+			reply(w, http.StatusBadRequest, "Unknown command "+request.Command)
+			return
+		}
+		reply(w, http.StatusOK, "Input levels "+request.Command)
+	case "subscribe", "unsubscribe":
+		request := rew.InputLevelsSubscribeRequest{}
+		if !decode(w, r, &request) {
+			return
+		}
+		if request.Url == "" {
+			reply(w, http.StatusBadRequest, "Missing url")
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if endpoint == "subscribe" {
+			s.levelHooks[request.Url] = request.Parameters.Unit
+		} else {
+			delete(s.levelHooks, request.Url)
+		}
+		reply(w, http.StatusOK, fmt.Sprintf("Input levels %sd %s", endpoint, request.Url))
+	default:
+		reply(w, http.StatusNotFound, "Unknown endpoint "+r.URL.Path)
+	}
+}
+
+func (s *Server) handleSPLMeter(w http.ResponseWriter, r *http.Request, n int, endpoint string) {
+	if endpoint == "configuration" && r.Method == http.MethodGet {
+		s.mu.Lock()
+		configuration := s.meters[n-1].configuration
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(configuration)
+		return
+	}
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	switch endpoint {
+	case "configuration":
+		configuration := rew.SPLMeterConfiguration{}
+		if !decode(w, r, &configuration) {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.meters[n-1].configuration = configuration
+		reply(w, http.StatusOK, fmt.Sprintf("SPL meter %d configured", n))
+	case "command":
+		request := rew.SPLMeterCommandRequest{}
+		if !decode(w, r, &request) {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		m := s.meters[n-1]
+		switch request.Command {
+		case "start":
+			if !m.running {
+				m.reset()
+			}
+			m.running = true
+		case "stop":
+			m.running = false
+		case "reset":
+			m.reset()
+		default:
+			reply(w, http.StatusBadRequest, "Unknown command "+request.Command)
+			return
+		}
+		reply(w, http.StatusOK, fmt.Sprintf("SPL meter %d %s", n, request.Command))
+	case "subscribe", "unsubscribe":
+		request := rew.SPLMeterSubscribeRequest{}
+		if !decode(w, r, &request) {
+			return
+		}
+		if request.Url == "" {
+			reply(w, http.StatusBadRequest, "Missing url")
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if endpoint == "subscribe" {
+			s.meters[n-1].hooks[request.Url] = true
+		} else {
+			delete(s.meters[n-1].hooks, request.Url)
+		}
+		reply(w, http.StatusOK, fmt.Sprintf("SPL meter %d %sd %s", n, endpoint, request.Url))
+	default:
+		reply(w, http.StatusNotFound, "Unknown endpoint "+r.URL.Path)
+	}
+}
+
+func (s *Server) handleAudio(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if endpoint == "input-devices" {
+		if r.Method != http.MethodGet {
+			reply(w, http.StatusMethodNotAllowed, "Invalid request method")
+			return
+		}
+		s.mu.Lock()
+		devices := append([]string{}, s.devices...)
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+		return
+	}
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	request := rew.AudioSelectInputDeviceRequest{}
+	if !decode(w, r, &request) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.devices) > 0 {
+		found := false
+		for _, device := range s.devices {
+			found = found || device == request.Device
+		}
+		if !found {
+			reply(w, http.StatusBadRequest, "Unknown input device "+request.Device)
+			return
+		}
+	}
+	s.device = request.Device
+	// REW accepts the device and switches asynchronously
+	reply(w, http.StatusAccepted, "Input device "+request.Device)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		reply(w, http.StatusBadRequest, "Failed to read request body")
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		reply(w, http.StatusBadRequest, "Invalid JSON format")
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rew.Message{Message: message})
+}
+
+/*
+	Webhook callbacks
+*/
+
+type callback struct {
+	url     string
+	payload interface{}
+}
+
+func (s *Server) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case t := <-ticker.C:
+			for _, c := range s.samples(t) {
+				s.posts.Add(1)
+				go s.post(c)
+			}
+		}
+	}
+}
+
+// samples builds the callbacks of one interval
+func (s *Server) samples(t time.Time) []callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var callbacks []callback
+	if s.inputLevels {
+		for url, unit := range s.levelHooks {
+			sample := rew.InputLevelsSample{
+				Unit:            unit,
+				RMS:             []float64{s.levels[0], s.levels[1]},
+				Peak:            []float64{s.levels[0] + 3.01, s.levels[1] + 3.01}, // sine crest factor
+				TimeSpanSeconds: s.interval.Seconds(),
+			}
+			callbacks = append(callbacks, callback{url, sample})
+		}
+	}
+
+	for i, m := range s.meters {
+		if !m.running {
+			continue
+		}
+		spl := s.levels[i%2] + s.splOffset
+		energy := math.Pow(10, spl/10)
+		m.energy = append(m.energy, timedEnergy{t, energy})
+		m.total += energy
+		m.samples++
+		for len(m.energy) > 0 && t.Sub(m.energy[0].t) > 10*time.Minute {
+			m.energy = m.energy[1:]
+		}
+		if len(m.hooks) == 0 {
+			continue
+		}
+
+		elapsed := t.Sub(m.start).Seconds()
+		leq := 10 * math.Log10(m.total/float64(m.samples))
+		sample := rew.SPLMeterSample{
+			MeterNumber:       i + 1,
+			Weighting:         m.configuration.Weighting,
+			Filter:            m.configuration.Filter,
+			SPL:               spl,
+			Leq:               leq,
+			IsRollingLeq:      m.configuration.RollingLeqActive,
+			RollingLeqMinutes: float64(m.configuration.RollingLeqMinutes),
+			Leq1m:             m.leq(t, time.Minute),
+			Leq10m:            m.leq(t, 10*time.Minute),
+			Sel:               10 * math.Log10(m.total*s.interval.Seconds()), // each sample stands for one interval
+			ElapsedTime:       elapsed,
+		}
+		if m.configuration.RollingLeqActive && m.configuration.RollingLeqMinutes > 0 {
+			sample.Leq = m.leq(t, time.Duration(m.configuration.RollingLeqMinutes)*time.Minute)
+		}
+		for url := range m.hooks {
+			callbacks = append(callbacks, callback{url, sample})
+		}
+	}
+
+	// Decide on the dropped callbacks here, so they follow the seed
+	kept := callbacks[:0]
+	for _, c := range callbacks {
+		if s.faults.DropRate > 0 && s.rand.Float64() < s.faults.DropRate {
+			s.stats.Dropped++
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// reset starts the Leq, Sel and elapsed time over
+func (m *meter) reset() {
+	m.start = time.Now()
+	m.energy = nil
+	m.total = 0
+	m.samples = 0
+}
+
+// leq is the level of the energy over the last window, the meter keeps up to
+// 10 minutes
+func (m *meter) leq(t time.Time, window time.Duration) float64 {
+	sum, n := 0.0, 0
+	for i := len(m.energy) - 1; i >= 0 && t.Sub(m.energy[i].t) < window; i-- {
+		sum += m.energy[i].energy
+		n++
+	}
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	return 10 * math.Log10(sum/float64(n))
+}
+
+func (s *Server) post(c callback) {
+	defer s.posts.Done()
+
+	body, err := json.Marshal(c.payload)
+	if err == nil {
+		var resp *http.Response
+		resp, err = s.hooks.Post(c.url, "application/json", strings.NewReader(string(body)))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.stats.Failed++
+		return
+	}
+	s.stats.Callbacks++
+}
@@ -0,0 +1,93 @@
+package rew
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+/*
+	SPL meters
+	- REW has numbered meters starting at 1
+	- POST /spl-meter/{n}/configuration with the mode, weighting and filter
+	- POST /spl-meter/{n}/command with e.g. "start", "stop" or "reset"
+	- POST /spl-meter/{n}/subscribe and /spl-meter/{n}/unsubscribe with a
+	  webhook URL, REW posts an SPLMeterSample to it for every update
+*/
+
+type SPLMeterConfiguration struct {
+	Mode              string `json:"mode"`      // e.g. "SPL"
+	Weighting         string `json:"weighting"` // "A", "C" or "Z"
+	Filter            string `json:"filter"`    // "Fast", "Slow" or "Impulse"
+	HighPassActive    bool   `json:"highPassActive"`
+	RollingLeqActive  bool   `json:"rollingLeqActive"`
+	RollingLeqMinutes int    `json:"rollingLeqMinutes"`
+}
+
+type SPLMeterCommandRequest struct {
+	Command    string   `json:"command"`
+	Parameters []string `json:"parameters"`
+}
+
+type SPLMeterSubscribeParameters struct {
+}
+
+type SPLMeterSubscribeRequest struct {
+	Url        string                      `json:"url"`
+	Parameters SPLMeterSubscribeParameters `json:"parameters"`
+}
+
+// SPLMeterSample is the webhook payload of an SPL meter
+type SPLMeterSample struct {
+	MeterNumber       int     `json:"meterNumber"`
+	Weighting         string  `json:"weighting"`
+	Filter            string  `json:"filter"`
+	SPL               float64 `json:"spl"`
+	Leq               float64 `json:"leq"`
+	IsRollingLeq      bool    `json:"isRollingLeq"`
+	RollingLeqMinutes float64 `json:"rollingLeqMinutes"`
+	Leq1m             float64 `json:"leq1m"`
+	Leq10m            float64 `json:"leq10m"`
+	Sel               float64 `json:"sel"`
+	ElapsedTime       float64 `json:"elapsedTime"`
+}
+
+func splMeterPath(meter int, endpoint string) string {
+	return fmt.Sprintf("/spl-meter/%d/%s", meter, endpoint)
+}
+
+// SPLMeterConfigure sets the configuration of a meter
+func (c *Client) SPLMeterConfigure(ctx context.Context, meter int, configuration SPLMeterConfiguration) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, splMeterPath(meter, "configuration"), configuration, &message)
+	return message, err
+}
+
+// SPLMeterConfiguration returns the configuration of a meter
+func (c *Client) SPLMeterConfiguration(ctx context.Context, meter int) (SPLMeterConfiguration, error) {
+	configuration := SPLMeterConfiguration{}
+	err := c.do(ctx, http.MethodGet, splMeterPath(meter, "configuration"), nil, &configuration)
+	return configuration, err
+}
+
+// SPLMeterCommand sends a command to a meter, e.g. "start" or "reset"
+func (c *Client) SPLMeterCommand(ctx context.Context, meter int, command string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, splMeterPath(meter, "command"),
+		SPLMeterCommandRequest{Command: command, Parameters: []string{}}, &message)
+	return message, err
+}
+
+// SPLMeterSubscribe registers url for the samples of a meter
+func (c *Client) SPLMeterSubscribe(ctx context.Context, meter int, url string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, splMeterPath(meter, "subscribe"), SPLMeterSubscribeRequest{Url: url}, &message)
+	return message, err
+}
+
+// SPLMeterUnsubscribe removes url from a meter
+func (c *Client) SPLMeterUnsubscribe(ctx context.Context, meter int, url string) (Message, error) {
+	message := Message{}
+	err := c.do(ctx, http.MethodPost, splMeterPath(meter, "unsubscribe"), SPLMeterSubscribeRequest{Url: url}, &message)
+	return message, err
+}
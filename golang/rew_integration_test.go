@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"spl/rew"
+	"spl/rew/rewtest"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	REW integration tests
+	- The Server talks to the rewtest fake: startInputLevels and startSPLMeters
+	  subscribe the webhooks, the fake POSTs samples to handleDBFS and handleSPL
+	- The webhook handlers run concurrently as REW posts, the test reads the
+	  REW levels through rewLevels and counts the callbacks in the fake's Stats
+	- Injected faults: error status, API latency against the client timeout,
+	  dropped callbacks and a webhook that went away
+*/
+
+const testInterval = 20 * time.Millisecond
+
+// rewHarness is a Server wired to a fake REW and a webhook server
+type rewHarness struct {
+	rew    *rewtest.Server
+	server *Server
+	hooks  *httptest.Server
+}
+
+func newREWHarness(t *testing.T, options ...rewtest.Option) *rewHarness {
+	t.Helper()
+	h := &rewHarness{rew: rewtest.NewServer(append([]rewtest.Option{rewtest.WithInterval(testInterval)}, options...)...)}
+	h.server = NewServer(h.rew.URL, NewCalfiles("ears", 1000), 100, DirectOptions{Weighting: "A", TimeWeighting: "Slow"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dbfs", h.server.handleDBFS)
+	mux.HandleFunc("/spl", h.server.handleSPL)
+	mux.HandleFunc("/ws", h.server.handleWebSocket)
+	h.hooks = httptest.NewServer(mux)
+
+	t.Cleanup(func() {
+		h.rew.Close()
+		h.hooks.Close()
+	})
+	return h
+}
+
+// callbacks is the number of samples the webhooks handled
+func (h *rewHarness) callbacks() int {
+	return h.rew.Stats().Callbacks
+}
+
+// wait polls cond until it holds or the timeout passes
+func (h *rewHarness) wait(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(testInterval / 2)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestREWInputLevels(t *testing.T) {
+	h := newREWHarness(t)
+	h.rew.SetLevel(0, -12)
+	h.rew.SetLevel(1, -30)
+
+	if err := h.server.startInputLevels(h.hooks.URL + "/dbfs"); err != nil {
+		t.Fatalf("startInputLevels: %v", err)
+	}
+	h.wait(t, "input levels", func() bool {
+		return h.server.rewLevels(0).DBFS == -12 && h.server.rewLevels(1).DBFS == -30
+	})
+
+	if err := h.server.stopInputLevels(h.hooks.URL + "/dbfs"); err != nil {
+		t.Fatalf("stopInputLevels: %v", err)
+	}
+	if inputLevels, _ := h.rew.Subscribers(); len(inputLevels) != 0 {
+		t.Fatalf("still subscribed after stopInputLevels: %v", inputLevels)
+	}
+}
+
+func TestREWSPLMeters(t *testing.T) {
+	h := newREWHarness(t)
+	h.rew.SetLevel(0, -20)
+	h.rew.SetLevel(1, -40)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(h.hooks.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("connecting to the WebSocket: %v", err)
+	}
+	defer conn.Close()
+	h.wait(t, "the WebSocket client", func() bool {
+		h.server.mu.Lock()
+		defer h.server.mu.Unlock()
+		return len(h.server.clients) == 1
+	})
+
+	if err := h.server.startSPLMeters(h.hooks.URL + "/spl"); err != nil {
+		t.Fatalf("startSPLMeters: %v", err)
+	}
+	for meter := 1; meter <= 2; meter++ {
+		configuration := h.rew.SPLMeterConfiguration(meter)
+		if configuration.Weighting != "A" || configuration.Filter != "Slow" || !configuration.RollingLeqActive {
+			t.Fatalf("meter %d configured as %+v, want the direct A weighting, Slow and a rolling Leq", meter, configuration)
+		}
+	}
+
+	// Without the rolling Leq the Leq of meter 1 runs since the start
+	configuration := h.rew.SPLMeterConfiguration(1)
+	configuration.RollingLeqActive = false
+	if _, err := h.rew.Client().SPLMeterConfigure(context.Background(), 1, configuration); err != nil {
+		t.Fatalf("configuring meter 1: %v", err)
+	}
+
+	h.wait(t, "SPL samples", func() bool {
+		return h.server.rewLevels(0).DBSPL == 80 && h.server.rewLevels(1).DBSPL == 60 && h.callbacks() >= 40
+	})
+
+	// A steady level reads the same Leq, and the SEL adds the elapsed time
+	left := h.server.rewLevels(0).SPL
+	if !near(left.Leq, 80, 0.01) || !near(left.Leq10m, 80, 0.01) {
+		t.Fatalf("Leq %.2f Leq10m %.2f, want 80", left.Leq, left.Leq10m)
+	}
+	if want := left.Leq + 10*math.Log10(left.ElapsedTime); !near(left.Sel, want, 0.5) {
+		t.Fatalf("SEL %.2f after %.2f s at Leq %.2f, want %.2f", left.Sel, left.ElapsedTime, left.Leq, want)
+	}
+
+	// A louder second half raises the Leq to the energy average
+	before := h.callbacks()
+	h.rew.SetLevel(0, -10)
+	h.wait(t, "the louder level", func() bool {
+		return h.callbacks() >= before+8 && h.server.rewLevels(0).DBSPL == 90
+	})
+	left = h.server.rewLevels(0).SPL
+	if left.Leq <= 80 || left.Leq >= 90 {
+		t.Fatalf("Leq %.2f after 80 and 90 dBSPL, want in between", left.Leq)
+	}
+	if !near(left.Leq1m, left.Leq, 0.01) {
+		t.Fatalf("Leq1m %.2f differs from Leq %.2f within the first minute", left.Leq1m, left.Leq)
+	}
+
+	// handleSPL forwards the level and the integrated values
+	names := map[string]bool{}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !names["Left_dBSPL"] || !names["Left_Leq"] || !names["Left_SEL"] || !names["Right_Leq"] {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading the WebSocket: %v, got %v", err, names)
+		}
+		metric := Metric{}
+		if err := json.Unmarshal(message, &metric); err == nil {
+			names[metric.Name] = true
+		}
+	}
+
+	if err := h.server.stopSPLMeters(h.hooks.URL + "/spl"); err != nil {
+		t.Fatalf("stopSPLMeters: %v", err)
+	}
+	if _, meters := h.rew.Subscribers(); len(meters[0]) != 0 || len(meters[1]) != 0 {
+		t.Fatalf("still subscribed after stopSPLMeters: %v", meters)
+	}
+}
+
+func TestREWErrorStatus(t *testing.T) {
+	h := newREWHarness(t)
+
+	h.rew.SetFaults(rewtest.Faults{ErrorRate: 1, ErrorStatus: http.StatusServiceUnavailable, ErrorPaths: []string{"/input-levels/command"}})
+	err := h.server.startInputLevels(h.hooks.URL + "/dbfs")
+	var rewErr *rew.Error
+	if !errors.As(err, &rewErr) || rewErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("startInputLevels returned %v, want a REW error with status 503", err)
+	}
+	if inputLevels, _ := h.rew.Subscribers(); len(inputLevels) != 0 {
+		t.Fatalf("subscribed after the start command failed: %v", inputLevels)
+	}
+
+	// The second meter fails after the first one started
+	h.rew.SetFaults(rewtest.Faults{ErrorRate: 1, ErrorPaths: []string{"/spl-meter/2/command"}})
+	err = h.server.startSPLMeters(h.hooks.URL + "/spl")
+	if !errors.As(err, &rewErr) || rewErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("startSPLMeters returned %v, want a REW error with status 500", err)
+	}
+	if _, meters := h.rew.Subscribers(); len(meters[0]) != 1 || len(meters[1]) != 0 {
+		t.Fatalf("subscribers %v, want meter 1 only", meters)
+	}
+	if stats := h.rew.Stats(); stats.Errors != 2 {
+		t.Fatalf("%d injected errors, want 2", stats.Errors)
+	}
+}
+
+func TestREWLatency(t *testing.T) {
+	h := newREWHarness(t)
+	h.rew.SetFaults(rewtest.Faults{Latency: 200 * time.Millisecond})
+
+	h.server.rewClient = h.rew.Client(rew.WithTimeout(50 * time.Millisecond))
+	if err := h.server.startSPLMeters(h.hooks.URL + "/spl"); err == nil {
+		t.Fatalf("startSPLMeters succeeded with a 50 ms timeout and 200 ms latency")
+	}
+
+	h.server.rewClient = h.rew.Client(rew.WithTimeout(time.Second))
+	if err := h.server.startSPLMeters(h.hooks.URL + "/spl"); err != nil {
+		t.Fatalf("startSPLMeters with a 1 s timeout: %v", err)
+	}
+	h.wait(t, "SPL samples", func() bool { return h.callbacks() > 0 })
+}
+
+func TestREWDroppedCallbacks(t *testing.T) {
+	h := newREWHarness(t, rewtest.WithSeed(7))
+	h.rew.SetFaults(rewtest.Faults{DropRate: 0.5})
+	h.rew.SetLevel(0, -6)
+
+	if err := h.server.startInputLevels(h.hooks.URL + "/dbfs"); err != nil {
+		t.Fatalf("startInputLevels: %v", err)
+	}
+	h.wait(t, "input levels", func() bool { return h.callbacks() >= 10 })
+	if stats := h.rew.Stats(); stats.Dropped == 0 {
+		t.Fatalf("no dropped callbacks with a drop rate of 0.5")
+	}
+	if left := h.server.rewLevels(0).DBFS; left != -6 {
+		t.Fatalf("left dBFS %.2f after dropped callbacks, want -6", left)
+	}
+
+	// The webhook goes away, REW keeps posting and the callbacks fail
+	h.hooks.CloseClientConnections()
+	h.hooks.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for h.rew.Stats().Failed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no failed callbacks after the webhook closed")
+		}
+		time.Sleep(testInterval)
+	}
+}
+
+func TestREWWebhookRequests(t *testing.T) {
+	server := NewServer("", NewCalfiles("ears", 1000), 100, DirectOptions{})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		status  int
+	}{
+		{"dBFS", server.handleDBFS, http.MethodPost, `{"unit":"dBFS","rms":[-10,-11],"peak":[-7,-8]}`, http.StatusOK},
+		{"dBFS GET", server.handleDBFS, http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"dBFS invalid", server.handleDBFS, http.MethodPost, "{", http.StatusBadRequest},
+		{"SPL", server.handleSPL, http.MethodPost, `{"meterNumber":2,"spl":71.5}`, http.StatusOK},
+		{"SPL GET", server.handleSPL, http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"SPL invalid", server.handleSPL, http.MethodPost, "[", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler(w, httptest.NewRequest(test.method, "/", strings.NewReader(test.body)))
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+	left, right := server.rewLevels(0), server.rewLevels(1)
+	if left.DBFS != -10 || right.DBFS != -11 || right.DBSPL != 71.5 || right.SPL.MeterNumber != 2 {
+		t.Fatalf("levels %.2f %.2f %.2f, want -10 -11 71.5", left.DBFS, right.DBFS, right.DBSPL)
+	}
+}
@@ -1,23 +1,23 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"sync"
-	"syscall"
 	"time"
 
+	"spl/rew"
+
 	"github.com/gorilla/websocket"
 )
 
 /*
 	Server
 	- Handle WebSocket connections
+	- Handle commands from WebSocket clients (e.g. reset)
 	- Broadcast data to WebSocket clients
 	- Start/Stop REW
 	- Select audio input device in REW
@@ -33,28 +33,65 @@ type Server struct {
 	clients     map[*websocket.Conn]bool
 	mu          sync.Mutex
 	rewEndpoint string
+	rewClient   *rew.Client // nil without REW
 	sploffset   int
+	offsets     []float64 // per channel offsets from a calibration profile, replace sploffset
 	calfiles    *CalFiles
-
+	sampleRate  float64
+	direct      DirectOptions
+
+	directMu         sync.Mutex // guards the per channel direct processing state
+	weightingFilters []*WeightingFilter
+	timeWeightings   []*TimeWeighting
+	meters           []*IntegratingMeter
+	statistics       []*LevelStatistics
+	doseFilters      []*WeightingFilter
+	doseDetectors    []*TimeWeighting
+	doses            [][]*NoiseDose // per channel: NIOSH and OSHA
+	spectra          []*SpectrumAnalyzer
+	octaves          []*OctaveAnalyzer
+	tones            []*ToneEstimator
+	calFilters       []*CalibrationFilter
+	calFilterSkip    int // filtered samples to drop until the filter delay has passed
+
+	statisticsInterval  int // samples between statistics samples
+	statisticsCountdown int // samples until the next statistics sample
+
+	rewMu            sync.Mutex // guards the REW webhook levels below
 	rewAPILeftdBFS   float64
 	rewAPIRightdBFS  float64
 	rewAPILeftdBSPL  float64
 	rewAPIRightdBSPL float64
-
-	directLeftdBFS   float64
-	directRightdBFS  float64
-	directLeftdBSPL  float64
-	directRightdBSPL float64
+	rewAPILeftSPL    rew.SPLMeterSample
+	rewAPIRightSPL   rew.SPLMeterSample
+
+	directLeftdBFS      float64 // in the -dbfs convention
+	directRightdBFS     float64
+	directLeftdBFSRMS   float64
+	directRightdBFSRMS  float64
+	directLeftdBFSSine  float64
+	directRightdBFSSine float64
+	directLeftdBSPL     float64
+	directRightdBSPL    float64
+
+	comparator *Comparator   // direct vs REW, nil when not comparing
+	recorder   *Recorder     // session recording, nil when not recording
+	replay     *Replayer     // replayed session, nil when live
+	capture    *AudioCapture // raw audio capture, nil when not capturing
 
 	counter int
 }
 
-func NewServer(rewEndpoint string, calFiles *CalFiles, sploffset int) *Server {
+func NewServer(rewEndpoint string, calFiles *CalFiles, sploffset int, direct DirectOptions) *Server {
 	var server = &Server{
 		rewEndpoint: rewEndpoint,
 		clients:     make(map[*websocket.Conn]bool),
 		sploffset:   sploffset,
 		calfiles:    calFiles,
+		direct:      direct,
+	}
+	if rewEndpoint != "" {
+		server.rewClient = rew.NewClient(rewEndpoint)
 	}
 	return server
 }
@@ -76,11 +113,20 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// Keep the connection open until the client disconnects
 	for {
-		_, _, err := conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("Client disconnected:", err)
 			break
 		}
+
+		command := Command{}
+		if err := json.Unmarshal(message, &command); err != nil {
+			log.Println("Invalid WebSocket command:", err)
+			continue
+		}
+		if err := s.handleCommand(command); err != nil {
+			log.Printf("WebSocket command '%s' failed: %v\n", command.Command, err)
+		}
 	}
 
 	s.mu.Lock()
@@ -89,14 +135,64 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	log.Println("WebSocket client disconnected")
 }
 
+/*
+	WebSocket commands
+	- {"command": "reset"} restarts the direct meters and REW's SPL meters
+	- {"command": "resetdose"} restarts the noise dose accumulation
+	- {"command": "compensation", "value": "IDF"} switches the calibration set
+	- While replaying: play, pause, seek and speed (see replay.go)
+*/
+
+type Command struct {
+	Command string `json:"command"`
+	Value   string `json:"value,omitempty"`
+}
+
+func (s *Server) handleCommand(command Command) error {
+	if s.replay != nil {
+		return s.replay.command(command)
+	}
+
+	switch command.Command {
+	case "reset":
+		s.resetDirect()
+		if s.comparator != nil {
+			s.comparator.Reset()
+		}
+		if s.rewClient == nil {
+			return nil
+		}
+		for meter := 1; meter <= 2; meter++ {
+			if err := s.splMeterCommand(meter, "reset"); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "resetdose":
+		s.resetDose()
+		return nil
+	case "compensation":
+		return s.setCompensation(command.Value)
+	default:
+		return fmt.Errorf("unknown command '%s'", command.Command)
+	}
+}
+
 func (s *Server) broadcast(name string, value float64) error {
 
 	metric := Metric{
-		Name:  name,
-		Value: value,
+		Name:         name,
+		Value:        value,
+		Compensation: s.calfiles.activeCompensation(),
 	}
 
-	body, err := json.Marshal(metric)
+	return s.broadcastJSON(metric)
+}
+
+// broadcastJSON sends any JSON message (e.g. a Metric or Spectrum) to all clients
+func (s *Server) broadcastJSON(message interface{}) error {
+
+	body, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
@@ -117,109 +213,66 @@ func (s *Server) broadcast(name string, value float64) error {
 	return nil
 }
 
-func (s *Server) startREW(url string, withgui bool) (*os.Process, error) {
-
-	path := "/Applications/REW/REW.app/Contents/MacOS/JavaApplicationStub"
-
-	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0755)
+// startREW attaches to a running REW or starts one and waits for its API
+func (s *Server) startREW(options rew.LaunchOptions) (*rew.Process, error) {
+	proc, err := rew.Launch(context.Background(), s.rewClient, options)
 	if err != nil {
 		return nil, err
 	}
 
-	args := []string{"REW.app", "-api"}
-	if !withgui {
-		args = append(args, "-nogui")
-	}
-
-	attr := &os.ProcAttr{
-		Dir:   "",
-		Env:   nil,
-		Files: []*os.File{os.Stdin, devnull, os.Stderr}, // process detachted from stdout
-		Sys: &syscall.SysProcAttr{
-			Setpgid: true, // This places the child in a new process group
-		},
-	}
-
-	proc, err := os.StartProcess(path, args, attr)
-	if err != nil {
-		return nil, err
+	if proc.Attached() {
+		fmt.Println("REW attached on:", s.rewClient.BaseURL())
+		return proc, nil
 	}
 
 	go func() {
-		_, err = proc.Wait()
-		if (err != nil) && (err.Error() != "signal: killed") {
+		<-proc.Exited()
+		if err := proc.Err(); err != nil {
 			fmt.Printf("Command finished with error: %v\n", err)
 		}
-		devnull.Close()
 	}()
 
-	fmt.Println("REW started pid:", proc.Pid)
-
-	// Need to give it some time to settle
-	time.Sleep(10000 * time.Millisecond)
-
-	// Wait for REW http to start
-	for {
-		resp, err := http.Get(url)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			resp.Body.Close()
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	// Need to give it some time to settle
-	time.Sleep(3000 * time.Millisecond)
-
-	fmt.Println("REW ready on:", url)
+	fmt.Println("REW started pid:", proc.Pid())
+	fmt.Println("REW ready on:", s.rewClient.BaseURL())
 
 	return proc, nil
 }
 
-func (s *Server) stopREW(proc *os.Process) error {
-	fmt.Println("Shutting down...", proc.Pid)
-	return proc.Signal(syscall.SIGKILL)
+// stopREW shuts a started REW down through the API, falling back to a signal
+// after timeout. An attached REW keeps running
+func (s *Server) stopREW(proc *rew.Process, timeout time.Duration) error {
+	if proc == nil || proc.Attached() {
+		return nil
+	}
+	fmt.Println("Shutting down...", proc.Pid())
+	return proc.Stop(timeout)
 }
 
-type AudioSelectInputDeviceRequest struct {
-	Device string `json:"device"`
+// REWLevels are the last REW webhook levels of one channel
+type REWLevels struct {
+	DBFS  float64
+	DBSPL float64
+	SPL   rew.SPLMeterSample
 }
 
-func (s *Server) rewSelectInputDevice(device string) error {
-	subReq := AudioSelectInputDeviceRequest{
-		Device: device,
-	}
+// rewLevels returns the last REW webhook levels of a channel
+func (s *Server) rewLevels(channel int) REWLevels {
+	s.rewMu.Lock()
+	defer s.rewMu.Unlock()
 
-	reqBody, err := json.Marshal(subReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal AudioSelectInputDeviceRequest request: %v", err)
-	}
-
-	fmt.Printf("rewEndpoint: %s\n", string(s.rewEndpoint))
-	fmt.Println(string(reqBody))
-
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/audio/java/input-device", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to post AudioSelectInputDeviceRequest request: %v", err)
+	if channel == 1 {
+		return REWLevels{s.rewAPIRightdBFS, s.rewAPIRightdBSPL, s.rewAPIRightSPL}
 	}
+	return REWLevels{s.rewAPILeftdBFS, s.rewAPILeftdBSPL, s.rewAPILeftSPL}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
+func (s *Server) rewSelectInputDevice(device string) error {
+	fmt.Printf("rewEndpoint: %s\n", s.rewClient.BaseURL())
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	message, err := s.rewClient.SelectInputDevice(context.Background(), device)
 	if err != nil {
-		return fmt.Errorf("AudioSelectInputDeviceRequest request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusAccepted {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("AudioSelectInputDeviceRequest request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
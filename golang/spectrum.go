@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+/*
+	Spectrum analyzer
+	- Windowed FFT frames with 50% overlap on the unweighted direct samples
+	- Hann, Blackman-Harris or flat-top window, power of 2 size
+	- Linear (moving average over N frames), exponential or peak-hold averaging
+	- Bin powers are scaled so a sine reads its RMS level, like the broadband dBFS
+*/
+
+type SpectrumOptions struct {
+	Size      int    // FFT size, 0 disables the analyzer
+	Window    string // "hann", "blackman-harris" or "flattop"
+	Averaging string // "none", "linear", "exponential" or "peak"
+	Averages  int    // Frames in the linear average, time constant in frames for exponential
+}
+
+type SpectrumAnalyzer struct {
+	options    SpectrumOptions
+	sampleRate float64
+	fft        *fft
+	window     *window
+
+	samples []float64 // ring of the last size samples
+	pos     int       // next write position in samples
+	hop     int       // samples between frames
+	pending int       // samples until the next frame
+
+	frame   []complex128
+	power   []float64   // power of the last frame per bin
+	average []float64   // averaged power per bin
+	history [][]float64 // last frames for the linear average
+	next    int         // next history slot to overwrite
+	frames  int         // frames since reset
+
+	// onFrame, when set, receives the (unaveraged) power of every frame
+	onFrame func(power []float64)
+}
+
+func NewSpectrumAnalyzer(options SpectrumOptions, sampleRate float64) (*SpectrumAnalyzer, error) {
+	f, err := newFFT(options.Size)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWindow(options.Window, options.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	options.Averaging = strings.ToLower(options.Averaging)
+	switch options.Averaging {
+	case "", "none":
+		options.Averaging = "none"
+	case "linear", "exponential", "peak":
+	default:
+		return nil, fmt.Errorf("unknown spectrum averaging '%s'", options.Averaging)
+	}
+	if options.Averages < 1 {
+		options.Averages = 1
+	}
+
+	bins := options.Size/2 + 1
+	a := &SpectrumAnalyzer{
+		options:    options,
+		sampleRate: sampleRate,
+		fft:        f,
+		window:     w,
+		samples:    make([]float64, options.Size),
+		hop:        options.Size / 2,
+		pending:    options.Size,
+		frame:      make([]complex128, options.Size),
+		power:      make([]float64, bins),
+		average:    make([]float64, bins),
+	}
+	if options.Averaging == "linear" {
+		a.history = make([][]float64, options.Averages)
+		for i := range a.history {
+			a.history[i] = make([]float64, bins)
+		}
+	}
+
+	return a, nil
+}
+
+// Process feeds one sample and runs an FFT when a frame is complete
+func (a *SpectrumAnalyzer) Process(x float64) {
+	a.samples[a.pos] = x
+	a.pos = (a.pos + 1) % len(a.samples)
+	a.pending--
+	if a.pending > 0 {
+		return
+	}
+	a.pending = a.hop
+	a.analyze()
+}
+
+func (a *SpectrumAnalyzer) analyze() {
+	size := len(a.samples)
+	for n := 0; n < size; n++ {
+		// Oldest sample first
+		x := a.samples[(a.pos+n)%size]
+		a.frame[n] = complex(x*a.window.coefs[n], 0)
+	}
+	a.fft.transform(a.frame)
+
+	// Scale so a sine of amplitude A in a bin gives A²/2 (its mean square)
+	scale := 2 / (a.window.sum * a.window.sum)
+	for k := range a.power {
+		re, im := real(a.frame[k]), imag(a.frame[k])
+		p := (re*re + im*im) * scale
+		if k == 0 || k == size/2 {
+			p /= 2
+		}
+		a.power[k] = p
+	}
+
+	if a.onFrame != nil {
+		a.onFrame(a.power)
+	}
+
+	a.frames++
+	switch a.options.Averaging {
+	case "none":
+		copy(a.average, a.power)
+	case "linear":
+		copy(a.history[a.next], a.power)
+		a.next = (a.next + 1) % len(a.history)
+		count := a.frames
+		if count > len(a.history) {
+			count = len(a.history)
+		}
+		for k := range a.average {
+			sum := 0.0
+			for i := 0; i < count; i++ {
+				sum += a.history[i][k]
+			}
+			a.average[k] = sum / float64(count)
+		}
+	case "exponential":
+		alpha := 1 / float64(a.options.Averages)
+		if a.frames == 1 {
+			alpha = 1
+		}
+		for k := range a.average {
+			a.average[k] += alpha * (a.power[k] - a.average[k])
+		}
+	case "peak":
+		for k := range a.average {
+			if a.power[k] > a.average[k] {
+				a.average[k] = a.power[k]
+			}
+		}
+	}
+}
+
+// Frames returns the number of frames analyzed since the last reset
+func (a *SpectrumAnalyzer) Frames() int {
+	return a.frames
+}
+
+// Frequency returns the center frequency of bin k
+func (a *SpectrumAnalyzer) Frequency(k int) float64 {
+	return float64(k) * a.sampleRate / float64(len(a.samples))
+}
+
+// Power returns the averaged power per bin in mean square units (1.0 is 0 dBFS)
+func (a *SpectrumAnalyzer) Power() []float64 {
+	return a.average
+}
+
+// ENBW returns the equivalent noise bandwidth of the window in bins, divide
+// summed bin powers by it to get the power of broadband signals
+func (a *SpectrumAnalyzer) ENBW() float64 {
+	return a.window.enbw()
+}
+
+func (a *SpectrumAnalyzer) Reset() {
+	for k := range a.average {
+		a.average[k] = 0
+	}
+	a.frames = 0
+	a.next = 0
+}
+
+// spectrumLevels converts bin powers to dBFS levels
+func spectrumLevels(power []float64) []float64 {
+	levels := make([]float64, len(power))
+	for k, p := range power {
+		levels[k] = 10 * math.Log10(p)
+	}
+	return levels
+}
+
+/*
+	Publish spectra
+	- Calibrated dBSPL per bin, using the calibration curve at each bin frequency
+	- Broadcast as {"name": "Direct_Left_Spectrum", "frequencies": [...], "values": [...]}
+*/
+
+type Spectrum struct {
+	Name         string    `json:"name"`
+	Frequencies  []float64 `json:"frequencies"`
+	Values       []float64 `json:"values"`
+	Compensation string    `json:"compensation,omitempty"`
+}
+
+// directSpectrum returns the calibrated spectrum of a channel in dBSPL
+func (s *Server) directSpectrum(channel int) (Spectrum, bool) {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	if s.spectra == nil || s.spectra[channel].Frames() == 0 {
+		return Spectrum{}, false
+	}
+
+	analyzer := s.spectra[channel]
+	levels := spectrumLevels(analyzer.Power())
+
+	spectrum := Spectrum{
+		Frequencies:  make([]float64, len(levels)),
+		Values:       make([]float64, len(levels)),
+		Compensation: s.calfiles.activeCompensation(),
+	}
+	for k, level := range levels {
+		frequency := analyzer.Frequency(k)
+		spectrum.Frequencies[k] = frequency
+		spectrum.Values[k] = floorLevel(s.adjustAt(channel, frequency, level))
+	}
+	return spectrum, true
+}
+
+func (s *Server) publishSpectrum(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		for channel, side := range []string{"Left", "Right"} {
+			spectrum, ok := s.directSpectrum(channel)
+			if !ok {
+				continue
+			}
+			spectrum.Name = "Direct_" + side + "_Spectrum"
+			if err := s.broadcastJSON(spectrum); err != nil {
+				log.Printf("Failed to broadcast %s: %v", spectrum.Name, err)
+			}
+		}
+	}
+}
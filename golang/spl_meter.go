@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
+
+	"spl/rew"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,209 +22,52 @@ import (
 	- Handle SPL Meter JSON data on callback
 	- Save SPL Meter data in server properties
 	- Forward SPL Meter JSON data to WebSocket clients
+	- Forward Leq, rolling Leq, SEL and elapsed time to WebSocket clients
 */
 
-type SPLMeterConfiguration struct {
-	Mode              string `json:"mode"`
-	Weighting         string `json:"weighting"`
-	Filter            string `json:"filter"`
-	HighPassActive    bool   `json:"highPassActive"`
-	RollingLeqActive  bool   `json:"rollingLeqActive"`
-	RollingLeqMinutes int    `json:"rollingLeqMinutes"`
-}
-
 func (s *Server) splMeterConfigure(meter int) error {
-	cfgReq := SPLMeterConfiguration{
+	message, err := s.rewClient.SPLMeterConfigure(context.Background(), meter, rew.SPLMeterConfiguration{
 		Mode:              "SPL",
-		Weighting:         "Z",
-		Filter:            "Fast",
+		Weighting:         s.direct.Weighting,     // Same weighting as the direct path
+		Filter:            s.direct.TimeWeighting, // Same time weighting as the direct path
 		HighPassActive:    true,
 		RollingLeqActive:  true,
 		RollingLeqMinutes: 1,
-	}
-
-	reqBody, err := json.Marshal(cfgReq)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal SPLMeterConfiguration: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/spl-meter/"+strconv.Itoa(meter)+"/configuration", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to post SPLMeterConfiguration request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("SPLMeterConfiguration request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("SPLMeterConfiguration request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
-type SPLMeterSubscribeParameters struct {
-}
-
-type SPLMeterSubscribeRequest struct {
-	Url        string                      `json:"url"`
-	Parameters SPLMeterSubscribeParameters `json:"parameters"`
-}
-
 func (s *Server) splMeterSubscribe(meter int, url string) error {
-	parameters := SPLMeterSubscribeParameters{}
-
-	subReq := SPLMeterSubscribeRequest{
-		Url:        url,
-		Parameters: parameters,
-	}
-
-	reqBody, err := json.Marshal(subReq)
+	message, err := s.rewClient.SPLMeterSubscribe(context.Background(), meter, url)
 	if err != nil {
-		return fmt.Errorf("failed to marshal SPLMeterSubscribeRequest request: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/spl-meter/"+strconv.Itoa(meter)+"/subscribe", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to post SPLMeterSubscribeRequest request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("SPLMeterSubscribeRequest request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("SPLMeterSubscribeRequest request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
-type SPLMeterUnsubscribeParameters struct {
-}
-
-type SPLMeterUnsubscribeRequest struct {
-	Url        string                        `json:"url"`
-	Parameters SPLMeterUnsubscribeParameters `json:"parameters"`
-}
-
 func (s *Server) splMeterUnsubscribe(meter int, url string) error {
-	parameters := SPLMeterUnsubscribeParameters{}
-
-	subReq := SPLMeterUnsubscribeRequest{
-		Url:        url,
-		Parameters: parameters,
-	}
-	reqBody, err := json.Marshal(subReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal SPLMeterUnsubscribeRequest request: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/spl-meter/"+strconv.Itoa(meter)+"/unsubscribe", bytes.NewBuffer(reqBody))
+	message, err := s.rewClient.SPLMeterUnsubscribe(context.Background(), meter, url)
 	if err != nil {
-		return fmt.Errorf("failed to post SPLMeterUnsubscribeRequest request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("SPLMeterUnsubscribeRequest request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("SPLMeterSubscribeRequest request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
-type SPLMeterCommandRequest struct {
-	Command    string   `json:"command"`
-	Parameters []string `json:"parameters"`
-}
-
 func (s *Server) splMeterCommand(meter int, command string) error {
-	parameters := []string{}
-
-	subReq := SPLMeterCommandRequest{
-		Command:    command,
-		Parameters: parameters,
-	}
-
-	reqBody, err := json.Marshal(subReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal SPLMeterCommandRequest request: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", s.rewEndpoint+"/spl-meter/"+strconv.Itoa(meter)+"/command", bytes.NewBuffer(reqBody))
+	message, err := s.rewClient.SPLMeterCommand(context.Background(), meter, command)
 	if err != nil {
-		return fmt.Errorf("failed to post SPLMeterCommandRequest request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("SPLMeterCommandRequest request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("SPLMeterCommandRequest request failed with status %d: %s", resp.StatusCode, string(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s\n", string(body))
+		return err
 	}
-
+	fmt.Printf("%s\n", message.Message)
 	return nil
 }
 
-/*
-	Http handler for SPLMeter samples
-*/
-
-type SPLMeterSample struct {
-	MeterNumber       int     `json:"meterNumber"`
-	Weighting         string  `json:"weighting"`
-	Filter            string  `json:"filter"`
-	SPL               float64 `json:"spl"`
-	Leq               float64 `json:"leq"`
-	IsRollingLeq      bool    `json:"isRollingLeq"`
-	RollingLeqMinutes float64 `json:"rollingLeqMinutes"`
-	Leq1m             float64 `json:"leq1m"`
-	Leq10m            float64 `json:"leq10m"`
-	Sel               float64 `json:"sel"`
-	ElapsedTime       float64 `json:"elapsedTime"`
-}
-
 /*
 	Adjust SPL Meter samples
 */
@@ -242,7 +87,7 @@ func (s *Server) handleSPL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify if it's valid JSON
-	sample := SPLMeterSample{}
+	sample := rew.SPLMeterSample{}
 	if err := json.Unmarshal(body, &sample); err != nil {
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
 		return
@@ -251,14 +96,26 @@ func (s *Server) handleSPL(w http.ResponseWriter, r *http.Request) {
 	label := ""
 	if sample.MeterNumber == 1 {
 		label = "Left_dBSPL"
+		s.rewMu.Lock()
 		s.rewAPILeftdBSPL = sample.SPL
+		s.rewAPILeftSPL = sample
+		s.rewMu.Unlock()
+		s.compareREW(compareDBSPL, 0, sample.SPL)
+		s.record("rew", 0, "Left_dBSPL", sample.SPL, "dBSPL")
+		s.record("rew", 0, "Left_Leq", sample.Leq, "dBSPL")
 		if err := s.broadcast("Left_dBSPL", sample.SPL); err != nil {
 			http.Error(w, "Failed to broadcast Left_dBSPL", http.StatusInternalServerError)
 			return
 		}
 	} else {
 		label = "Right_dBSPL"
+		s.rewMu.Lock()
 		s.rewAPIRightdBSPL = sample.SPL
+		s.rewAPIRightSPL = sample
+		s.rewMu.Unlock()
+		s.compareREW(compareDBSPL, 1, sample.SPL)
+		s.record("rew", 1, "Right_dBSPL", sample.SPL, "dBSPL")
+		s.record("rew", 1, "Right_Leq", sample.Leq, "dBSPL")
 		if err := s.broadcast("Right_dBSPL", sample.SPL); err != nil {
 			http.Error(w, "Failed to marshal metric JSON", http.StatusInternalServerError)
 			return
@@ -288,6 +145,13 @@ func (s *Server) handleSPL(w http.ResponseWriter, r *http.Request) {
 	}
 	s.mu.Unlock()
 
+	// Integrated values, named like the direct metrics without the "Direct_" prefix
+	prefix := strings.TrimSuffix(label, "dBSPL")
+	s.broadcastLevel(prefix+"Leq", sample.Leq)
+	s.broadcastLevel(prefix+"Leq1m", sample.Leq1m)
+	s.broadcastLevel(prefix+"Leq10m", sample.Leq10m)
+	s.broadcastLevel(prefix+"SEL", sample.Sel)
+	s.broadcastLevel(prefix+"ElapsedTime", sample.ElapsedTime)
 }
 
 /*
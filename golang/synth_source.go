@@ -0,0 +1,50 @@
+package main
+
+import "math"
+
+/*
+	Synthetic audio source
+	- Generate a stereo sine wave of a given frequency and gain
+	- Same signal on both channels, like the Web Audio test generator
+*/
+
+type synthSource struct {
+	*blockPump
+	frequency float64
+	gain      float64
+	phase     float64
+}
+
+func newSynthSource(opts AudioSourceOptions, handler AudioHandler) *synthSource {
+	s := &synthSource{
+		frequency: opts.Frequency,
+		gain:      opts.Gain,
+	}
+	s.blockPump = &blockPump{
+		sampleRate:      opts.SampleRate,
+		channels:        2,
+		framesPerBuffer: opts.FramesPerBuffer,
+		realtime:        opts.Realtime,
+		handler:         handler,
+		next:            s.next,
+	}
+	return s
+}
+
+func (s *synthSource) next(buf []float32) (int, error) {
+	step := 2 * math.Pi * s.frequency / s.sampleRate
+	frames := len(buf) / 2
+
+	for i := 0; i < frames; i++ {
+		v := float32(s.gain * math.Sin(s.phase))
+		buf[2*i] = v
+		buf[2*i+1] = v
+
+		s.phase += step
+		if s.phase >= 2*math.Pi {
+			s.phase -= 2 * math.Pi
+		}
+	}
+
+	return frames, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+/*
+	Time weighting (IEC 61672-1)
+	- Exponential averaging of the squared (frequency weighted) signal
+	- Fast: 125 ms, Slow: 1 s
+	- Impulse: 35 ms averaging followed by a peak detector with a 1.5 s decay
+	- Runs sample by sample, the level can be read at any time
+*/
+
+type TimeWeighting struct {
+	name  string
+	tau   float64 // time constant of the exponential average in seconds
+	alpha float64 // smoothing coefficient of the exponential average
+	decay float64 // decay coefficient of the Impulse peak detector, 0 when unused
+	avg   float64 // exponential average of the squared signal
+	ms    float64 // current time weighted mean square
+}
+
+// timeWeightingName returns the canonical name REW uses for a time weighting
+func timeWeightingName(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "fast", "f", "":
+		return "Fast", nil
+	case "slow", "s":
+		return "Slow", nil
+	case "impulse", "i":
+		return "Impulse", nil
+	default:
+		return "", fmt.Errorf("unknown time weighting '%s'", name)
+	}
+}
+
+func NewTimeWeighting(name string, sampleRate float64) (*TimeWeighting, error) {
+	canonical, err := timeWeightingName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	coefficient := func(tau float64) float64 {
+		return 1 - math.Exp(-1/(tau*sampleRate))
+	}
+
+	t := &TimeWeighting{name: canonical}
+	switch canonical {
+	case "Fast":
+		t.tau = 0.125
+	case "Slow":
+		t.tau = 1.0
+	case "Impulse":
+		t.tau = 0.035
+		t.decay = coefficient(1.5)
+	}
+	t.alpha = coefficient(t.tau)
+
+	return t, nil
+}
+
+func (t *TimeWeighting) Name() string {
+	return t.name
+}
+
+// SettleTime is the time the detector needs to charge from silence to
+// within 0.1 dB of a steady level
+func (t *TimeWeighting) SettleTime() time.Duration {
+	return time.Duration(5 * t.tau * float64(time.Second))
+}
+
+// Process feeds one (frequency weighted) sample into the detector
+func (t *TimeWeighting) Process(x float64) {
+	t.avg += t.alpha * (x*x - t.avg)
+
+	if t.decay == 0 {
+		t.ms = t.avg
+		return
+	}
+
+	// Impulse: follow rises immediately, decay slowly
+	if t.avg > t.ms {
+		t.ms = t.avg
+	} else {
+		t.ms -= t.decay * (t.ms - t.avg)
+	}
+}
+
+// MeanSquare returns the current time weighted mean square
+func (t *TimeWeighting) MeanSquare() float64 {
+	return t.ms
+}
+
+func (t *TimeWeighting) Reset() {
+	t.avg = 0
+	t.ms = 0
+}
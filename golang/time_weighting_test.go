@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+const timeWeightingRate = 48000
+
+// feedSine runs a 1 kHz sine of the given amplitude through the detector for
+// seconds, amplitude 0 is silence
+func feedSine(tw *TimeWeighting, amplitude, seconds float64) {
+	n := int(seconds * timeWeightingRate)
+	for i := 0; i < n; i++ {
+		tw.Process(amplitude * math.Sin(2*math.Pi*1000*float64(i)/timeWeightingRate))
+	}
+}
+
+func levelOf(tw *TimeWeighting) float64 {
+	return 10 * math.Log10(tw.MeanSquare())
+}
+
+func TestTimeWeightingDecay(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float64 // dB/s
+		from   float64 // seconds after the signal stops
+		window float64
+	}{
+		{"Fast", 34.7, 0.1, 0.5},
+		{"Slow", 4.3, 0.5, 2},
+		{"Impulse", 2.9, 0.5, 2}, // the peak detector, once the 35 ms average has dropped
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tw, err := NewTimeWeighting(test.name, timeWeightingRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			feedSine(tw, 1, 6)
+			feedSine(tw, 0, test.from)
+			start := levelOf(tw)
+			feedSine(tw, 0, test.window)
+			rate := (start - levelOf(tw)) / test.window
+			if math.Abs(rate-test.rate) > 0.1 {
+				t.Fatalf("decays at %.2f dB/s, want %.1f dB/s", rate, test.rate)
+			}
+		})
+	}
+}
+
+func TestTimeWeightingSteadySine(t *testing.T) {
+	for _, name := range []string{"Fast", "Slow", "Impulse"} {
+		t.Run(name, func(t *testing.T) {
+			tw, _ := NewTimeWeighting(name, timeWeightingRate)
+
+			// Within 0.1 dB after SettleTime and at the RMS of the sine after
+			feedSine(tw, 0.5, tw.SettleTime().Seconds())
+			if level := levelOf(tw); math.Abs(level+9.03) > 0.1 {
+				t.Fatalf("%.3f dB after the settle time, want -9.03 within 0.1 dB", level)
+			}
+			feedSine(tw, 0.5, 2)
+			if level := levelOf(tw); math.Abs(level+9.03) > 0.02 {
+				t.Fatalf("%.3f dB for a sine of 0.5, want -9.03", level)
+			}
+
+			tw.Reset()
+			if tw.MeanSquare() != 0 {
+				t.Fatalf("mean square %v after Reset", tw.MeanSquare())
+			}
+		})
+	}
+}
+
+func TestTimeWeightingName(t *testing.T) {
+	for name, want := range map[string]string{"f": "Fast", "SLOW": "Slow", "i": "Impulse", "": "Fast"} {
+		if got, err := timeWeightingName(name); err != nil || got != want {
+			t.Errorf("timeWeightingName(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := timeWeightingName("peak"); err == nil {
+		t.Errorf("timeWeightingName accepted peak")
+	}
+}
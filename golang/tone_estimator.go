@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+)
+
+/*
+	Test tone estimator
+	- Track the dominant frequency of each channel on the unweighted direct samples
+	- Hann windowed FFT frames with 50% overlap, peak bin between 20 Hz and 20 kHz
+	- Gaussian (parabolic on log power) interpolation around the peak bin
+	- Confidence is the fraction of the total power in the peak, 0 on silence
+	- Confident estimates replace -frequency in the calibration lookup
+*/
+
+const (
+	toneFFTSize       = 8192
+	toneMinFrequency  = 20.0
+	toneMaxFrequency  = 20000.0
+	tonePeakBins      = 3     // bins on each side of the peak counted as the tone
+	toneMinLevel      = -90.0 // dBFS, below this the confidence is 0
+	toneMinConfidence = 0.9   // confidence needed to follow the estimate
+)
+
+type ToneEstimator struct {
+	analyzer   *SpectrumAnalyzer
+	frequency  float64 // Hz
+	confidence float64 // 0 to 1
+	level      float64 // dBFS of the tone
+	frames     int
+}
+
+func NewToneEstimator(sampleRate float64) (*ToneEstimator, error) {
+	analyzer, err := NewSpectrumAnalyzer(SpectrumOptions{Size: toneFFTSize, Window: "hann"}, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &ToneEstimator{analyzer: analyzer, level: math.Inf(-1)}
+	analyzer.onFrame = t.estimate
+	return t, nil
+}
+
+func (t *ToneEstimator) Process(x float64) {
+	t.analyzer.Process(x)
+}
+
+func (t *ToneEstimator) estimate(power []float64) {
+	t.frames++
+
+	df := t.analyzer.Frequency(1)
+	first := int(math.Ceil(toneMinFrequency / df))
+	last := int(math.Floor(toneMaxFrequency / df))
+	if last > len(power)-2 {
+		last = len(power) - 2
+	}
+	if first < 1 {
+		first = 1
+	}
+
+	peak := first
+	total := 0.0
+	for k := first; k <= last; k++ {
+		total += power[k]
+		if power[k] > power[peak] {
+			peak = k
+		}
+	}
+
+	// Power in the main lobe, corrected for the window to a tone level
+	tone := 0.0
+	for k := peak - tonePeakBins; k <= peak+tonePeakBins; k++ {
+		if k >= 0 && k < len(power) {
+			tone += power[k]
+		}
+	}
+	tone /= t.analyzer.ENBW()
+	total /= t.analyzer.ENBW()
+
+	if total <= 0 || 10*math.Log10(total) < toneMinLevel {
+		t.confidence = 0
+		t.level = math.Inf(-1)
+		return
+	}
+
+	// Interpolate the peak on the log power, exact for a Gaussian and close for Hann
+	a := math.Log(power[peak-1])
+	b := math.Log(power[peak])
+	c := math.Log(power[peak+1])
+	delta := 0.0
+	if d := a - 2*b + c; d < 0 {
+		delta = 0.5 * (a - c) / d
+	}
+	if math.IsNaN(delta) || math.Abs(delta) > 0.5 {
+		delta = 0
+	}
+
+	t.frequency = (float64(peak) + delta) * df
+	t.confidence = math.Min(tone/total, 1)
+	t.level = 10 * math.Log10(tone)
+}
+
+// Frequency returns the last estimated tone frequency in Hz
+func (t *ToneEstimator) Frequency() float64 {
+	return t.frequency
+}
+
+// Confidence returns the fraction of the power in the tone, from 0 to 1
+func (t *ToneEstimator) Confidence() float64 {
+	return t.confidence
+}
+
+// Level returns the tone level in dBFS
+func (t *ToneEstimator) Level() float64 {
+	return t.level
+}
+
+func (t *ToneEstimator) Frames() int {
+	return t.frames
+}
+
+func (t *ToneEstimator) Reset() {
+	t.analyzer.Reset()
+	t.frequency = 0
+	t.confidence = 0
+	t.level = math.Inf(-1)
+	t.frames = 0
+}
+
+// directTone returns the estimated test tone of a channel and its confidence
+func (s *Server) directTone(channel int) (float64, float64, bool) {
+	s.directMu.Lock()
+	defer s.directMu.Unlock()
+
+	if s.tones == nil || s.tones[channel].Frames() == 0 {
+		return 0, 0, false
+	}
+	return s.tones[channel].Frequency(), s.tones[channel].Confidence(), true
+}
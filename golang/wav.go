@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+/*
+	WAV reader
+	- Parse RIFF/WAVE headers (PCM, IEEE float and WAVE_FORMAT_EXTENSIBLE)
+	- Decode 8/16/24/32-bit PCM and 32/64-bit float samples
+	- Return interleaved float32 samples scaled to [-1.0, 1.0]
+*/
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+type wavReader struct {
+	file          *os.File
+	r             *bufio.Reader
+	format        uint16
+	channels      int
+	sampleRate    float64
+	bitsPerSample int
+	blockAlign    int
+	remaining     int64 // bytes left in the data chunk
+	frame         []byte
+}
+
+func openWav(path string) (*wavReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening wav file: %w", err)
+	}
+
+	w := &wavReader{file: file, r: bufio.NewReaderSize(file, 64*1024)}
+	if err := w.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading wav file %s: %v", path, err)
+	}
+	return w, nil
+}
+
+func (w *wavReader) readHeader() error {
+	var riff [12]byte
+	if _, err := io.ReadFull(w.r, riff[:]); err != nil {
+		return err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return fmt.Errorf("not a RIFF/WAVE file")
+	}
+
+	haveFormat := false
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(w.r, hdr[:]); err != nil {
+			return fmt.Errorf("no data chunk found: %v", err)
+		}
+		id := string(hdr[0:4])
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+
+		switch id {
+		case "fmt ":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(w.r, body); err != nil {
+				return err
+			}
+			if len(body) < 16 {
+				return fmt.Errorf("fmt chunk too short")
+			}
+			w.format = binary.LittleEndian.Uint16(body[0:2])
+			w.channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			w.sampleRate = float64(binary.LittleEndian.Uint32(body[4:8]))
+			w.blockAlign = int(binary.LittleEndian.Uint16(body[12:14]))
+			w.bitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			if w.format == wavFormatExtensible {
+				if len(body) < 26 {
+					return fmt.Errorf("extensible fmt chunk too short")
+				}
+				// The sub format GUID starts with the actual format code
+				w.format = binary.LittleEndian.Uint16(body[24:26])
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return fmt.Errorf("data chunk before fmt chunk")
+			}
+			return w.checkFormat(size)
+		default:
+			if _, err := w.r.Discard(int(size)); err != nil {
+				return err
+			}
+		}
+		// Chunks are word aligned
+		if size%2 == 1 {
+			if _, err := w.r.Discard(1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *wavReader) checkFormat(dataSize int64) error {
+	switch {
+	case w.format == wavFormatPCM && (w.bitsPerSample == 8 || w.bitsPerSample == 16 || w.bitsPerSample == 24 || w.bitsPerSample == 32):
+	case w.format == wavFormatIEEEFloat && (w.bitsPerSample == 32 || w.bitsPerSample == 64):
+	default:
+		return fmt.Errorf("unsupported format %d with %d bits per sample", w.format, w.bitsPerSample)
+	}
+	if w.channels <= 0 {
+		return fmt.Errorf("invalid channel count %d", w.channels)
+	}
+	if w.blockAlign != w.channels*w.bitsPerSample/8 {
+		w.blockAlign = w.channels * w.bitsPerSample / 8
+	}
+	w.remaining = dataSize
+	w.frame = make([]byte, w.blockAlign)
+	return nil
+}
+
+func (w *wavReader) SampleRate() float64 { return w.sampleRate }
+func (w *wavReader) Channels() int       { return w.channels }
+
+// Read decodes up to len(buf)/Channels() frames into buf and returns the
+// number of frames read, or io.EOF at the end of the data chunk.
+func (w *wavReader) Read(buf []float32) (int, error) {
+	frames := 0
+	bytesPerSample := w.bitsPerSample / 8
+
+	for frames < len(buf)/w.channels {
+		if w.remaining < int64(w.blockAlign) {
+			break
+		}
+		if _, err := io.ReadFull(w.r, w.frame); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			return frames, err
+		}
+		w.remaining -= int64(w.blockAlign)
+
+		for ch := 0; ch < w.channels; ch++ {
+			b := w.frame[ch*bytesPerSample : (ch+1)*bytesPerSample]
+			buf[frames*w.channels+ch] = w.decode(b)
+		}
+		frames++
+	}
+
+	if frames == 0 {
+		return 0, io.EOF
+	}
+	return frames, nil
+}
+
+func (w *wavReader) decode(b []byte) float32 {
+	if w.format == wavFormatIEEEFloat {
+		if w.bitsPerSample == 32 {
+			return math.Float32frombits(binary.LittleEndian.Uint32(b))
+		}
+		return float32(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	}
+
+	switch w.bitsPerSample {
+	case 8:
+		return float32(int(b[0])-128) / 128
+	case 16:
+		return float32(int16(binary.LittleEndian.Uint16(b))) / 32768
+	case 24:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float32(v) / 8388608
+	default:
+		return float32(float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648)
+	}
+}
+
+func (w *wavReader) Close() error {
+	return w.file.Close()
+}
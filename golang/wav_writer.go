@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+/*
+	WAV writer
+	- 32-bit IEEE float or 24-bit PCM, interleaved float32 input
+	- Broadcast Wave (BWF) bext chunk with the description, origination date
+	  and time, and the time reference in samples since midnight
+	- The RIFF, data and fact sizes are written on Close
+	- wavMaxData keeps files below the 4 GiB RIFF limit
+*/
+
+const (
+	wavBextSize = 602
+	wavMaxData  = 0xFFFFFFFF - 4096
+)
+
+// wavFormat returns the canonical capture format
+func wavFormat(format string) (string, error) {
+	switch format {
+	case "", "float32", "float":
+		return "float32", nil
+	case "pcm24", "24":
+		return "pcm24", nil
+	default:
+		return "", fmt.Errorf("unknown capture format '%s', use float32 or pcm24", format)
+	}
+}
+
+// BextInfo is the content of the BWF bext chunk
+type BextInfo struct {
+	Description         string // up to 256 characters
+	Originator          string // up to 32 characters
+	OriginatorReference string // up to 32 characters
+	Origination         time.Time
+	CodingHistory       string
+}
+
+type wavWriter struct {
+	file           *os.File
+	w              *bufio.Writer
+	format         string
+	channels       int
+	sampleRate     int
+	bytesPerSample int
+	dataOffset     int64 // file offset of the data chunk size
+	factOffset     int64 // file offset of the fact sample count, 0 without fact chunk
+	dataSize       int64
+	buf            []byte
+}
+
+func createWav(path, format string, channels int, sampleRate float64, bext BextInfo) (*wavWriter, error) {
+	format, err := wavFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating wav file: %v", err)
+	}
+
+	w := &wavWriter{
+		file:       file,
+		w:          bufio.NewWriterSize(file, 256*1024),
+		format:     format,
+		channels:   channels,
+		sampleRate: int(sampleRate),
+	}
+	w.bytesPerSample = 4
+	if format == "pcm24" {
+		w.bytesPerSample = 3
+	}
+	if err := w.writeHeader(bext); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error writing wav file %s: %v", path, err)
+	}
+	return w, nil
+}
+
+func (w *wavWriter) writeHeader(bext BextInfo) error {
+	var header []byte
+	chunk := func(id string, body []byte) {
+		header = append(header, id...)
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(body)))
+		header = append(header, body...)
+		if len(body)%2 == 1 {
+			header = append(header, 0)
+		}
+	}
+
+	header = append(header, "RIFF\x00\x00\x00\x00WAVE"...)
+	chunk("bext", bextChunk(bext, w.sampleRate))
+
+	formatCode := uint16(wavFormatIEEEFloat)
+	if w.format == "pcm24" {
+		formatCode = wavFormatPCM
+	}
+	blockAlign := w.channels * w.bytesPerSample
+	fmtBody := binary.LittleEndian.AppendUint16(nil, formatCode)
+	fmtBody = binary.LittleEndian.AppendUint16(fmtBody, uint16(w.channels))
+	fmtBody = binary.LittleEndian.AppendUint32(fmtBody, uint32(w.sampleRate))
+	fmtBody = binary.LittleEndian.AppendUint32(fmtBody, uint32(w.sampleRate*blockAlign))
+	fmtBody = binary.LittleEndian.AppendUint16(fmtBody, uint16(blockAlign))
+	fmtBody = binary.LittleEndian.AppendUint16(fmtBody, uint16(w.bytesPerSample*8))
+	if w.format == "float32" {
+		// Non-PCM formats have a cbSize field and a fact chunk
+		fmtBody = binary.LittleEndian.AppendUint16(fmtBody, 0)
+		chunk("fmt ", fmtBody)
+		w.factOffset = int64(len(header)) + 8
+		chunk("fact", make([]byte, 4))
+	} else {
+		chunk("fmt ", fmtBody)
+	}
+
+	w.dataOffset = int64(len(header)) + 4
+	header = append(header, "data\x00\x00\x00\x00"...)
+
+	_, err := w.w.Write(header)
+	return err
+}
+
+// bextChunk builds a version 1 bext chunk
+func bextChunk(info BextInfo, sampleRate int) []byte {
+	body := make([]byte, wavBextSize, wavBextSize+len(info.CodingHistory))
+	copy(body[0:256], info.Description)
+	copy(body[256:288], info.Originator)
+	copy(body[288:320], info.OriginatorReference)
+	copy(body[320:330], info.Origination.Format("2006-01-02"))
+	copy(body[330:338], info.Origination.Format("15:04:05"))
+
+	// Samples since midnight at the first sample
+	midnight := time.Date(info.Origination.Year(), info.Origination.Month(), info.Origination.Day(), 0, 0, 0, 0, info.Origination.Location())
+	reference := uint64(info.Origination.Sub(midnight).Seconds() * float64(sampleRate))
+	binary.LittleEndian.PutUint64(body[338:346], reference)
+	binary.LittleEndian.PutUint16(body[346:348], 1)
+	// UMID and reserved bytes stay zero
+	return append(body, info.CodingHistory...)
+}
+
+// Write appends interleaved samples, full scale is 1.0
+func (w *wavWriter) Write(samples []float32) error {
+	size := len(samples) * w.bytesPerSample
+	if cap(w.buf) < size {
+		w.buf = make([]byte, size)
+	}
+	buf := w.buf[:size]
+
+	switch w.format {
+	case "pcm24":
+		for i, x := range samples {
+			v := int32(math.Round(math.Max(-1, math.Min(1, float64(x))) * 8388607))
+			buf[3*i] = byte(v)
+			buf[3*i+1] = byte(v >> 8)
+			buf[3*i+2] = byte(v >> 16)
+		}
+	default:
+		for i, x := range samples {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(x))
+		}
+	}
+
+	n, err := w.w.Write(buf)
+	w.dataSize += int64(n)
+	return err
+}
+
+// Full reports that the next block may not fit below the RIFF limit
+func (w *wavWriter) Full(samples int) bool {
+	return w.dataSize+int64(samples*w.bytesPerSample) > wavMaxData
+}
+
+// Frames returns the number of frames written
+func (w *wavWriter) Frames() int64 {
+	return w.dataSize / int64(w.channels*w.bytesPerSample)
+}
+
+// Close writes the chunk sizes and closes the file
+func (w *wavWriter) Close() error {
+	err := w.close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *wavWriter) close() error {
+	if w.dataSize%2 == 1 {
+		if err := w.w.WriteByte(0); err != nil {
+			return err
+		}
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	size := make([]byte, 4)
+	end, err := w.file.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(size, uint32(end-8))
+	if _, err := w.file.WriteAt(size, 4); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(size, uint32(w.dataSize))
+	if _, err := w.file.WriteAt(size, w.dataOffset); err != nil {
+		return err
+	}
+	if w.factOffset > 0 {
+		binary.LittleEndian.PutUint32(size, uint32(w.Frames()))
+		if _, err := w.file.WriteAt(size, w.factOffset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
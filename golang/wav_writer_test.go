@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wavChunks returns the chunks of a RIFF/WAVE file by id, and checks the
+// RIFF size
+func wavChunks(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		t.Fatalf("not a RIFF/WAVE file")
+	}
+	if size := binary.LittleEndian.Uint32(b[4:8]); int(size) != len(b)-8 {
+		t.Fatalf("RIFF size %d, file has %d bytes", size, len(b))
+	}
+	chunks := make(map[string][]byte)
+	var order []string
+	for pos := 12; pos+8 <= len(b); {
+		id := string(b[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(b[pos+4 : pos+8]))
+		chunks[id] = b[pos+8 : pos+8+size]
+		order = append(order, id)
+		pos += 8 + size + size%2
+	}
+	if order[0] != "bext" || order[len(order)-1] != "data" {
+		t.Fatalf("chunks %v, want bext first and data last", order)
+	}
+	return chunks
+}
+
+func TestWavWriterRoundTrip(t *testing.T) {
+	origination := time.Date(2026, 3, 1, 12, 30, 15, 0, time.UTC)
+	bext := BextInfo{
+		Description:         "levels direct path",
+		Originator:          "levels",
+		OriginatorReference: "20260301-123015-001",
+		Origination:         origination,
+		CodingHistory:       "A=PCM,F=48000,W=24,M=stereo,T=levels direct path\r\n",
+	}
+	tests := []struct {
+		format    string
+		code      uint16
+		bits      int
+		fmtSize   int
+		tolerance float64
+	}{
+		{"float32", wavFormatIEEEFloat, 32, 18, 0},
+		{"pcm24", wavFormatPCM, 24, 16, 2.0 / 8388608},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "capture.wav")
+			w, err := createWav(path, test.format, 2, 48000, bext)
+			if err != nil {
+				t.Fatalf("createWav: %v", err)
+			}
+			// 1001 frames in two writes, pcm24 clips beyond full scale
+			samples := make([]float32, 2*1001)
+			for i := range samples {
+				samples[i] = float32(math.Sin(float64(i) / 10))
+			}
+			samples[0], samples[1] = 1.5, -1.5
+			if err := w.Write(samples[:1000]); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Write(samples[1000:]); err != nil {
+				t.Fatal(err)
+			}
+			if w.Frames() != 1001 {
+				t.Fatalf("%d frames, want 1001", w.Frames())
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			chunks := wavChunks(t, path)
+			format := chunks["fmt "]
+			if len(format) != test.fmtSize || binary.LittleEndian.Uint16(format[0:2]) != test.code ||
+				binary.LittleEndian.Uint16(format[14:16]) != uint16(test.bits) {
+				t.Fatalf("fmt chunk %v", format)
+			}
+			if fact, ok := chunks["fact"]; ok != (test.format == "float32") || ok && binary.LittleEndian.Uint32(fact) != 1001 {
+				t.Fatalf("fact chunk %v", fact)
+			}
+			if len(chunks["data"]) != 2*1001*test.bits/8 {
+				t.Fatalf("data size %d", len(chunks["data"]))
+			}
+
+			// bext version 1: description, originator, reference, date, time,
+			// samples since midnight, version, then the coding history
+			b := chunks["bext"]
+			text := func(from, to int) string { return strings.TrimRight(string(b[from:to]), "\x00") }
+			if len(b) != wavBextSize+len(bext.CodingHistory) ||
+				text(0, 256) != bext.Description || text(256, 288) != bext.Originator ||
+				text(288, 320) != bext.OriginatorReference ||
+				text(320, 330) != "2026-03-01" || text(330, 338) != "12:30:15" ||
+				binary.LittleEndian.Uint64(b[338:346]) != (12*3600+30*60+15)*48000 ||
+				binary.LittleEndian.Uint16(b[346:348]) != 1 ||
+				string(b[wavBextSize:]) != bext.CodingHistory {
+				t.Fatalf("bext chunk %q", b)
+			}
+
+			r, err := openWav(path)
+			if err != nil {
+				t.Fatalf("openWav: %v", err)
+			}
+			defer r.Close()
+			if r.SampleRate() != 48000 || r.Channels() != 2 {
+				t.Fatalf("%v Hz %d channels", r.SampleRate(), r.Channels())
+			}
+			read := make([]float32, 4096)
+			n, err := r.Read(read)
+			if err != nil || n != 1001 {
+				t.Fatalf("read %d frames: %v", n, err)
+			}
+			if _, err := r.Read(read); err != io.EOF {
+				t.Fatalf("no EOF after the data: %v", err)
+			}
+			for i, x := range samples {
+				want := float64(x)
+				if test.format == "pcm24" {
+					want = math.Max(-1, math.Min(1, want))
+				}
+				if math.Abs(float64(read[i])-want) > test.tolerance {
+					t.Fatalf("sample %d: %v, want %v", i, read[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+/*
+	IEC 61672-1 frequency weightings
+	- A and C design goals at the exact one-third octave frequencies
+	  1000 * 10^(n/10) Hz from 10 Hz to 20 kHz
+	- Class 1 acceptance limits around the design goals, -Inf where the
+	  standard has no lower limit
+*/
+
+var weightingTable = []struct {
+	a, c         float64
+	lower, upper float64 // class 1 limits in dB
+}{
+	{-70.4, -14.3, math.Inf(-1), 3.5}, // 10 Hz
+	{-63.4, -11.2, math.Inf(-1), 3.0},
+	{-56.7, -8.5, -4.5, 2.5},
+	{-50.5, -6.2, -2.5, 2.5}, // 20 Hz
+	{-44.7, -4.4, -2.0, 2.5},
+	{-39.4, -3.0, -2.0, 2.0},
+	{-34.6, -2.0, -1.5, 1.5}, // 40 Hz
+	{-30.2, -1.3, -1.5, 1.5},
+	{-26.2, -0.8, -1.5, 1.5},
+	{-22.5, -0.5, -1.5, 1.5}, // 80 Hz
+	{-19.1, -0.3, -1.0, 1.0},
+	{-16.1, -0.2, -1.0, 1.0},
+	{-13.4, -0.1, -1.0, 1.0}, // 160 Hz
+	{-10.9, 0.0, -1.0, 1.0},
+	{-8.6, 0.0, -1.0, 1.0},
+	{-6.6, 0.0, -1.0, 1.0}, // 315 Hz
+	{-4.8, 0.0, -1.0, 1.0},
+	{-3.2, 0.0, -1.0, 1.0},
+	{-1.9, 0.0, -1.0, 1.0}, // 630 Hz
+	{-0.8, 0.0, -1.0, 1.0},
+	{0.0, 0.0, -0.7, 0.7},
+	{0.6, 0.0, -1.0, 1.0}, // 1250 Hz
+	{1.0, -0.1, -1.0, 1.0},
+	{1.2, -0.2, -1.0, 1.0},
+	{1.3, -0.3, -1.0, 1.0}, // 2500 Hz
+	{1.2, -0.5, -1.0, 1.0},
+	{1.0, -0.8, -1.0, 1.0},
+	{0.5, -1.3, -1.5, 1.5}, // 5 kHz
+	{-0.1, -2.0, -2.0, 1.5},
+	{-1.1, -3.0, -2.5, 1.5},
+	{-2.5, -4.4, -3.0, 2.0}, // 10 kHz
+	{-4.3, -6.2, -5.0, 2.0},
+	{-6.6, -8.5, -16.0, 2.5},
+	{-9.3, -11.2, math.Inf(-1), 3.0}, // 20 kHz
+}
+
+func TestWeightingClass1(t *testing.T) {
+	for _, sampleRate := range []float64{44100, 48000, 96000} {
+		for _, weighting := range []string{"A", "C", "Z"} {
+			filter, err := NewWeightingFilter(weighting, sampleRate)
+			if err != nil {
+				t.Fatalf("%s at %.0f Hz: %v", weighting, sampleRate, err)
+			}
+			if gain := 20 * math.Log10(filter.Magnitude(1000, sampleRate)); math.Abs(gain) > 1e-9 {
+				t.Fatalf("%s at %.0f Hz: %.6f dB at 1 kHz, want 0", weighting, sampleRate, gain)
+			}
+
+			for i, row := range weightingTable {
+				f := 1000 * math.Pow(10, float64(i-20)/10)
+				goal := 0.0
+				switch weighting {
+				case "A":
+					goal = row.a
+				case "C":
+					goal = row.c
+				}
+				deviation := 20*math.Log10(filter.Magnitude(f, sampleRate)) - goal
+				if deviation < row.lower || deviation > row.upper {
+					t.Errorf("%s at %.0f Hz: %.1f dB off at %.0f Hz, class 1 allows %+.1f to %+.1f dB",
+						weighting, sampleRate, deviation, f, row.lower, row.upper)
+				}
+			}
+		}
+	}
+}
+
+// The filter output of a sine matches Magnitude once it settled
+func TestWeightingProcess(t *testing.T) {
+	const sampleRate = 48000
+	for _, weighting := range []string{"A", "C"} {
+		for _, f := range []float64{50, 1000, 8000} {
+			filter, _ := NewWeightingFilter(weighting, sampleRate)
+			sum, n := 0.0, 0
+			for i := 0; i < sampleRate; i++ {
+				y := filter.Process(math.Sin(2 * math.Pi * f * float64(i) / sampleRate))
+				if i >= sampleRate/2 {
+					sum += y * y
+					n++
+				}
+			}
+			got := 10 * math.Log10(2*sum/float64(n))
+			want := 20 * math.Log10(filter.Magnitude(f, sampleRate))
+			if math.Abs(got-want) > 0.01 {
+				t.Errorf("%s weighting at %.0f Hz: %.3f dB, Magnitude says %.3f dB", weighting, f, got, want)
+			}
+		}
+	}
+}
+
+func TestWeightingErrors(t *testing.T) {
+	if _, err := NewWeightingFilter("B", 48000); err == nil {
+		t.Errorf("B weighting accepted")
+	}
+	if _, err := NewWeightingFilter("A", 16000); err == nil {
+		t.Errorf("A weighting accepted at 16 kHz")
+	}
+}
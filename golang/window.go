@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+	FFT windows
+	- Hann: general purpose
+	- Blackman-Harris (4 term): low leakage for wide dynamic range
+	- Flat-top: accurate tone amplitudes
+*/
+
+type window struct {
+	name  string
+	coefs []float64
+	sum   float64 // sum of the coefficients (coherent gain × size)
+	sumSq float64 // sum of the squared coefficients
+}
+
+func newWindow(name string, size int) (*window, error) {
+	var a []float64
+	switch strings.ToLower(name) {
+	case "hann", "hanning", "":
+		name = "hann"
+		a = []float64{0.5, 0.5}
+	case "blackman-harris", "blackmanharris", "bh":
+		name = "blackman-harris"
+		a = []float64{0.35875, 0.48829, 0.14128, 0.01168}
+	case "flattop", "flat-top":
+		name = "flattop"
+		a = []float64{0.21557895, 0.41663158, 0.277263158, 0.083578947, 0.006947368}
+	default:
+		return nil, fmt.Errorf("unknown window '%s'", name)
+	}
+
+	w := &window{name: name, coefs: make([]float64, size)}
+	for n := range w.coefs {
+		// Periodic (DFT-even) cosine sum window with alternating signs
+		v := 0.0
+		for k, ak := range a {
+			term := ak * math.Cos(2*math.Pi*float64(k)*float64(n)/float64(size))
+			if k%2 == 1 {
+				term = -term
+			}
+			v += term
+		}
+		w.coefs[n] = v
+		w.sum += v
+		w.sumSq += v * v
+	}
+
+	return w, nil
+}
+
+// enbw returns the equivalent noise bandwidth in bins
+func (w *window) enbw() float64 {
+	return float64(len(w.coefs)) * w.sumSq / (w.sum * w.sum)
+}
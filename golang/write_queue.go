@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	Write queue
+	- Shared by the session recorder and the audio capture, so the audio
+	  callback and the webhooks never wait for the disk
+	- Push queues an item without blocking, a full queue drops it
+	- A separate goroutine hands the items to write, and calls flush every
+	  second when there is one
+	- After a write error the goroutine keeps draining, so Push never blocks
+	- Close waits until the queued items are written
+*/
+
+// writeQueueFlush is the interval of the periodic flush
+const writeQueueFlush = time.Second
+
+type writeQueue[T any] struct {
+	name  string // in the log, e.g. "Recorder"
+	unit  string // what is queued, e.g. "entries"
+	items chan T
+	done  chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+func newWriteQueue[T any](name, unit string, size int) *writeQueue[T] {
+	return &writeQueue[T]{
+		name:  name,
+		unit:  unit,
+		items: make(chan T, size),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start runs the writer goroutine, flush may be nil
+func (q *writeQueue[T]) Start(write func(T) error, flush func() error) {
+	go q.run(write, flush)
+}
+
+func (q *writeQueue[T]) run(write func(T) error, flush func() error) {
+	defer close(q.done)
+
+	var tick <-chan time.Time
+	if flush != nil {
+		ticker := time.NewTicker(writeQueueFlush)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case item, ok := <-q.items:
+			if !ok {
+				return
+			}
+			if err := write(item); err != nil {
+				log.Printf("%s stopped: %v\n", q.name, err)
+				for range q.items {
+				}
+				return
+			}
+		case <-tick:
+			if err := flush(); err != nil {
+				log.Printf("%s failed to flush: %v\n", q.name, err)
+			}
+		}
+	}
+}
+
+// Push queues an item without blocking, it reports false when the item was
+// dropped or the queue is closed
+func (q *writeQueue[T]) Push(item T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	select {
+	case q.items <- item:
+		return true
+	default:
+		q.dropped++
+		return false
+	}
+}
+
+// Close waits for the queued items to be written, it reports false when the
+// queue was closed before
+func (q *writeQueue[T]) Close() bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.closed = true
+	close(q.items)
+	dropped := q.dropped
+	q.mu.Unlock()
+
+	<-q.done
+	if dropped > 0 {
+		log.Printf("%s dropped %d %s, the disk could not keep up\n", q.name, dropped, q.unit)
+	}
+	return true
+}
+
+// Dropped returns the number of items dropped because the queue was full
+func (q *writeQueue[T]) Dropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
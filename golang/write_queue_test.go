@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	release := make(chan struct{})
+	var written []int
+	q := newWriteQueue[int]("Test", "items", 2)
+	q.Start(func(item int) error {
+		<-release
+		written = append(written, item)
+		return nil
+	}, nil)
+
+	// The writer holds the first item, the queue takes two more
+	q.Push(1)
+	time.Sleep(10 * time.Millisecond)
+	for item, queued := range map[int]bool{2: true, 3: true} {
+		if q.Push(item) != queued {
+			t.Fatalf("Push(%d) = %v", item, !queued)
+		}
+	}
+	if q.Push(4) || q.Dropped() != 1 {
+		t.Fatalf("Push on a full queue, %d dropped", q.Dropped())
+	}
+
+	close(release)
+	if !q.Close() {
+		t.Fatalf("Close reported the queue closed before")
+	}
+	if len(written) != 3 || written[0] != 1 {
+		t.Fatalf("written %v, want the 3 queued items", written)
+	}
+	if q.Push(5) || q.Close() {
+		t.Fatalf("the queue accepted an item or closed twice")
+	}
+}
+
+func TestWriteQueueErrorAndFlush(t *testing.T) {
+	written := 0
+	q := newWriteQueue[int]("Test", "items", 4)
+	q.Start(func(item int) error {
+		written++
+		if item == 2 {
+			return fmt.Errorf("disk full")
+		}
+		return nil
+	}, nil)
+
+	// After the error the queue keeps draining, so Push never blocks
+	for item := 1; item <= 100; item++ {
+		q.Push(item)
+		time.Sleep(100 * time.Microsecond)
+	}
+	if q.Dropped() > 50 {
+		t.Fatalf("%d items dropped, the queue is not drained after the error", q.Dropped())
+	}
+	q.Close()
+	if written != 2 {
+		t.Fatalf("%d items written, want the writer stopped after the error", written)
+	}
+
+	// The flush runs every second
+	flushed := make(chan struct{}, 1)
+	q = newWriteQueue[int]("Test", "items", 4)
+	q.Start(func(int) error { return nil }, func() error {
+		select {
+		case flushed <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	select {
+	case <-flushed:
+	case <-time.After(3 * writeQueueFlush):
+		t.Fatalf("no flush")
+	}
+	q.Close()
+}